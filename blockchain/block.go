@@ -2,44 +2,56 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"log"
+	"runtime"
 	"time"
 )
 
 type Block struct {
-	Timestamp     int64
-	Transactions  []*Transaction
-	PrevBlockHash Hash
-	Hash          Hash
-	Nonce         int
-	Height        int
+	BlockHeader
+	Transactions []*Transaction
+	Hash         Hash
+	Height       int
 }
 
 type Hash = []byte
 
 // NewBlock Create new block by running the proof of work algorithm
 func NewBlock(transactions []*Transaction, prevBlockHash Hash, height int) *Block {
+	block, err := NewBlockContext(context.Background(), transactions, prevBlockHash, height, time.Now().Unix())
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
 
+// NewBlockContext creates a new block stamped with timestamp by running the proof of work
+// on every core, the mining is abandoned when ctx is done
+func NewBlockContext(ctx context.Context, transactions []*Transaction, prevBlockHash Hash, height int, timestamp int64) (*Block, error) {
 	block := &Block{
-		Timestamp:     time.Now().Unix(),
-		Transactions:  transactions,
-		PrevBlockHash: prevBlockHash,
-		Hash:          []byte{},
-		Nonce:         0,
-		Height:        height,
+		BlockHeader: BlockHeader{
+			Version:       blockVersion,
+			PrevBlockHash: prevBlockHash,
+			Timestamp:     timestamp,
+			Bits:          int32(targetBits()),
+			Nonce:         0,
+		},
+		Transactions: transactions,
+		Hash:         []byte{},
+		Height:       height,
 	}
+	block.MerkleRoot = block.HashTransactions()
 
 	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-	block.Hash = hash[:]
-	block.Nonce = nonce
-	return block
-}
-
-// NewGenesisBlock create the genesis block for the blockchain
-func NewGenesisBlock(coinBaseTx *Transaction) *Block {
-	return NewBlock([]*Transaction{coinBaseTx}, []byte{}, 0)
+	result, err := pow.Mine(ctx, runtime.NumCPU())
+	if err != nil {
+		return nil, err
+	}
+	block.Hash = result.Hash
+	block.Nonce = result.Nonce
+	return block, nil
 }
 
 // Serialize serializes the block
@@ -64,13 +76,25 @@ func (b *Block) HashTransactions() Hash {
 	return mTree.RootNode.Data
 }
 
+// Proof returns the merkle proof that the transaction is part of the block
+func (b *Block) Proof(txID []byte) (*MerkleProof, error) {
+	var transactions [][]byte
+	index := -1
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		transactions = append(transactions, tx.Serialize())
+	}
+	return NewMerkleTree(transactions).Proof(index)
+}
+
 // DeserializeBlock deserializes the block
-func DeserializeBlock(data []byte) *Block {
+func DeserializeBlock(data []byte) (*Block, error) {
 	var r Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&r)
-	if err != nil {
-		log.Println("Error deserializing block chain", err)
+	if err := decoder.Decode(&r); err != nil {
+		return nil, err
 	}
-	return &r
+	return &r, nil
 }
@@ -2,28 +2,45 @@ package blockchain
 
 import (
 	"blockchaincore/types"
-	"blockchaincore/utils"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"log"
 	"os"
+	"sync"
 )
 
 type Blockchain struct {
-	lastHash []byte
-	Db       *bolt.DB
+	// tipMu guards lastHash and timeSource, the chain is shared by every connection of a node
+	tipMu      sync.RWMutex
+	lastHash   []byte
+	timeSource TimeSource
+	store      ChainStore
 }
 
-const DbFile = "./db/blockchain_%s.db"
+// DbFile is the name of the chain database of a node, in the directory of the network
+const DbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const genesisCoinbaseData = "Testing"
 
 var TransactionNotFoundError = errors.New("transaction not found")
 
+var (
+	ErrInvalidProofOfWork = errors.New("invalid proof of work")
+	ErrPrevBlockNotFound  = errors.New("previous block not found")
+	ErrInvalidHeight      = errors.New("invalid block height")
+	ErrUnexpectedGenesis  = errors.New("genesis block received for a non empty chain")
+	ErrInvalidBlockTx     = errors.New("invalid transaction in block")
+	ErrInvalidTx          = errors.New("invalid transaction")
+	ErrChainNotFound      = errors.New("no existing blockchain found")
+	ErrChainExists        = errors.New("blockchain already exists")
+	ErrStaleTip           = errors.New("the tip changed while mining")
+	ErrBadMerkleRoot      = errors.New("merkle root does not match the transactions")
+	ErrGenesisMismatch    = errors.New("the chain does not start from the genesis block of the network")
+)
+
 func dbExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		log.Println("Database file not exist: ", dbFile)
@@ -32,162 +49,416 @@ func dbExists(dbFile string) bool {
 	return true
 }
 
-// CreateBlockchain creates a new blockchain DB
-func CreateBlockchain(address, nodeID string) *Blockchain {
-
-	file := fmt.Sprintf(DbFile, nodeID)
+// CreateBlockchain creates the chain DB of the node holding the genesis block of the network,
+// the following blocks are downloaded from the other nodes or mined
+func CreateBlockchain(nodeID string) (*Blockchain, error) {
+	file := DbFilePath(nodeID)
 	if dbExists(file) {
-		fmt.Println("Blockchain already exists.")
-		utils.HandleError(errors.New("blockchain already exists"))
+		return nil, ErrChainExists
 	}
 
-	var tip []byte
-
-	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, -1)
-	genesis := NewGenesisBlock(cbtx)
-	db, err := bolt.Open(file, 0600, nil)
-	utils.HandleError(err)
+	if err := CreateNetworkDir(); err != nil {
+		return nil, err
+	}
+	store, err := OpenStore(storeBackend, file)
+	if err != nil {
+		return nil, err
+	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		utils.HandleError(err)
+	bc, err := CreateBlockchainInStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return bc, nil
+}
 
-		err = b.Put(genesis.Hash, genesis.Serialize())
-		utils.HandleError(err)
-		err = b.Put([]byte("l"), genesis.Hash)
-		utils.HandleError(err)
-		tip = genesis.Hash
+// CreateBlockchainInStore stores the genesis block of the active network in an empty store
+func CreateBlockchainInStore(store ChainStore) (*Blockchain, error) {
+	genesis := activeNetwork.GenesisBlock
 
-		return nil
+	err := store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, genesis); err != nil {
+			return err
+		}
+		if err := tx.Put(blocksBucket, []byte("l"), genesis.Hash); err != nil {
+			return err
+		}
+		if err := putSchemaVersion(tx); err != nil {
+			return err
+		}
+		if err := indexBestChain(tx); err != nil {
+			return err
+		}
+		return applyBlock(tx, genesis)
 	})
-	utils.HandleError(err)
-
-	bc := Blockchain{tip, db}
-	return &bc
+	if err != nil {
+		return nil, err
+	}
+	return &Blockchain{lastHash: genesis.Hash, store: store}, nil
 }
 
-// NewBlockchain creates a new Blockchain with genesis Block and reward coinbase transaction to the first miner
-func NewBlockchain(nodeID string) *Blockchain {
-	file := fmt.Sprintf(DbFile, nodeID)
+// NewBlockchain opens the existing chain of the node, ErrChainNotFound is returned when
+// the node has no chain yet
+func NewBlockchain(nodeID string) (*Blockchain, error) {
+	file := DbFilePath(nodeID)
 
 	if dbExists(file) == false {
-		fmt.Println("No existing blockchain found. Create one first.")
-		os.Exit(1)
+		return nil, ErrChainNotFound
 	}
 
-	var tip []byte
-	db, err := bolt.Open(file, 0600, nil)
-	utils.HandleError(err)
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+	store, err := OpenStore(storeBackend, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := upgradeStore(store, file); err != nil {
+		store.Close()
+		return nil, err
+	}
+	bc, err := NewBlockchainFromStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return bc, nil
+}
 
+// NewBlockchainFromStore opens the chain kept in the store, an older layout is migrated and
+// ErrSchemaTooNew is returned for a layout written by a newer version. ErrGenesisMismatch is
+// returned for a chain of another network or of an earlier genesis block
+func NewBlockchainFromStore(store ChainStore) (*Blockchain, error) {
+	if err := upgradeStore(store, ""); err != nil {
+		return nil, err
+	}
+	var tip []byte
+	err := store.View(func(tx StoreTx) error {
+		lastHash := tx.Get(blocksBucket, []byte("l"))
+		if lastHash == nil {
+			return nil
+		}
+		if genesis := tx.Get(heightsBucket, IntToHex(0)); !bytes.Equal(genesis, activeNetwork.GenesisHash) {
+			return fmt.Errorf("%w: %x instead of %x", ErrGenesisMismatch, genesis, activeNetwork.GenesisHash)
+		}
+		tip = append([]byte{}, lastHash...)
 		return nil
 	})
-	utils.HandleError(err)
-	bc := Blockchain{tip, db}
-
-	return &bc
+	if err != nil {
+		return nil, err
+	}
+	return &Blockchain{lastHash: tip, store: store}, nil
 }
 
 // MineBlock mine a block by adding new transactions to a new created block
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	return bc.MineBlockContext(context.Background(), transactions)
+}
+
+// Generate mines count blocks paying their subsidy to address right away, on the regtest
+// network only. The blocks only hold their coinbase
+func (bc *Blockchain) Generate(count int, address string) ([]*Block, error) {
+	if !IsRegTest() {
+		return nil, ErrNotRegTest
+	}
+	if !ValidateAddress(address) {
+		return nil, ErrInvalidAddress
+	}
+
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		block, err := bc.MineBlockContext(context.Background(), []*Transaction{NewCoinbaseTX(address, "", 0)})
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// MineBlockContext mines a block on top of the current tip, the mining is abandoned when ctx
+// is done. ErrStaleTip is returned when another block was connected while mining. The block,
+// the tip and the UTXO set are updated in one transaction
+func (bc *Blockchain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	var lastHash Hash
 	var lastHeight int
 
+	inBlock := make(map[string]*Transaction)
 	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("ERROR: Invalid transaction")
+		if err := bc.ValidateTransaction(tx, inBlock); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBlockTx, err)
 		}
+		inBlock[hex.EncodeToString(tx.ID)] = tx
 	}
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-
-		lastHeight = block.Height
-		return nil
+	err := bc.store.View(func(tx StoreTx) error {
+		lastHash = append(Hash{}, tx.Get(blocksBucket, []byte("l"))...)
+		_, height, err := getHeader(tx, lastHash)
+		lastHeight = height
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	utils.HandleError(err)
+	timestamp, err := bc.nextBlockTime(lastHash)
+	if err != nil {
+		return nil, err
+	}
 
 	// create new block and do proof of work
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+	newBlock, err := NewBlockContext(ctx, transactions, lastHash, lastHeight+1, timestamp)
+	if err != nil {
+		return nil, err
+	}
 
 	// Store new block to local database
-	_ = bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
-		err = b.Put([]byte("l"), newBlock.Hash)
-		bc.lastHash = newBlock.Hash
-		utils.HandleError(err)
-		return nil
+	err = bc.store.Update(func(tx StoreTx) error {
+		if !bytes.Equal(tx.Get(blocksBucket, []byte("l")), lastHash) {
+			return ErrStaleTip
+		}
+		if err := putBlock(tx, newBlock); err != nil {
+			return err
+		}
+		if err := tx.Put(blocksBucket, []byte("l"), newBlock.Hash); err != nil {
+			return err
+		}
+		return connectTip(tx)
 	})
-	return newBlock
+	if err != nil {
+		return nil, err
+	}
+	bc.setTip(newBlock.Hash)
+	return newBlock, nil
 }
 
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
-
-		if blockInDb != nil {
+// AddBlock stores the block, the tip moves to it when it is higher than the tip. The UTXO set
+// follows the tip in the same transaction, a block which cannot be applied is not stored
+func (bc *Blockchain) AddBlock(block *Block) error {
+	var newTip []byte
+	err := bc.store.Update(func(tx StoreTx) error {
+		// The header is kept when the body is pruned
+		if tx.Get(headersBucket, block.Hash) != nil {
 			return nil
 		}
 
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
-		utils.HandleError(err)
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		lastHash := tx.Get(blocksBucket, []byte("l"))
+		if lastHash == nil {
+			// First block of an empty chain
+			newTip = block.Hash
+			if err := tx.Put(blocksBucket, []byte("l"), block.Hash); err != nil {
+				return err
+			}
+			return connectTip(tx)
+		}
+		_, lastHeight, err := getHeader(tx, lastHash)
+		if err != nil {
+			return err
+		}
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			utils.HandleError(err)
-			bc.lastHash = block.Hash
+		if block.Height > lastHeight {
+			newTip = block.Hash
+			if err := tx.Put(blocksBucket, []byte("l"), block.Hash); err != nil {
+				return err
+			}
+			return connectTip(tx)
 		}
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-
+	if newTip != nil {
+		bc.setTip(newTip)
+	}
+	return nil
 }
 
-func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+// ValidateBlock checks that the block can be connected on top of its parent, which may be on
+// a side branch: the proof of work is valid, the block matches the checkpoint of its height,
+// the parent is known, the height follows the parent, every transaction is correctly signed
+// and spends outputs left unspent by the parent branch, and the coinbase pays no more than
+// the subsidy and the fees of the block
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	if !NewProofOfWork(block).Validate() {
+		return ErrInvalidProofOfWork
+	}
+	if err := checkBlockLimits(block); err != nil {
+		return err
+	}
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w: block has no transaction", ErrInvalidBlockTx)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ErrBadMerkleRoot
+	}
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+	if err := activeNetwork.checkCheckpoint(block.Height, block.Hash); err != nil {
+		return err
+	}
+	if len(block.PrevBlockHash) == 0 {
+		if block.Height != 0 {
+			return ErrInvalidHeight
+		}
+		if bc.tip() != nil {
+			return ErrUnexpectedGenesis
+		}
+	} else {
+		_, prevHeight, err := bc.GetBlockHeader(block.PrevBlockHash)
+		if err != nil {
+			return ErrPrevBlockNotFound
+		}
+		if block.Height != prevHeight+1 {
+			return ErrInvalidHeight
+		}
+	}
+	if err := bc.checkTimestamp(&block.BlockHeader); err != nil {
+		return err
+	}
 
+	// The transactions spend the outputs left by the parent branch and the preceding
+	// transactions of the block, whichever branch the tip is on
+	var coinbases []*Transaction
+	fees := 0
+	err := bc.store.View(func(dbTx StoreTx) error {
+		view, err := utxoViewAt(dbTx, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				coinbases = append(coinbases, tx)
+			} else {
+				fee, err := validateTransaction(view, tx, nil)
+				if err != nil {
+					return fmt.Errorf("%w: %s", ErrInvalidBlockTx, err)
+				}
+				fees += fee
+			}
+			if _, err := applyTx(view, tx); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	utils.HandleError(err)
-	return lastBlock.Height
+	if err != nil {
+		return err
+	}
+	if len(coinbases) > 1 {
+		return fmt.Errorf("%w: more than one coinbase transaction", ErrInvalidBlockTx)
+	}
+	// The genesis reward is fixed by the network and checked by the first checkpoint
+	if len(coinbases) == 1 && block.Height > 0 {
+		value := 0
+		for _, out := range coinbases[0].Vout {
+			value += out.Value
+		}
+		if value > coinbaseReward(fees) {
+			return fmt.Errorf("%w: coinbase pays %d, the block collects %d", ErrInvalidBlockTx, value, coinbaseReward(fees))
+		}
+	}
+
+	return nil
 }
 
-func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
-	var block Block
+// ValidateTransaction checks that every input of the transaction refers to an unspent output
+// owned by the signer and is correctly signed, unlike VerifyTransaction it tells why it fails.
+// inBlock holds the transactions preceding tx in its block, tx may spend their outputs
+func (bc *Blockchain) ValidateTransaction(tx *Transaction, inBlock map[string]*Transaction) error {
+	return bc.store.View(func(dbTx StoreTx) error {
+		_, err := validateTransaction(dbTx, tx, inBlock)
+		return err
+	})
+}
+
+// validateTransaction is ValidateTransaction against the UTXO set of dbTx, it returns the fee
+// of tx, the value of its inputs minus the value of its outputs
+func validateTransaction(dbTx StoreTx, tx *Transaction, inBlock map[string]*Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	if len(tx.Vin) == 0 {
+		return 0, fmt.Errorf("%w: transaction %x has no input", ErrInvalidTx, tx.ID)
+	}
 
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
+	// The spent outputs are read from the UTXO set, the bodies of their blocks may be pruned
+	fee := 0
+	prevOuts := make(map[string]TXOutput)
+	for _, vin := range tx.Vin {
+		op := outpoint(vin.Txid, vin.Vout)
+		if _, ok := prevOuts[op]; ok {
+			return 0, fmt.Errorf("%w: transaction %x spends %s twice", ErrInvalidTx, tx.ID, op)
+		}
+		var prevOut TXOutput
+		if parent, ok := inBlock[hex.EncodeToString(vin.Txid)]; ok {
+			if vin.Vout < 0 || vin.Vout >= len(parent.Vout) {
+				return 0, fmt.Errorf("%w: input %s of transaction %x is not found", ErrInvalidTx, op, tx.ID)
+			}
+			prevOut = parent.Vout[vin.Vout]
+		} else {
+			out, ok, err := findOutput(dbTx, vin.Txid, vin.Vout)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				return 0, fmt.Errorf("%w: input %s of transaction %x is not unspent", ErrInvalidTx, op, tx.ID)
+			}
+			prevOut = out
+		}
+		if !prevOut.IsLockedWithKey(HashPubKey(vin.PubKey)) {
+			return 0, fmt.Errorf("%w: input of transaction %x is not owned by the signer", ErrInvalidTx, tx.ID)
+		}
+		fee += prevOut.Value
+		prevOuts[op] = prevOut
+	}
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return 0, fmt.Errorf("%w: transaction %x has a negative output", ErrInvalidTx, tx.ID)
+		}
+		fee -= out.Value
+	}
+	if fee < 0 {
+		return 0, fmt.Errorf("%w: transaction %x spends more than its inputs", ErrInvalidTx, tx.ID)
+	}
+	if !tx.VerifyOutputs(prevOuts) {
+		return 0, fmt.Errorf("%w: transaction %x has a wrong signature", ErrInvalidTx, tx.ID)
+	}
+	return fee, nil
+}
 
-		blockData := b.Get(blockHash)
+// GetBestHeight returns the height of the tip, -1 when the chain has no block yet or its tip
+// cannot be read
+func (bc *Blockchain) GetBestHeight() int {
+	height := -1
 
-		if blockData == nil {
-			return errors.New("Block is not found.")
+	err := bc.store.View(func(tx StoreTx) error {
+		lastHash := tx.Get(blocksBucket, []byte("l"))
+		if lastHash == nil {
+			return nil
 		}
+		_, lastHeight, err := getHeader(tx, lastHash)
+		height = lastHeight
+		return err
+	})
+	if err != nil {
+		log.Println("Cannot read the tip: ", err)
+		return -1
+	}
+	return height
+}
 
-		block = *DeserializeBlock(blockData)
+func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
+	var block Block
 
+	err := bc.store.View(func(tx StoreTx) error {
+		found, err := getBlock(tx, blockHash)
+		if err != nil {
+			return err
+		}
+		block = *found
 		return nil
 	})
 	if err != nil {
@@ -197,155 +468,329 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
+func (bc *Blockchain) tip() []byte {
+	bc.tipMu.RLock()
+	defer bc.tipMu.RUnlock()
+	return bc.lastHash
+}
+
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	bc.lastHash = hash
+}
+
 // Iterator create new iterator to traverse the blockchain
 func (bc *Blockchain) Iterator() *BlockChainIterator {
-	bci := &BlockChainIterator{bc.lastHash, bc.Db}
+	bci := &BlockChainIterator{currentHash: bc.tip(), store: bc.store}
 	return bci
 }
 
-func (bc *Blockchain) GetBlockHashes() [][]byte {
+// GetBlockHashes returns the hashes of the chain from the tip down to the genesis block,
+// only the headers are read so that the pruned blocks are listed too
+func (bc *Blockchain) GetBlockHashes() ([][]byte, error) {
 	var blocks [][]byte
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
+	err := bc.store.View(func(tx StoreTx) error {
+		for hash := bc.tip(); len(hash) > 0; {
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, append([]byte{}, hash...))
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	return blocks, err
+}
 
-		blocks = append(blocks, block.Hash)
+// GetBlockHashesAfter returns the hashes of the blocks following fromHash up to the tip,
+// ordered from the lowest to the highest block. When fromHash is not in the chain
+// the whole chain is returned starting from the genesis block
+func (bc *Blockchain) GetBlockHashesAfter(fromHash []byte) ([][]byte, error) {
+	hashes, err := bc.GetBlockHashes()
+	if err != nil {
+		return nil, err
+	}
 
-		if len(block.PrevBlockHash) == 0 {
+	for i, hash := range hashes {
+		if bytes.Equal(hash, fromHash) {
+			hashes = hashes[:i]
 			break
 		}
 	}
 
-	return blocks
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return hashes, nil
+}
+
+// connectTip updates the UTXO set and the height index and prunes the old bodies in the
+// transaction moving the tip, a crash leaves either the previous or the new tip with its UTXO set
+func connectTip(tx StoreTx) error {
+	if err := catchUpUTXO(tx); err != nil {
+		return err
+	}
+	if err := indexBestChain(tx); err != nil {
+		return err
+	}
+	return pruneBodies(tx)
 }
 
 // Close the underlying database of blockchain
-func (bc *Blockchain) Close() {
-	err := bc.Db.Close()
-	utils.HandleError(err)
+func (bc *Blockchain) Close() error {
+	return bc.store.Close()
 }
 
-// SignTransaction Sign transaction by private key
+// SignTransaction Sign transaction by private key, the spent outputs must be unspent in the chain
 func (bc *Blockchain) SignTransaction(t *Transaction, key ecdsa.PrivateKey) error {
-
-	// key is transaction id mapping to transaction
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range t.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			return fmt.Errorf("%w Not found transaction by id", err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevOuts, err := UTXOSet{bc}.FindPrevOutputs(t)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTx, err)
 	}
-	t.Sign(key, prevTXs)
-	return nil
+	return t.SignOutputs(key, prevOuts)
 }
 
 // FindTransaction find transaction by transaction id
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
 
-	for {
-		block := bci.Next()
-
+	for block := bci.Next(); block != nil; block = bci.Next() {
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
 				return *tx, nil
 			}
 		}
+	}
+	if err := bci.Err(); err != nil {
+		return Transaction{}, err
+	}
 
-		// Hit the genesis block
-		if len(block.PrevBlockHash) == 0 {
-			break
+	return Transaction{}, TransactionNotFoundError
+}
+
+// FindTransactionBlock returns the block including the transaction
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
+	bci := bc.Iterator()
+
+	for block := bci.Next(); block != nil; block = bci.Next() {
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, nil
+			}
 		}
 	}
+	if err := bci.Err(); err != nil {
+		return nil, err
+	}
 
-	return Transaction{}, TransactionNotFoundError
+	return nil, TransactionNotFoundError
+}
+
+// TxProof is a transaction with the proof that its block commits to it
+type TxProof struct {
+	BlockHash []byte
+	Tx        *Transaction
+	Proof     *MerkleProof
+}
+
+// FindTransactionProofs returns the transactions of the blocks following fromHash paying to or
+// spending from one of the public key hashes, oldest first. The whole chain is searched when
+// fromHash is not part of it
+func (bc *Blockchain) FindTransactionProofs(pubKeyHashes [][]byte, fromHash []byte) ([]TxProof, error) {
+	tip := bc.tip()
+	if tip == nil {
+		return nil, ErrChainNotFound
+	}
+
+	var hashes [][]byte
+	err := bc.store.View(func(tx StoreTx) error {
+		for hash := tip; len(hash) > 0 && !bytes.Equal(hash, fromHash); {
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return bc.FindBlockTransactionProofs(pubKeyHashes, hashes)
+}
+
+// FindBlockTransactionProofs returns the transactions of the blocks paying to or spending from
+// one of the public key hashes, in the order of the blocks. The blocks whose filter does not
+// match any key are skipped without reading their body
+func (bc *Blockchain) FindBlockTransactionProofs(pubKeyHashes [][]byte, blockHashes [][]byte) ([]TxProof, error) {
+	var proofs []TxProof
+	for _, hash := range blockHashes {
+		filter, err := bc.GetBlockFilter(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.MatchAny(hash, pubKeyHashes) {
+			continue
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions {
+			if !concernsKeys(tx, pubKeyHashes) {
+				continue
+			}
+			proof, err := block.Proof(tx.ID)
+			if err != nil {
+				return nil, err
+			}
+			proofs = append(proofs, TxProof{block.Hash, tx, proof})
+		}
+	}
+	return proofs, nil
+}
+
+// concernsKeys tells whether the transaction pays to or spends from one of the public key hashes
+func concernsKeys(tx *Transaction, pubKeyHashes [][]byte) bool {
+	for _, pubKeyHash := range pubKeyHashes {
+		for _, out := range tx.Vout {
+			if out.IsLockedWithKey(pubKeyHash) {
+				return true
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			if in.UsesKey(pubKeyHash) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // FindPreviousTransactions Find previous transaction related to the current transaction
-func (bc *Blockchain) FindPreviousTransactions(tx *Transaction) map[string]Transaction {
+func (bc *Blockchain) FindPreviousTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
 		prevTX, err := bc.FindTransaction(vin.Txid)
-		utils.HandleError(err)
+		if err != nil {
+			return nil, err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-	return prevTXs
+	return prevTXs, nil
 }
 
-// VerifyTransaction verify transaction
+// VerifyTransaction verify transaction, it is false when an input refers to an unknown or spent output
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
-	prevTXs := bc.FindPreviousTransactions(tx)
-	return tx.Verify(prevTXs)
+	prevOuts, err := UTXOSet{bc}.FindPrevOutputs(tx)
+	if err != nil {
+		return false
+	}
+	return tx.VerifyOutputs(prevOuts)
 }
 
 // FindUnspentTransactions Find unspent transactions by address
-func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
+func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) ([]Transaction, error) {
 	var unspentTxs []Transaction
 	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-	Transactions:
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				// Was the output spent ?
-
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							// Skip that output since it was already referenced in an input
-							continue Outputs
+	tip := bc.tip()
+
+	// Only the headers and the filters are read for the blocks not concerning the key
+	err := bc.store.View(func(dbTx StoreTx) error {
+		for hash := tip; len(hash) > 0; {
+			if !matchBlock(dbTx, hash, pubKeyHash) {
+				header, _, err := getHeader(dbTx, hash)
+				if err != nil {
+					return err
+				}
+				hash = header.PrevBlockHash
+				continue
+			}
+			block, err := getBlock(dbTx, hash)
+			if err != nil {
+				return err
+			}
+			hash = block.PrevBlockHash
+
+		Transactions:
+			for _, tx := range block.Transactions {
+				txID := hex.EncodeToString(tx.ID)
+
+			Outputs:
+				for outIdx, out := range tx.Vout {
+					// Was the output spent ?
+
+					if spentTXOs[txID] != nil {
+						for _, spentOutIdx := range spentTXOs[txID] {
+							if spentOutIdx == outIdx {
+								// Skip that output since it was already referenced in an input
+								continue Outputs
+							}
 						}
 					}
+					// Check for the OutputTx is belonged to address
+					if out.IsLockedWithKey(pubKeyHash) {
+						unspentTxs = append(unspentTxs, *tx)
+					}
 				}
-				// Check for the OutputTx is belonged to address
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTxs = append(unspentTxs, *tx)
-				}
-			}
 
-			if tx.IsCoinbase() { // Skip the coinbase transaction
-				continue Transactions
-			}
+				if tx.IsCoinbase() { // Skip the coinbase transaction
+					continue Transactions
+				}
 
-			for _, in := range tx.Vin {
-				if in.UsesKey(pubKeyHash) {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+				for _, in := range tx.Vin {
+					if in.UsesKey(pubKeyHash) {
+						inTxID := hex.EncodeToString(in.Txid)
+						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+					}
 				}
 			}
 		}
-
-		// Break if that is genesis block
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return unspentTxs
+	return unspentTxs, nil
 }
 
 // FindUTXO Find all unspent transaction outputs in blockchain
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+func (bc *Blockchain) FindUTXO() (map[string]TXOutputs, error) {
+	var UTXO map[string]TXOutputs
+	err := bc.store.View(func(tx StoreTx) error {
+		var err error
+		UTXO, err = findUTXO(tx, bc.tip())
+		return err
+	})
+	return UTXO, err
+}
+
+// findUTXO walks the chain down from tip to find its unspent outputs
+func findUTXO(dbTx StoreTx, tip []byte) (map[string]TXOutputs, error) {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
 
+	for hash := tip; len(hash) > 0; {
+		block, err := getBlock(dbTx, hash)
+		if err != nil {
+			return nil, err
+		}
+		hash = block.PrevBlockHash
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 
@@ -361,7 +806,7 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 				}
 
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs.Add(outIdx, out)
 				UTXO[txID] = outs
 			}
 
@@ -372,32 +817,20 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 				}
 			}
 		}
-
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
 	}
 
-	return UTXO
+	return UTXO, nil
 }
 
+// GetLastHash returns the hash of the tip, empty when the chain has no block yet
 func (bc *Blockchain) GetLastHash() string {
-	var lastHash []byte
-	err := bc.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-		return nil
-	})
-	utils.HandleError(err)
-	return string(lastHash)
+	return string(bc.tip())
 }
 
 func (bc *Blockchain) GetBlockByHeight(height int) (*types.BlockInfo, error) {
 	it := bc.Iterator()
 
-	for {
-		block := it.Next()
-
+	for block := it.Next(); block != nil; block = it.Next() {
 		var reward = 0
 
 		for i := range block.Transactions {
@@ -415,20 +848,18 @@ func (bc *Blockchain) GetBlockByHeight(height int) (*types.BlockInfo, error) {
 				BlockReward: reward,
 			}, nil
 		}
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
-
 	}
-	return nil, errors.New("block not found")
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrBlockNotFound
 }
 
 var TxNotFound = errors.New("transaction not found")
 
 func (bc *Blockchain) GetTransaction(txId string) (*types.TransactionInfo, error) {
 	it := bc.Iterator()
-	for {
-		block := it.Next()
+	for block := it.Next(); block != nil; block = it.Next() {
 		for _, tx := range block.Transactions {
 			if hex.EncodeToString(tx.ID) == txId {
 				return &types.TransactionInfo{
@@ -442,9 +873,9 @@ func (bc *Blockchain) GetTransaction(txId string) (*types.TransactionInfo, error
 				}, nil
 			}
 		}
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
 	return nil, TxNotFound
 }
@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBadRequestsReturnErrors(t *testing.T) {
+	sender, receiver := NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+
+	_, err := NewBlockchain("missing")
+	assert.ErrorIs(t, err, ErrChainNotFound)
+	_, err = CreateBlockchain("test")
+	assert.ErrorIs(t, err, ErrChainExists)
+
+	_, err = NewUTXOTransaction(sender, string(receiver.GetAddress()), 1000, utxoSet)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	_, err = NewUTXOTransaction(receiver, string(sender.GetAddress()), 10, utxoSet)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	_, err = NewUTXOTransaction(sender, "invalid", 10, utxoSet)
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = NewUTXOTransaction(sender, string(receiver.GetAddress()), 0, utxoSet)
+	assert.ErrorIs(t, err, ErrInvalidTx)
+
+	// The input refers to an output the chain does not have
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	tx.Vin[0].Vout = 7
+	assert.ErrorIs(t, bc.SignTransaction(tx, sender.PrivateKey), ErrInvalidTx)
+	assert.False(t, bc.VerifyTransaction(tx))
+
+	wallets := Wallets{Wallets: map[string]*Wallet{}}
+	_, err = wallets.FromPrivateKey("not a key")
+	assert.ErrorIs(t, err, ErrInvalidPrivateKey)
+	_, err = DeserializeBlock([]byte("garbage"))
+	assert.Error(t, err)
+	_, err = DeserializeTransaction([]byte("garbage"))
+	assert.Error(t, err)
+}
+
+func TestInflatedCoinbaseIsRejected(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	sender, receiver := NewWallet(), NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	blocks, err := bc.Generate(1, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, &UTXOSet{bc})
+	assert.NoError(t, err)
+
+	newBlock := func(coinbase *Transaction) *Block {
+		block, err := NewBlockContext(context.Background(), []*Transaction{tx, coinbase}, blocks[0].Hash, 2, blocks[0].Timestamp+1)
+		assert.NoError(t, err)
+		return block
+	}
+	inflated := newBlock(NewCoinbaseTX(string(sender.GetAddress()), "", tx.TransactionFee+100))
+	assert.ErrorIs(t, bc.ValidateBlock(inflated), ErrInvalidBlockTx)
+	assert.NoError(t, bc.ValidateBlock(newBlock(NewCoinbaseTX(string(sender.GetAddress()), "", tx.TransactionFee))))
+}
+
+func TestSideBranchIsValidatedAgainstItsOwnOutputs(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	sender, receiver, other := NewWallet(), NewWallet(), NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	funding, err := bc.Generate(1, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	_, err = bc.Generate(1, string(other.GetAddress()))
+	assert.NoError(t, err)
+
+	// Both spend the output of the sender, which is unspent on the best chain
+	payment, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, &UTXOSet{bc})
+	assert.NoError(t, err)
+	doubleSpend, err := NewUTXOTransaction(sender, string(other.GetAddress()), 20, &UTXOSet{bc})
+	assert.NoError(t, err)
+	newBlock := func(prev *Block, tx *Transaction) *Block {
+		coinbase := NewCoinbaseTX(string(other.GetAddress()), "", tx.TransactionFee)
+		block, err := NewBlockContext(context.Background(), []*Transaction{tx, coinbase}, prev.Hash, prev.Height+1, prev.Timestamp+1)
+		assert.NoError(t, err)
+		return block
+	}
+
+	side := newBlock(funding[0], payment)
+	assert.NoError(t, bc.ValidateBlock(side))
+	assert.NoError(t, bc.AddBlock(side))
+	assert.Equal(t, 2, bc.GetBestHeight())
+	assert.NotEqual(t, string(side.Hash), bc.GetLastHash())
+
+	// The side branch spent the output already
+	assert.ErrorIs(t, bc.ValidateBlock(newBlock(side, doubleSpend)), ErrInvalidBlockTx)
+
+	// The side branch created the spent output
+	spend, err := NewTransactionFromOutputs(receiver, string(sender.GetAddress()), 9, 10,
+		map[string][]int{hex.EncodeToString(payment.ID): {0}}, map[string]Transaction{hex.EncodeToString(payment.ID): *payment})
+	assert.NoError(t, err)
+	longer := newBlock(side, spend)
+	assert.NoError(t, bc.ValidateBlock(longer))
+	assert.NoError(t, bc.AddBlock(longer))
+	assert.Equal(t, string(longer.Hash), bc.GetLastHash())
+	assert.Zero(t, balanceOf(t, bc, receiver))
+	assert.Equal(t, RegTest.BlockSubsidy-10-CalcTxFee(10)+9, balanceOf(t, bc, sender))
+}
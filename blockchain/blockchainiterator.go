@@ -1,21 +1,32 @@
 package blockchain
 
-import "github.com/boltdb/bolt"
-
 type BlockChainIterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	store       ChainStore
+	err         error
 }
 
-// Next return next block starting from the last block utils
+// Next return next block starting from the last block utils, nil once the genesis block
+// was returned or when the block cannot be read (see Err)
 func (iter *BlockChainIterator) Next() *Block {
-	var block *Block
-	iter.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(iter.currentHash)
-		block = DeserializeBlock(encodedBlock)
+	if len(iter.currentHash) == 0 || iter.err != nil {
 		return nil
+	}
+	var block *Block
+	err := iter.store.View(func(tx StoreTx) error {
+		var err error
+		block, err = getBlock(tx, iter.currentHash)
+		return err
 	})
+	if err != nil {
+		iter.err = err
+		return nil
+	}
 	iter.currentHash = block.PrevBlockHash
 	return block
 }
+
+// Err returns the error which stopped the iteration, nil when it reached the genesis block
+func (iter *BlockChainIterator) Err() error {
+	return iter.err
+}
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const blockVersion = 1
+
+const (
+	hashLength = 32
+	// BlockHeaderLength is the size of a serialized header, the nonce is its last 8 bytes
+	BlockHeaderLength = 4 + hashLength + hashLength + 8 + 4 + 8
+)
+
+var ErrInvalidHeader = errors.New("invalid block header")
+
+// BlockHeader is the part of a block covered by the proof of work, the transactions are
+// committed by the merkle root so a header can be checked without the block body
+type BlockHeader struct {
+	Version       int32
+	PrevBlockHash Hash
+	MerkleRoot    Hash
+	Timestamp     int64
+	Bits          int32
+	Nonce         int
+}
+
+// Serialize returns the canonical encoding of the header: fixed size big endian fields in
+// order, an empty previous hash (genesis block) is encoded as zeros
+func (h *BlockHeader) Serialize() []byte {
+	data := make([]byte, BlockHeaderLength)
+	binary.BigEndian.PutUint32(data[0:], uint32(h.Version))
+	copy(data[4:4+hashLength], h.PrevBlockHash)
+	copy(data[4+hashLength:4+2*hashLength], h.MerkleRoot)
+	binary.BigEndian.PutUint64(data[4+2*hashLength:], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(data[12+2*hashLength:], uint32(h.Bits))
+	binary.BigEndian.PutUint64(data[16+2*hashLength:], uint64(h.Nonce))
+	return data
+}
+
+// DeserializeBlockHeader decodes a header encoded by Serialize
+func DeserializeBlockHeader(data []byte) (*BlockHeader, error) {
+	if len(data) != BlockHeaderLength {
+		return nil, ErrInvalidHeader
+	}
+	h := &BlockHeader{
+		Version:    int32(binary.BigEndian.Uint32(data[0:])),
+		MerkleRoot: append(Hash{}, data[4+hashLength:4+2*hashLength]...),
+		Timestamp:  int64(binary.BigEndian.Uint64(data[4+2*hashLength:])),
+		Bits:       int32(binary.BigEndian.Uint32(data[12+2*hashLength:])),
+		Nonce:      int(binary.BigEndian.Uint64(data[16+2*hashLength:])),
+	}
+	prev := data[4 : 4+hashLength]
+	if !bytes.Equal(prev, make([]byte, hashLength)) {
+		h.PrevBlockHash = append(Hash{}, prev...)
+	}
+	return h, nil
+}
+
+// BlockHash returns the hash identifying the block of the header
+func (h *BlockHeader) BlockHash() Hash {
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockHeadersAreStoredAndServed(t *testing.T) {
+	wallet := NewWallet()
+	bc := newTestChain(t, wallet)
+	genesis, err := bc.GetBlock(MainNet.GenesisHash)
+	assert.NoError(t, err)
+	block, err := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)})
+	assert.NoError(t, err)
+
+	// The canonical encoding round trips, the genesis previous hash stays empty
+	encoded := genesis.BlockHeader.Serialize()
+	assert.Len(t, encoded, BlockHeaderLength)
+	decoded, err := DeserializeBlockHeader(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, genesis.BlockHeader, *decoded)
+	assert.Equal(t, genesis.Hash, decoded.BlockHash())
+
+	header, height, err := bc.GetBlockHeader(block.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, height)
+	assert.True(t, NewHeaderProofOfWork(header).Validate())
+
+	headers := bc.GetHeadersAfter(nil, MaxHeadersPerMessage)
+	assert.Len(t, headers, 3)
+	assert.Equal(t, block.Hash, headers[2].BlockHash())
+	assert.Len(t, bc.GetHeadersAfter(genesis.Hash, MaxHeadersPerMessage), 2)
+
+	// The merkle root commits to the transactions
+	block.Transactions = []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)}
+	assert.ErrorIs(t, bc.ValidateBlock(block), ErrBadMerkleRoot)
+}
+
+func TestHeadersAreKeptUntilTheirBlocksArrive(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet := NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	tip := RegTest.GenesisBlock
+
+	var blocks []*Block
+	var headers []*BlockHeader
+	prev := tip
+	for height := 1; height <= 3; height++ {
+		coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 0)
+		block, err := NewBlockContext(context.Background(), []*Transaction{coinbase}, prev.Hash, height, prev.Timestamp+1)
+		assert.NoError(t, err)
+		blocks = append(blocks, block)
+		headers = append(headers, &block.BlockHeader)
+		prev = block
+	}
+
+	// Headers which do not connect are refused, the first ones are kept apart from the chain
+	_, err = bc.AddHeaders(headers[1:])
+	assert.ErrorIs(t, err, ErrPrevBlockNotFound)
+	missing, err := bc.AddHeaders(append([]*BlockHeader{&tip.BlockHeader}, headers[:2]...))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{blocks[0].Hash, blocks[1].Hash}, missing)
+	assert.False(t, bc.HasBlock(blocks[0].Hash))
+
+	// The next header follows a kept one, a stored block leaves the pending headers
+	missing, err = bc.AddHeaders(headers[2:])
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{blocks[2].Hash}, missing)
+	assert.NoError(t, bc.AddBlock(blocks[0]))
+	missing, err = bc.AddHeaders(headers)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{blocks[1].Hash, blocks[2].Hash}, missing)
+	err = bc.store.View(func(tx StoreTx) error {
+		assert.Nil(t, tx.Get(pendingHeadersBucket, blocks[0].Hash))
+		return nil
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,238 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// headersBucket maps a block hash to its header and height, the blocks bucket holds the bodies
+const headersBucket = "headers"
+
+// heightsBucket maps the heights of the best chain to the hashes of its blocks
+const heightsBucket = "heights"
+
+// pendingHeadersBucket holds the checked headers whose blocks are not downloaded yet, with
+// their heights. A header leaves it when its block is stored
+const pendingHeadersBucket = "pendingheaders"
+
+// MaxHeadersPerMessage is the maximum number of headers returned at once
+const MaxHeadersPerMessage = 2000
+
+var ErrBlockNotFound = errors.New("block is not found")
+
+// blockBody is the part of a block stored apart from its header
+type blockBody struct {
+	Transactions []*Transaction
+}
+
+// headerRecord is a header as stored in the headers bucket
+type headerRecord struct {
+	Header []byte
+	Height int
+}
+
+// putBlock stores the header, the filter and the body of the block
+func putBlock(tx StoreTx, block *Block) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(blockBody{block.Transactions}); err != nil {
+		return err
+	}
+	if err := putHeader(tx, &block.BlockHeader, block.Hash, block.Height); err != nil {
+		return err
+	}
+	if err := putFilter(tx, block); err != nil {
+		return err
+	}
+	if err := tx.Delete(pendingHeadersBucket, block.Hash); err != nil {
+		return err
+	}
+	return tx.Put(blocksBucket, block.Hash, body.Bytes())
+}
+
+// putHeader stores the header of the block and its height
+func putHeader(tx StoreTx, header *BlockHeader, hash []byte, height int) error {
+	return putHeaderIn(tx, headersBucket, header, hash, height)
+}
+
+func putHeaderIn(tx StoreTx, bucket string, header *BlockHeader, hash []byte, height int) error {
+	var record bytes.Buffer
+	if err := gob.NewEncoder(&record).Encode(headerRecord{header.Serialize(), height}); err != nil {
+		return err
+	}
+	return tx.Put(bucket, hash, record.Bytes())
+}
+
+// getHeader reads the header of the block and its height
+func getHeader(tx StoreTx, hash []byte) (*BlockHeader, int, error) {
+	return getHeaderIn(tx, headersBucket, hash)
+}
+
+// getKnownHeader reads the header of a stored block or a pending header
+func getKnownHeader(tx StoreTx, hash []byte) (*BlockHeader, int, error) {
+	header, height, err := getHeader(tx, hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return getHeaderIn(tx, pendingHeadersBucket, hash)
+	}
+	return header, height, err
+}
+
+func getHeaderIn(tx StoreTx, bucket string, hash []byte) (*BlockHeader, int, error) {
+	data := tx.Get(bucket, hash)
+	if data == nil {
+		return nil, 0, ErrBlockNotFound
+	}
+	var record headerRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+		return nil, 0, err
+	}
+	header, err := DeserializeBlockHeader(record.Header)
+	return header, record.Height, err
+}
+
+// getBlock reads the header and the body of the block, ErrBlockPruned is returned when only
+// the header is left
+func getBlock(tx StoreTx, hash []byte) (*Block, error) {
+	header, height, err := getHeader(tx, hash)
+	if err != nil {
+		return nil, err
+	}
+	data := tx.Get(blocksBucket, hash)
+	if data == nil {
+		return nil, ErrBlockPruned
+	}
+	var body blockBody
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &Block{
+		BlockHeader:  *header,
+		Transactions: body.Transactions,
+		Hash:         append(Hash{}, hash...),
+		Height:       height,
+	}, nil
+}
+
+// GetBlockHeader returns the header of the block and its height
+func (bc *Blockchain) GetBlockHeader(hash []byte) (*BlockHeader, int, error) {
+	var header *BlockHeader
+	var height int
+	err := bc.store.View(func(tx StoreTx) error {
+		var err error
+		header, height, err = getHeader(tx, hash)
+		return err
+	})
+	return header, height, err
+}
+
+// GetHeadersAfter returns at most max headers of the chain following fromHash in ascending
+// order, starting from the genesis block when fromHash is not part of the chain
+func (bc *Blockchain) GetHeadersAfter(fromHash []byte, max int) []*BlockHeader {
+	var headers []*BlockHeader
+	_ = bc.store.View(func(tx StoreTx) error {
+		height := 0
+		if _, fromHeight, err := getHeader(tx, fromHash); err == nil && bytes.Equal(tx.Get(heightsBucket, IntToHex(int64(fromHeight))), fromHash) {
+			height = fromHeight + 1
+		}
+		for ; len(headers) < max; height++ {
+			hash := tx.Get(heightsBucket, IntToHex(int64(height)))
+			if hash == nil {
+				return nil
+			}
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+		return nil
+	})
+	return headers
+}
+
+// indexBestChain makes the heights bucket follow the tip: the heights above the tip are
+// dropped and the blocks are indexed from the tip down to the first one already indexed
+func indexBestChain(tx StoreTx) error {
+	hash := tx.Get(blocksBucket, []byte("l"))
+	if len(hash) == 0 {
+		return nil
+	}
+	_, height, err := getHeader(tx, hash)
+	if err != nil {
+		return err
+	}
+	for above := height + 1; tx.Get(heightsBucket, IntToHex(int64(above))) != nil; above++ {
+		if err := tx.Delete(heightsBucket, IntToHex(int64(above))); err != nil {
+			return err
+		}
+	}
+
+	for ; len(hash) > 0; height-- {
+		key := IntToHex(int64(height))
+		if bytes.Equal(tx.Get(heightsBucket, key), hash) {
+			return nil
+		}
+		if err := tx.Put(heightsBucket, key, hash); err != nil {
+			return err
+		}
+		header, _, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		hash = header.PrevBlockHash
+	}
+	return nil
+}
+
+// AddHeaders checks the headers received from a peer and keeps them until their blocks are
+// downloaded. Each header needs a valid proof of work and time, the checkpoint of its height,
+// and a parent which is a stored block or a kept header. It returns the hashes of the blocks
+// still to download, in the order of the headers
+func (bc *Blockchain) AddHeaders(headers []*BlockHeader) ([][]byte, error) {
+	var missing [][]byte
+	err := bc.store.Update(func(tx StoreTx) error {
+		// The headers of the batch are the parents and the ancestors of the next ones
+		batch := make(map[string]*BlockHeader)
+		heights := make(map[string]int)
+		lookup := func(hash []byte) (*BlockHeader, int, error) {
+			if header, ok := batch[string(hash)]; ok {
+				return header, heights[string(hash)], nil
+			}
+			return getKnownHeader(tx, hash)
+		}
+		for _, header := range headers {
+			hash := header.BlockHash()
+			if tx.Get(headersBucket, hash) != nil {
+				continue
+			}
+			if !NewHeaderProofOfWork(header).Validate() {
+				return ErrInvalidProofOfWork
+			}
+			if len(header.PrevBlockHash) == 0 {
+				return ErrUnexpectedGenesis
+			}
+			_, prevHeight, err := lookup(header.PrevBlockHash)
+			if err != nil {
+				return ErrPrevBlockNotFound
+			}
+			height := prevHeight + 1
+			if err := activeNetwork.checkCheckpoint(height, hash); err != nil {
+				return err
+			}
+			if err := checkHeaderTime(lookup, header, bc.adjustedTime()); err != nil {
+				return err
+			}
+
+			if err := putHeaderIn(tx, pendingHeadersBucket, header, hash, height); err != nil {
+				return err
+			}
+			batch[string(hash)], heights[string(hash)] = header, height
+			missing = append(missing, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxBlockSize is the maximum size of the serialized transactions of a block
+	MaxBlockSize = 1024 * 1024
+	// MaxBlockTxs is the maximum number of transactions of a block, coinbase included
+	MaxBlockTxs = 2000
+	// coinbaseReserve is the room left in a template for the coinbase transaction
+	coinbaseReserve = 1000
+)
+
+var ErrBlockTooLarge = errors.New("block exceeds the size or transaction count limit")
+
+// BlockTemplateConfig holds the limits of the blocks assembled from the mempool
+type BlockTemplateConfig struct {
+	MaxBlockSize int
+	MaxBlockTxs  int
+}
+
+var DefaultBlockTemplateConfig = BlockTemplateConfig{
+	MaxBlockSize: MaxBlockSize,
+	MaxBlockTxs:  MaxBlockTxs,
+}
+
+// TemplateTx is a transaction selected for the next block
+type TemplateTx struct {
+	Tx   *Transaction
+	Fee  int
+	Size int
+	// Depends are the indexes in the template of the parents of the transaction
+	Depends []int
+}
+
+// BlockTemplate is the next block to mine without its coinbase and proof of work
+type BlockTemplate struct {
+	PrevBlockHash Hash
+	Height        int
+	TargetBits    int
+	Timestamp     int64
+	// MinTime is the earliest timestamp allowed for the block
+	MinTime int64
+	// Transactions are sorted so that a parent always precedes its children
+	Transactions []TemplateTx
+	Fees         int
+	Size         int
+	// Invalid are the ids of the pool transactions rejected by the chain
+	Invalid []string
+}
+
+// NewBlockTemplate selects the mempool transactions paying the best fee rate, along with their
+// unconfirmed ancestors, until the size or transaction count limit of the block is reached
+func (bc *Blockchain) NewBlockTemplate(mp *Mempool, config BlockTemplateConfig) (*BlockTemplate, error) {
+	template := &BlockTemplate{
+		PrevBlockHash: bc.tip(),
+		Height:        bc.GetBestHeight() + 1,
+		TargetBits:    targetBits(),
+		Size:          coinbaseReserve,
+	}
+	if template.PrevBlockHash == nil {
+		return nil, ErrChainNotFound
+	}
+	mtp, err := bc.MedianTimePast(template.PrevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	template.MinTime = mtp + 1
+	if template.Timestamp, err = bc.nextBlockTime(template.PrevBlockHash); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]MempoolEntry)
+	for _, entry := range mp.Entries() {
+		entries[hex.EncodeToString(entry.Tx.ID)] = entry
+	}
+
+	inBlock := make(map[string]*Transaction)
+	index := make(map[string]int)
+	// skipped holds the transactions left out, their descendants are left out as well
+	skipped := make(map[string]bool)
+	for _, tx := range mp.MiningOrder() {
+		id := hex.EncodeToString(tx.ID)
+		entry := entries[id]
+
+		var depends []int
+		for _, vin := range tx.Vin {
+			parent := hex.EncodeToString(vin.Txid)
+			if skipped[parent] {
+				skipped[id] = true
+			}
+			if i, ok := index[parent]; ok {
+				depends = append(depends, i)
+			}
+		}
+		if skipped[id] {
+			continue
+		}
+		if template.Size+entry.Size > config.MaxBlockSize || len(template.Transactions)+2 > config.MaxBlockTxs {
+			skipped[id] = true
+			continue
+		}
+		if err := bc.ValidateTransaction(tx, inBlock); err != nil {
+			skipped[id] = true
+			template.Invalid = append(template.Invalid, id)
+			continue
+		}
+
+		inBlock[id] = tx
+		index[id] = len(template.Transactions)
+		template.Transactions = append(template.Transactions, TemplateTx{tx, entry.Fee, entry.Size, depends})
+		template.Fees += entry.Fee
+		template.Size += entry.Size
+	}
+	return template, nil
+}
+
+// CoinbaseValue returns the reward of the miner of the template
+func (t *BlockTemplate) CoinbaseValue() int {
+	return coinbaseReward(t.Fees)
+}
+
+// Txs returns the transactions of the block paying the reward to minerAddress
+func (t *BlockTemplate) Txs(minerAddress string) []*Transaction {
+	var txs []*Transaction
+	for _, tx := range t.Transactions {
+		txs = append(txs, tx.Tx)
+	}
+	return append(txs, NewCoinbaseTX(minerAddress, "", t.Fees))
+}
+
+// checkBlockLimits checks the size and transaction count limits of the block
+func checkBlockLimits(block *Block) error {
+	if len(block.Transactions) > MaxBlockTxs {
+		return fmt.Errorf("%w: %d transactions", ErrBlockTooLarge, len(block.Transactions))
+	}
+	size := 0
+	for _, tx := range block.Transactions {
+		size += len(tx.Serialize())
+	}
+	if size > MaxBlockSize {
+		return fmt.Errorf("%w: %d bytes", ErrBlockTooLarge, size)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockTemplateRespectsLimitsAndDependencies(t *testing.T) {
+	sender, receiver := NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+	mp := NewMempool(utxoSet, DefaultMempoolConfig)
+
+	parent, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(parent))
+	child, err := NewChildPaysForParentTransaction(receiver, parent, 5)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(child))
+
+	template, err := bc.NewBlockTemplate(mp, DefaultBlockTemplateConfig)
+	assert.NoError(t, err)
+	assert.Len(t, template.Transactions, 2)
+	assert.Equal(t, parent, template.Transactions[0].Tx)
+	assert.Equal(t, []int{0}, template.Transactions[1].Depends)
+	assert.Equal(t, 2, template.Height)
+
+	// Room for a single transaction besides the coinbase
+	template, err = bc.NewBlockTemplate(mp, BlockTemplateConfig{MaxBlockSize: MaxBlockSize, MaxBlockTxs: 2})
+	assert.NoError(t, err)
+	assert.Len(t, template.Transactions, 1)
+	assert.Equal(t, parent, template.Transactions[0].Tx)
+
+	block, err := bc.MineBlock(template.Txs(string(sender.GetAddress())))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, block.Height)
+}
+
+func TestBlockTemplateFeesComeFromTheMempool(t *testing.T) {
+	sender, receiver := NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+	mp := NewMempool(utxoSet, DefaultMempoolConfig)
+
+	// The fee field of a transaction is not signed, a relaying peer can change it
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	tx.TransactionFee = 1000
+	assert.NoError(t, mp.Add(tx))
+
+	template, err := bc.NewBlockTemplate(mp, DefaultBlockTemplateConfig)
+	assert.NoError(t, err)
+	fees := 0
+	for _, entry := range mp.Entries() {
+		fees += entry.Fee
+	}
+	assert.Equal(t, CalcTxFee(10), fees)
+	assert.Equal(t, fees, template.Fees)
+	assert.Equal(t, coinbaseReward(fees), template.CoinbaseValue())
+
+	block, err := bc.MineBlock(template.Txs(string(sender.GetAddress())))
+	assert.NoError(t, err)
+	assert.Equal(t, coinbaseReward(fees), block.Transactions[1].Vout[0].Value)
+}
@@ -0,0 +1,117 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var ErrCheckpointMismatch = errors.New("block does not match the checkpoint at its height")
+
+// genesisAddress is paid the reward of the genesis blocks, its public key hash is all zeros so
+// nobody holds its key and the reward cannot be spent
+const genesisAddress = "1111111111111111111114oLvT2"
+
+// ChainParams holds the consensus rules of a network and its fixed genesis block, the nodes of
+// a network agree on the chain from the first block. The files of a network are kept in the
+// directory named after it
+type ChainParams struct {
+	Name string
+	// TargetBits is the difficulty of the proof of work
+	TargetBits int
+	// BlockSubsidy is added to the fees collected by a block
+	BlockSubsidy int
+	// GenesisReward is paid by the coinbase of the genesis block to genesisAddress, it can
+	// never be spent
+	GenesisReward int
+	// GenesisBlock is the first block of every chain of the network, GenesisHash is its hash
+	GenesisBlock *Block
+	GenesisHash  Hash
+	// Checkpoints are blocks of the best chain, a block or a header at a checkpoint height
+	// with another hash is rejected
+	Checkpoints []Checkpoint
+	// MinPruneDepth is the number of block bodies a pruned node keeps at least, a deeper
+	// reorganization is not expected on the network
+	MinPruneDepth int
+}
+
+// Checkpoint is the hash of the best chain block at a height
+type Checkpoint struct {
+	Height int
+	Hash   Hash
+}
+
+var (
+	MainNet = ChainParams{
+		Name:          "main",
+		TargetBits:    16,
+		BlockSubsidy:  50,
+		GenesisReward: 100,
+		GenesisBlock:  newGenesisBlock("Testing", 100, 1790000000, 16, 12253),
+		GenesisHash:   mustDecodeHash("000029bac8c4cf652e386073625c3a92376c6e655ee54b21f60a23c3ea5f60af"),
+		Checkpoints: []Checkpoint{
+			{0, mustDecodeHash("000029bac8c4cf652e386073625c3a92376c6e655ee54b21f60a23c3ea5f60af")},
+		},
+		MinPruneDepth: 288,
+	}
+	// RegTest is a local network for the tests, a block is mined in a couple of hashes
+	// and its subsidy funds the wallets of the tests
+	RegTest = ChainParams{
+		Name:          "regtest",
+		TargetBits:    1,
+		BlockSubsidy:  50,
+		GenesisReward: 100,
+		GenesisBlock:  newGenesisBlock("Regtest", 100, 1790000000, 1, 0),
+		GenesisHash:   mustDecodeHash("40e7c9a3a8fee0a2489a1aaa9b9cc785c62b405bb36f4303c8fb6eb79a9ec2a2"),
+		Checkpoints: []Checkpoint{
+			{0, mustDecodeHash("40e7c9a3a8fee0a2489a1aaa9b9cc785c62b405bb36f4303c8fb6eb79a9ec2a2")},
+		},
+		MinPruneDepth: 8,
+	}
+)
+
+// newGenesisBlock builds a genesis block from fixed fields only, its coinbase pays reward to
+// genesisAddress. The nonce is the one found when the network was defined
+func newGenesisBlock(coinbaseData string, reward int, timestamp int64, bits int, nonce int) *Block {
+	coinbase := &Transaction{
+		Vin:         []TXInput{{[]byte{}, -1, nil, []byte(coinbaseData)}},
+		Vout:        []TXOutput{*NewTXOutput(reward, genesisAddress)},
+		Timestamp:   timestamp,
+		FromAddress: "Base Reward",
+		ToAddress:   genesisAddress,
+		Amount:      reward,
+	}
+	coinbase.ID = coinbase.Hash()
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   blockVersion,
+			Timestamp: timestamp,
+			Bits:      int32(bits),
+			Nonce:     nonce,
+		},
+		Transactions: []*Transaction{coinbase},
+		Height:       0,
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHash()
+	return block
+}
+
+func mustDecodeHash(s string) Hash {
+	hash, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// checkCheckpoint rejects a block of the height of a checkpoint which is not the checkpoint
+func (p ChainParams) checkCheckpoint(height int, hash []byte) error {
+	for _, checkpoint := range p.Checkpoints {
+		if checkpoint.Height == height && !bytes.Equal(checkpoint.Hash, hash) {
+			return fmt.Errorf("%w: %x at height %d", ErrCheckpointMismatch, hash, height)
+		}
+	}
+	return nil
+}
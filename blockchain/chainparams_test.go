@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGenesisBlocksAreFixed(t *testing.T) {
+	defer SetNetwork(MainNet)
+	for _, params := range []ChainParams{MainNet, RegTest} {
+		SetNetwork(params)
+		assert.Equal(t, params.GenesisHash, params.GenesisBlock.Hash, params.Name)
+		assert.Equal(t, params.GenesisHash, params.GenesisBlock.BlockHash(), params.Name)
+		assert.True(t, NewProofOfWork(params.GenesisBlock).Validate(), params.Name)
+
+		// Two nodes started apart agree on the first block
+		a, err := CreateBlockchainInStore(NewMemoryStore())
+		assert.NoError(t, err)
+		b, err := CreateBlockchainInStore(NewMemoryStore())
+		assert.NoError(t, err)
+		assert.Equal(t, string(params.GenesisHash), a.GetLastHash())
+		assert.Equal(t, a.GetLastHash(), b.GetLastHash())
+		assert.NoError(t, a.Close())
+		assert.NoError(t, b.Close())
+
+		// Nobody holds the key of the genesis reward
+		assert.Equal(t, make([]byte, 20), params.GenesisBlock.Transactions[0].Vout[0].PubKeyHash, params.Name)
+	}
+}
+
+func TestChainOfAnotherGenesisIsRefused(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	store := NewMemoryStore()
+	bc, err := CreateBlockchainInStore(store)
+	assert.NoError(t, err)
+	_, err = NewBlockchainFromStore(store)
+	assert.NoError(t, err)
+
+	SetNetwork(MainNet)
+	_, err = NewBlockchainFromStore(store)
+	assert.ErrorIs(t, err, ErrGenesisMismatch)
+	assert.NoError(t, bc.Close())
+}
+
+func TestCheckpointMismatchIsRejected(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet := NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	blocks, err := bc.Generate(2, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+
+	params := RegTest
+	params.Checkpoints = append([]Checkpoint{{2, blocks[1].Hash}}, RegTest.Checkpoints...)
+	SetNetwork(params)
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 0)
+	block, err := NewBlockContext(context.Background(), []*Transaction{coinbase}, blocks[0].Hash, 2, time.Now().Unix())
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bc.ValidateBlock(block), ErrCheckpointMismatch)
+	assert.NoError(t, bc.ValidateBlock(blocks[1]))
+
+	// The genesis block of another chain is not the first checkpoint
+	other := newGenesisBlock("Other", RegTest.GenesisReward, 1790000000, RegTest.TargetBits, 0)
+	for !NewProofOfWork(other).Validate() {
+		other.Nonce++
+		other.Hash = other.BlockHash()
+	}
+	assert.ErrorIs(t, bc.ValidateBlock(other), ErrCheckpointMismatch)
+}
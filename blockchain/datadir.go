@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DefaultDataDir is the data directory of a node started without -datadir
+const DefaultDataDir = "./data"
+
+// LogFile receives the log of the node, next to its chain
+const LogFile = "debug_%s.log"
+
+// lockFileName is held by the process using the directory of a network
+const lockFileName = ".lock"
+
+var ErrDataDirLocked = errors.New("the data directory is used by another node")
+
+// legacyDbDirs are the directories of the databases of the networks before the data directory,
+// relative to the working directory like the wallet files were
+var legacyDbDirs = map[string]string{
+	MainNet.Name: "db",
+	RegTest.Name: filepath.Join("db", "regtest"),
+}
+
+// dataDir holds a directory per network, the chain, the wallets, the peers and the log of
+// the node are kept in the directory of the active network
+var dataDir = DefaultDataDir
+
+// SetDataDir selects the data directory of the process, before any file is opened
+func SetDataDir(dir string) {
+	dataDir = dir
+}
+
+// DataDir returns the data directory of the process
+func DataDir() string {
+	return dataDir
+}
+
+// NetworkDir returns the directory of the active network in the data directory
+func NetworkDir() string {
+	return filepath.Join(dataDir, activeNetwork.Name)
+}
+
+// NetworkFilePath returns the path of the file of the node named by pattern, in the directory
+// of the active network
+func NetworkFilePath(pattern, nodeID string) string {
+	return filepath.Join(NetworkDir(), fmt.Sprintf(pattern, nodeID))
+}
+
+// CreateNetworkDir creates the directory of the active network, only the user running the
+// node can read it since it holds the wallets
+func CreateNetworkDir() error {
+	if err := os.MkdirAll(NetworkDir(), 0700); err != nil {
+		return err
+	}
+	return os.Chmod(NetworkDir(), 0700)
+}
+
+// DirLock is the lock of the directory of a network, see LockNetworkDir
+type DirLock struct {
+	file *os.File
+}
+
+// LockNetworkDir creates the directory of the active network and locks it for the process,
+// ErrDataDirLocked is returned when another process holds it. The lock is released by
+// Release or when the process exits
+func LockNetworkDir() (*DirLock, error) {
+	if err := CreateNetworkDir(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(NetworkDir(), lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s", ErrDataDirLocked, NetworkDir())
+	}
+	if err := file.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return &DirLock{file: file}, nil
+}
+
+// Release unlocks the directory
+func (l *DirLock) Release() error {
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// legacyFile is a file of the node written before the data directory
+type legacyFile struct {
+	from, to string
+	move     func(from, to string) error
+}
+
+// legacyFiles are the chain and the header databases in ./db and the wallet file the networks
+// shared in the working directory
+func legacyFiles(nodeID string) []legacyFile {
+	var files []legacyFile
+	if dir, ok := legacyDbDirs[activeNetwork.Name]; ok {
+		for _, pattern := range []string{DbFile, HeadersDbFile} {
+			from := filepath.Join(dir, fmt.Sprintf(pattern, nodeID))
+			files = append(files, legacyFile{from, NetworkFilePath(pattern, nodeID), os.Rename})
+		}
+	}
+	return append(files, legacyFile{fmt.Sprintf(WalletFile, nodeID), NetworkFilePath(WalletFile, nodeID), copyFile})
+}
+
+// pending tells whether the file is still to be moved, a file is left alone when the directory
+// of the network already has one
+func (f legacyFile) pending() bool {
+	if _, err := os.Stat(f.from); err != nil {
+		return false
+	}
+	_, err := os.Stat(f.to)
+	return err != nil
+}
+
+// MoveLegacyFiles brings the files of the node written before the data directory into the
+// directory of the active network: the databases are moved and the wallet file is copied. The
+// caller holds the lock of the directory, see LockNetworkDir
+func MoveLegacyFiles(nodeID string) error {
+	for _, file := range legacyFiles(nodeID) {
+		if !file.pending() {
+			continue
+		}
+		if err := CreateNetworkDir(); err != nil {
+			return err
+		}
+		if err := file.move(file.from, file.to); err != nil {
+			return fmt.Errorf("moving %s to the data directory: %w", file.from, err)
+		}
+		log.Printf("Moved %s written by an older version to %s\n", file.from, file.to)
+	}
+	return nil
+}
+
+// PendingLegacyFiles returns the files written before the data directory which MoveLegacyFiles
+// has not moved yet
+func PendingLegacyFiles(nodeID string) []string {
+	var pending []string
+	for _, file := range legacyFiles(nodeID) {
+		if file.pending() {
+			pending = append(pending, file.from)
+		}
+	}
+	return pending
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeBackup(to, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetworkDirIsLocked(t *testing.T) {
+	SetDataDir(filepath.Join(t.TempDir(), "data"))
+	defer SetDataDir(DefaultDataDir)
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+
+	lock, err := LockNetworkDir()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(DataDir(), "regtest", "wallet_3000.dat"), NetworkFilePath(WalletFile, "3000"))
+	info, err := os.Stat(NetworkDir())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	_, err = LockNetworkDir()
+	assert.ErrorIs(t, err, ErrDataDirLocked)
+	// Every network has its own directory
+	SetNetwork(MainNet)
+	other, err := LockNetworkDir()
+	assert.NoError(t, err)
+	assert.NoError(t, other.Release())
+	SetNetwork(RegTest)
+
+	assert.NoError(t, lock.Release())
+	lock, err = LockNetworkDir()
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
+
+func TestLegacyFilesAreMoved(t *testing.T) {
+	wd, _ := os.Getwd()
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	SetDataDir("data")
+	defer SetDataDir(DefaultDataDir)
+
+	assert.NoError(t, os.MkdirAll("db", 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join("db", "blockchain_3000.db"), []byte("chain"), 0600))
+	assert.NoError(t, os.WriteFile("wallet_3000.dat", []byte("wallet"), 0600))
+	assert.Equal(t, []string{filepath.Join("db", "blockchain_3000.db"), "wallet_3000.dat"}, PendingLegacyFiles("3000"))
+	assert.NoError(t, MoveLegacyFiles("3000"))
+	assert.Empty(t, PendingLegacyFiles("3000"))
+
+	chain, err := os.ReadFile(DbFilePath("3000"))
+	assert.NoError(t, err)
+	assert.Equal(t, "chain", string(chain))
+	_, err = os.Stat(filepath.Join("db", "blockchain_3000.db"))
+	assert.True(t, os.IsNotExist(err))
+	// The wallet file was shared by the networks, it is copied
+	wallet, err := os.ReadFile(NetworkFilePath(WalletFile, "3000"))
+	assert.NoError(t, err)
+	assert.Equal(t, "wallet", string(wallet))
+	_, err = os.Stat("wallet_3000.dat")
+	assert.NoError(t, err)
+
+	// The files of the data directory win
+	assert.NoError(t, os.WriteFile("wallet_3000.dat", []byte("old wallet"), 0600))
+	assert.NoError(t, MoveLegacyFiles("3000"))
+	wallet, err = os.ReadFile(NetworkFilePath(WalletFile, "3000"))
+	assert.NoError(t, err)
+	assert.Equal(t, "wallet", string(wallet))
+}
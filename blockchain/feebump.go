@@ -0,0 +1,171 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// SentTxsFile keeps the transactions sent by the wallets of a node, so they can be bumped later
+const SentTxsFile = "sent_txs_%s.dat"
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrNotReplaceable    = errors.New("transaction does not signal replaceability")
+	ErrFeeNotHigher      = errors.New("new fee must be higher than the current one")
+	ErrNoWalletOutput    = errors.New("transaction has no output paying the wallet")
+)
+
+// NewFeeBumpTransaction creates a replacement of the unconfirmed transaction paying fee instead
+// of its current fee. The inputs and the recipient are kept, the difference is taken from the change
+func NewFeeBumpTransaction(wallet *Wallet, original *Transaction, fee int, bc *Blockchain) (*Transaction, error) {
+	if !original.Replaceable {
+		return nil, ErrNotReplaceable
+	}
+
+	prevOuts, err := UTXOSet{bc}.FindPrevOutputs(original)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the inputs must be confirmed", err)
+	}
+	inputValue := 0
+	for _, out := range prevOuts {
+		inputValue += out.Value
+	}
+
+	outputValue := 0
+	for _, out := range original.Vout {
+		outputValue += out.Value
+	}
+	currentFee := inputValue - outputValue
+	if fee <= currentFee {
+		return nil, ErrFeeNotHigher
+	}
+
+	// Take the extra fee from the change, which is the last output paying the wallet
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	outputs := append([]TXOutput{}, original.Vout...)
+	remaining := fee - currentFee
+	for i := len(outputs) - 1; i >= 0 && remaining > 0; i-- {
+		if !outputs[i].IsLockedWithKey(pubKeyHash) {
+			continue
+		}
+		taken := remaining
+		if taken > outputs[i].Value {
+			taken = outputs[i].Value
+		}
+		outputs[i].Value -= taken
+		remaining -= taken
+		if outputs[i].Value == 0 {
+			outputs = append(outputs[:i], outputs[i+1:]...)
+		}
+	}
+	if remaining > 0 {
+		return nil, ErrInsufficientFunds
+	}
+
+	var inputs []TXInput
+	for _, vin := range original.Vin {
+		inputs = append(inputs, TXInput{Txid: vin.Txid, Vout: vin.Vout, PubKey: wallet.PublicKey})
+	}
+
+	tx := Transaction{
+		ID:             nil,
+		Vin:            inputs,
+		Vout:           outputs,
+		Timestamp:      Now(),
+		FromAddress:    original.FromAddress,
+		ToAddress:      original.ToAddress,
+		Amount:         original.Amount,
+		TransactionFee: fee,
+		Replaceable:    true,
+	}
+	tx.ID = tx.Hash()
+	if err := tx.SignOutputs(wallet.PrivateKey, prevOuts); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// NewChildPaysForParentTransaction spends the outputs of the unconfirmed parent paying the wallet
+// back to the wallet, with a fee high enough for miners to include the parent with it
+func NewChildPaysForParentTransaction(wallet *Wallet, parent *Transaction, fee int) (*Transaction, error) {
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	address := fmt.Sprintf("%s", wallet.GetAddress())
+
+	var inputs []TXInput
+	inputValue := 0
+	for outIdx, out := range parent.Vout {
+		if out.IsLockedWithKey(pubKeyHash) {
+			inputs = append(inputs, TXInput{Txid: parent.ID, Vout: outIdx, PubKey: wallet.PublicKey})
+			inputValue += out.Value
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, ErrNoWalletOutput
+	}
+	if inputValue <= fee {
+		return nil, ErrInsufficientFunds
+	}
+
+	tx := Transaction{
+		ID:             nil,
+		Vin:            inputs,
+		Vout:           []TXOutput{*NewTXOutput(inputValue-fee, address)},
+		Timestamp:      Now(),
+		FromAddress:    address,
+		ToAddress:      address,
+		Amount:         inputValue - fee,
+		TransactionFee: fee,
+	}
+	tx.ID = tx.Hash()
+	if err := tx.Sign(wallet.PrivateKey, map[string]Transaction{hex.EncodeToString(parent.ID): *parent}); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// SentTransactions are the transactions sent from the wallets of a node, indexed by hex id
+type SentTransactions struct {
+	Txs map[string]Transaction
+}
+
+// LoadSentTransactions reads the sent transactions of the node, empty when none was sent yet
+func LoadSentTransactions(nodeID string) (*SentTransactions, error) {
+	sent := SentTransactions{Txs: make(map[string]Transaction)}
+	content, err := ioutil.ReadFile(NetworkFilePath(SentTxsFile, nodeID))
+	if os.IsNotExist(err) {
+		return &sent, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&sent)
+	return &sent, err
+}
+
+// Add records the transaction
+func (s *SentTransactions) Add(tx *Transaction) {
+	s.Txs[hex.EncodeToString(tx.ID)] = *tx
+}
+
+// Get returns the sent transaction by hex id
+func (s *SentTransactions) Get(txID string) (*Transaction, bool) {
+	tx, ok := s.Txs[txID]
+	return &tx, ok
+}
+
+func (s *SentTransactions) SaveToFile(nodeID string) error {
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(s); err != nil {
+		return err
+	}
+	if err := CreateNetworkDir(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(NetworkFilePath(SentTxsFile, nodeID), content.Bytes(), 0600)
+}
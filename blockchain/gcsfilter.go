@@ -0,0 +1,259 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// filtersBucket maps a block hash to its serialized filter
+	filtersBucket = "filters"
+	// MaxFiltersPerMessage is the maximum number of filters returned at once
+	MaxFiltersPerMessage = 1000
+
+	// gcsP is the Golomb-Rice parameter, the remainder of a delta is coded on gcsP bits
+	gcsP = 19
+	// gcsM sets the false positive rate of a filter to 1/gcsM
+	gcsM = 784931
+	// gcsKeyLength is the number of bytes of the block hash keying the filter
+	gcsKeyLength = 16
+)
+
+var ErrInvalidFilter = errors.New("invalid block filter")
+
+// GCSFilter is a Golomb-coded set: the sorted hashes of the items mapped to [0, N*gcsM),
+// delta encoded with Golomb-Rice codes. A filter never misses an item of the set
+// and matches an item out of the set with a 1/gcsM probability. The block header does not
+// commit to the filter, a light client trusts the node sending it
+type GCSFilter struct {
+	N    uint32
+	Data []byte
+}
+
+// NewGCSFilter builds the filter of the items keyed by key, duplicated items are counted once
+func NewGCSFilter(key []byte, items [][]byte) *GCSFilter {
+	unique := make(map[string]bool)
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+
+	f := &GCSFilter{N: uint32(len(unique))}
+	var values []uint64
+	for item := range unique {
+		values = append(values, f.hashToRange(key, []byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var w bitWriter
+	var last uint64
+	for _, value := range values {
+		delta := value - last
+		last = value
+		for q := delta >> gcsP; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, gcsP)
+	}
+	f.Data = w.data
+	return f
+}
+
+// BlockFilter returns the filter of the block, keyed by its hash. It holds the public key
+// hashes of the outputs, the outpoints spent by the inputs and the public key hashes of
+// the inputs, so a wallet finds both its payments and its spends by its keys alone
+func BlockFilter(block *Block) *GCSFilter {
+	var items [][]byte
+	for _, tx := range block.Transactions {
+		for _, out := range tx.Vout {
+			items = append(items, out.PubKeyHash)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			items = append(items, filterOutpoint(in.Txid, in.Vout), HashPubKey(in.PubKey))
+		}
+	}
+	return NewGCSFilter(block.Hash, items)
+}
+
+// filterOutpoint encodes the output vout of the transaction txid as a filter item
+func filterOutpoint(txid []byte, vout int) []byte {
+	data := make([]byte, len(txid)+4)
+	copy(data, txid)
+	binary.BigEndian.PutUint32(data[len(txid):], uint32(vout))
+	return data
+}
+
+// hashToRange maps the item to [0, N*gcsM) with a hash keyed by the block
+func (f *GCSFilter) hashToRange(key, item []byte) uint64 {
+	if len(key) > gcsKeyLength {
+		key = key[:gcsKeyLength]
+	}
+	hash := sha256.Sum256(append(append([]byte{}, key...), item...))
+	hi, _ := bits.Mul64(binary.BigEndian.Uint64(hash[:8]), uint64(f.N)*gcsM)
+	return hi
+}
+
+// Match tells whether the item is probably part of the set
+func (f *GCSFilter) Match(key, item []byte) bool {
+	return f.MatchAny(key, [][]byte{item})
+}
+
+// MatchAny tells whether one of the items is probably part of the set
+func (f *GCSFilter) MatchAny(key []byte, items [][]byte) bool {
+	if f.N == 0 || len(items) == 0 {
+		return false
+	}
+	var queries []uint64
+	for _, item := range items {
+		queries = append(queries, f.hashToRange(key, item))
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i] < queries[j] })
+
+	// Both lists are sorted, walk them side by side
+	r := bitReader{data: f.Data}
+	var value uint64
+	for i := uint32(0); i < f.N; i++ {
+		delta, err := r.readDelta()
+		if err != nil {
+			return false
+		}
+		value += delta
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false
+		}
+		if queries[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Serialize encodes the number of items followed by the coded set
+func (f *GCSFilter) Serialize() []byte {
+	data := make([]byte, 4, 4+len(f.Data))
+	binary.BigEndian.PutUint32(data, f.N)
+	return append(data, f.Data...)
+}
+
+// DeserializeGCSFilter decodes a filter encoded by Serialize
+func DeserializeGCSFilter(data []byte) (*GCSFilter, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidFilter
+	}
+	return &GCSFilter{
+		N:    binary.BigEndian.Uint32(data),
+		Data: append([]byte{}, data[4:]...),
+	}, nil
+}
+
+// putFilter stores the filter of the block
+func putFilter(tx StoreTx, block *Block) error {
+	return tx.Put(filtersBucket, block.Hash, BlockFilter(block).Serialize())
+}
+
+// GetBlockFilter returns the filter of the block, it is built from the block when the
+// block was stored before the filters existed
+func (bc *Blockchain) GetBlockFilter(hash []byte) (*GCSFilter, error) {
+	var filter *GCSFilter
+	err := bc.store.View(func(tx StoreTx) error {
+		if data := tx.Get(filtersBucket, hash); data != nil {
+			var err error
+			filter, err = DeserializeGCSFilter(data)
+			return err
+		}
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		filter = BlockFilter(block)
+		return nil
+	})
+	return filter, err
+}
+
+// matchBlock tells whether the block probably pays to or spends from the public key hash
+func matchBlock(tx StoreTx, hash, pubKeyHash []byte) bool {
+	data := tx.Get(filtersBucket, hash)
+	if data == nil {
+		return true
+	}
+	filter, err := DeserializeGCSFilter(data)
+	if err != nil {
+		return true
+	}
+	return filter.Match(hash, pubKeyHash)
+}
+
+type bitWriter struct {
+	data []byte
+	// used is the number of bits written in the last byte
+	used uint8
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 || w.used == 8 {
+		w.data = append(w.data, 0)
+		w.used = 0
+	}
+	if bit {
+		w.data[len(w.data)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+// writeBits writes the count low bits of value, most significant first
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.writeBit(value>>uint(i)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, ErrInvalidFilter
+	}
+	bit := r.data[r.pos/8]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readDelta reads a Golomb-Rice coded value
+func (r *bitReader) readDelta() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	var rem uint64
+	for i := 0; i < gcsP; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		rem <<= 1
+		if bit {
+			rem |= 1
+		}
+	}
+	return q<<gcsP | rem, nil
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGCSFilter(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var items [][]byte
+	for i := 0; i < 500; i++ {
+		items = append(items, []byte(fmt.Sprintf("item %d", i)))
+	}
+	filter, err := DeserializeGCSFilter(NewGCSFilter(key, items).Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(500), filter.N)
+
+	for _, item := range items {
+		assert.True(t, filter.Match(key, item))
+	}
+	matched := 0
+	for i := 0; i < 1000; i++ {
+		if filter.Match(key, []byte(fmt.Sprintf("other %d", i))) {
+			matched++
+		}
+	}
+	assert.LessOrEqual(t, matched, 1)
+	assert.True(t, filter.MatchAny(key, [][]byte{[]byte("other"), items[42]}))
+	assert.False(t, NewGCSFilter(key, nil).Match(key, items[0]))
+}
+
+func TestBlockFilters(t *testing.T) {
+	sender, receiver, other := NewWallet(), NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	block, err := bc.MineBlock([]*Transaction{tx, NewCoinbaseTX(string(other.GetAddress()), "", tx.TransactionFee)})
+	assert.NoError(t, err)
+
+	filter, err := bc.GetBlockFilter(block.Hash)
+	assert.NoError(t, err)
+	assert.True(t, filter.Match(block.Hash, HashPubKey(receiver.PublicKey)))
+	assert.True(t, filter.Match(block.Hash, HashPubKey(sender.PublicKey)))
+	assert.True(t, filter.Match(block.Hash, filterOutpoint(tx.Vin[0].Txid, tx.Vin[0].Vout)))
+	assert.False(t, filter.Match(block.Hash, HashPubKey(NewWallet().PublicKey)))
+
+	// The genesis block only pays the sender
+	unspent, err := bc.FindUnspentTransactions(HashPubKey(receiver.PublicKey))
+	assert.NoError(t, err)
+	assert.Len(t, unspent, 1)
+	proofs, err := bc.FindTransactionProofs([][]byte{HashPubKey(receiver.PublicKey)}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, proofs, 1)
+	assert.Equal(t, tx.ID, proofs[0].Tx.ID)
+}
@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// HeadersDbFile is the database of a light client, it only holds the block headers
+const HeadersDbFile = "headers_%s.db"
+
+var (
+	ErrNotOnBestChain     = errors.New("block is not on the best header chain")
+	ErrInvalidMerkleProof = errors.New("merkle proof does not match the block header")
+)
+
+// HeaderChain follows the chain by its headers only. The proof of work, the linkage and the
+// timestamps of the headers are checked, the transactions are checked against the merkle roots
+type HeaderChain struct {
+	mu    sync.RWMutex
+	tip   []byte
+	store ChainStore
+}
+
+// OpenHeaderChain opens the header chain of the node, it is created empty the first time
+func OpenHeaderChain(nodeID string) (*HeaderChain, error) {
+	if err := CreateNetworkDir(); err != nil {
+		return nil, err
+	}
+	store, err := OpenStore(storeBackend, HeadersDbFilePath(nodeID))
+	if err != nil {
+		return nil, err
+	}
+	hc, err := NewHeaderChain(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return hc, nil
+}
+
+// NewHeaderChain opens the header chain kept in the store
+func NewHeaderChain(store ChainStore) (*HeaderChain, error) {
+	hc := &HeaderChain{store: store}
+	err := store.View(func(tx StoreTx) error {
+		if tip := tx.Get(headersBucket, []byte("l")); tip != nil {
+			hc.tip = append([]byte{}, tip...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func (hc *HeaderChain) Close() error {
+	return hc.store.Close()
+}
+
+// Tip returns the hash of the best header and its height, a nil hash for an empty chain
+func (hc *HeaderChain) Tip() ([]byte, int) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if len(hc.tip) == 0 {
+		return nil, -1
+	}
+	var height int
+	_ = hc.store.View(func(tx StoreTx) error {
+		var err error
+		_, height, err = getHeader(tx, hc.tip)
+		return err
+	})
+	return hc.tip, height
+}
+
+// GetHeader returns the header of the block and its height
+func (hc *HeaderChain) GetHeader(hash []byte) (*BlockHeader, int, error) {
+	var header *BlockHeader
+	var height int
+	err := hc.store.View(func(tx StoreTx) error {
+		var err error
+		header, height, err = getHeader(tx, hash)
+		return err
+	})
+	return header, height, err
+}
+
+// AddHeaders stores the headers following a known header, or the genesis header of an empty
+// chain. The tip moves to the highest header. It returns the number of new headers
+func (hc *HeaderChain) AddHeaders(headers []*BlockHeader) (int, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	added := 0
+	// The tip moves once the headers are stored, a failed batch leaves it as it was
+	tip := hc.tip
+	err := hc.store.Update(func(tx StoreTx) error {
+		lookup := func(hash []byte) (*BlockHeader, int, error) { return getHeader(tx, hash) }
+		tipHeight := -1
+		if len(tip) > 0 {
+			_, height, err := getHeader(tx, tip)
+			if err != nil {
+				return err
+			}
+			tipHeight = height
+		}
+
+		for _, header := range headers {
+			hash := header.BlockHash()
+			if tx.Get(headersBucket, hash) != nil {
+				continue
+			}
+			if !NewHeaderProofOfWork(header).Validate() {
+				return ErrInvalidProofOfWork
+			}
+
+			height := 0
+			if len(header.PrevBlockHash) == 0 {
+				if tipHeight >= 0 {
+					return ErrUnexpectedGenesis
+				}
+			} else {
+				_, prevHeight, err := getHeader(tx, header.PrevBlockHash)
+				if err != nil {
+					return ErrPrevBlockNotFound
+				}
+				height = prevHeight + 1
+			}
+			if err := activeNetwork.checkCheckpoint(height, hash); err != nil {
+				return err
+			}
+			if err := checkHeaderTime(lookup, header, time.Now()); err != nil {
+				return err
+			}
+
+			if err := putHeader(tx, header, hash, height); err != nil {
+				return err
+			}
+			added++
+			if height > tipHeight {
+				if err := tx.Put(headersBucket, []byte("l"), hash); err != nil {
+					return err
+				}
+				tip = hash
+				tipHeight = height
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	hc.tip = tip
+	return added, nil
+}
+
+// VerifyTransaction checks that the transaction is committed by the merkle root of a block of
+// the best chain and returns the height of the block
+func (hc *HeaderChain) VerifyTransaction(blockHash []byte, tx *Transaction, proof *MerkleProof) (int, error) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	var height int
+	err := hc.store.View(func(btx StoreTx) error {
+		header, h, err := getHeader(btx, blockHash)
+		if err != nil {
+			return err
+		}
+		if !VerifyProof(header.MerkleRoot, tx.Serialize(), proof) {
+			return ErrInvalidMerkleProof
+		}
+
+		// Walk back from the tip to the height of the block, a stale block is not trusted
+		hash := hc.tip
+		for len(hash) > 0 {
+			ancestor, ancestorHeight, err := getHeader(btx, hash)
+			if err != nil {
+				return err
+			}
+			if ancestorHeight == h {
+				break
+			}
+			hash = ancestor.PrevBlockHash
+		}
+		if !bytes.Equal(hash, blockHash) {
+			return ErrNotOnBestChain
+		}
+		height = h
+		return nil
+	})
+	return height, err
+}
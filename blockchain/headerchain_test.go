@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHeaderChainVerifiesTransactions(t *testing.T) {
+	wallet := NewWallet()
+	bc := newTestChain(t, wallet)
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 0)
+	block, err := bc.MineBlock([]*Transaction{coinbase})
+	assert.NoError(t, err)
+
+	hc, err := OpenHeaderChain("light")
+	assert.NoError(t, err)
+	defer hc.Close()
+
+	headers := bc.GetHeadersAfter(nil, MaxHeadersPerMessage)
+	_, err = hc.AddHeaders(headers[1:])
+	assert.ErrorIs(t, err, ErrPrevBlockNotFound)
+	added, err := hc.AddHeaders(headers[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+
+	// A batch failing after a new best header leaves the tip at the last stored header
+	bad := *headers[2]
+	bad.PrevBlockHash = []byte("unknown block")
+	_, err = hc.AddHeaders([]*BlockHeader{headers[2], &bad})
+	assert.Error(t, err)
+	tip, height := hc.Tip()
+	assert.Equal(t, headers[1].BlockHash(), tip)
+	assert.Equal(t, 1, height)
+
+	added, err = hc.AddHeaders(headers)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added)
+	tip, height = hc.Tip()
+	assert.Equal(t, block.Hash, tip)
+	assert.Equal(t, 2, height)
+
+	proofs, err := bc.FindTransactionProofs([][]byte{HashPubKey(wallet.PublicKey)}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, proofs, 2)
+	assert.Equal(t, coinbase.ID, proofs[1].Tx.ID)
+	height, err = hc.VerifyTransaction(block.Hash, coinbase, proofs[1].Proof)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, height)
+
+	// The coinbase of the first block is not committed by the second one
+	_, err = hc.VerifyTransaction(block.Hash, proofs[0].Tx, proofs[0].Proof)
+	assert.ErrorIs(t, err, ErrInvalidMerkleProof)
+}
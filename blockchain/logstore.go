@@ -0,0 +1,543 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	logOpPut byte = iota
+	logOpDelete
+	logOpClear
+)
+
+// compactLogSize is the log size below which the log is never compacted
+const compactLogSize = 1 << 20
+
+// compactBatchSize is about the size of the keys copied in one record by a compaction
+const compactBatchSize = 1 << 20
+
+// logHeaderSize is the size of the length and the checksum before the payload of a record
+const logHeaderSize = 8
+
+var errCorruptRecord = errors.New("corrupt log record")
+
+var ErrCorruptLog = errors.New("the chain log is corrupt")
+
+// logStore is a log-structured store in the spirit of Bitcask: every update is appended to a
+// log file as one checksummed record, and an index in memory maps the keys to the offsets of
+// their values in the log, the values are read from the file. The index is rebuilt from the log
+// on open, a record cut by a crash at the end of the log is dropped so an update is applied
+// completely or not at all, a corrupt record anywhere else fails the open.
+// Once the log is mostly stale it is compacted in the background while the updates go on
+type logStore struct {
+	mu     sync.RWMutex
+	path   string
+	file   *os.File
+	index  *logIndex
+	closed bool
+	// size is the size of the log
+	size int64
+	// compacting is set while a compaction runs
+	compacting bool
+	compaction sync.WaitGroup
+}
+
+// logValue locates a value in the log
+type logValue struct {
+	offset int64
+	size   int
+}
+
+// logOp is a change of a record, value locates the value of a put
+type logOp struct {
+	op     byte
+	bucket string
+	key    string
+	value  logValue
+}
+
+// logIndex maps the keys of the buckets to their values in the log
+type logIndex struct {
+	buckets map[string]map[string]logValue
+	// live is about the size of a log holding the current keys only
+	live int64
+}
+
+// OpenLogStore opens the log at path, it is created when missing
+func OpenLogStore(path string) (ChainStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &logStore{path: path, file: file, index: newLogIndex()}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.maybeCompact()
+	return s, nil
+}
+
+// replay indexes the records of the log. A torn record at the end of the file is cut off, the
+// last update was not completely written before a crash
+func (s *logStore) replay() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		ops, n, err := readLogRecord(reader, offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == errCorruptRecord {
+			// Whatever follows a corrupt record cannot be trusted, only the last one is torn
+			if _, err := reader.Peek(1); err != io.EOF {
+				return fmt.Errorf("%w: record at offset %d of %s", ErrCorruptLog, offset, s.path)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.index.apply(ops)
+		offset += n
+	}
+
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	s.size = offset
+	return err
+}
+
+func (s *logStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	tables := &logTables{store: s}
+	if err := fn(&memTx{tables: tables}); err != nil {
+		return err
+	}
+	return tables.err
+}
+
+func (s *logStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	tables := &logTables{store: s}
+	tx := &memTx{tables: tables, changes: newMemChanges()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// The changes may rest on a value which could not be read
+	if tables.err != nil {
+		return tables.err
+	}
+	if tx.changes.empty() {
+		return nil
+	}
+	ops, err := s.append(encodeLogRecord(tx.changes))
+	if err != nil {
+		return err
+	}
+	s.index.apply(ops)
+	s.maybeCompact()
+	return nil
+}
+
+// append writes the record of an update at the end of the log and returns its changes
+func (s *logStore) append(record []byte) ([]logOp, error) {
+	_, err := s.file.Write(record)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Drop the partial record, the next records must follow the last valid one
+		_ = s.file.Truncate(s.size)
+		_, _ = s.file.Seek(s.size, io.SeekStart)
+		return nil, err
+	}
+	ops, err := parseLogPayload(record[logHeaderSize:], s.size+logHeaderSize)
+	s.size += int64(len(record))
+	return ops, err
+}
+
+// read reads the value of the key from the log, nil when the key is missing
+func (s *logStore) read(bucket, key string) ([]byte, error) {
+	value, ok := s.index.buckets[bucket][key]
+	if !ok {
+		return nil, nil
+	}
+	data := make([]byte, value.size)
+	if _, err := s.file.ReadAt(data, value.offset); err != nil {
+		return nil, fmt.Errorf("reading the chain log: %w", err)
+	}
+	return data, nil
+}
+
+func (s *logStore) keys(bucket string) []string {
+	keys := make([]string, 0, len(s.index.buckets[bucket]))
+	for key := range s.index.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// logTables are the tables of a transaction of the log store, the first value which cannot
+// be read fails the transaction
+type logTables struct {
+	store *logStore
+	err   error
+}
+
+func (t *logTables) get(bucket, key string) []byte {
+	data, err := t.store.read(bucket, key)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return data
+}
+
+func (t *logTables) keys(bucket string) []string {
+	return t.store.keys(bucket)
+}
+
+// maybeCompact starts a compaction once the log is mostly stale, the lock is held
+func (s *logStore) maybeCompact() {
+	if s.compacting || s.size <= compactLogSize || s.size <= 2*s.index.live {
+		return
+	}
+	s.compacting = true
+	s.compaction.Add(1)
+	go func() {
+		defer s.compaction.Done()
+		err := s.compact()
+		s.mu.Lock()
+		s.compacting = false
+		s.mu.Unlock()
+		if err != nil && err != ErrStoreClosed {
+			log.Println("Compacting the chain log failed:", err)
+		}
+	}()
+}
+
+// compact copies the current keys to a new log while the updates go on. The records appended
+// meanwhile are then copied after them and the new log replaces the old one
+func (s *logStore) compact() error {
+	s.mu.RLock()
+	old, end := s.file, s.size
+	var entries []logOp
+	for bucket, values := range s.index.buckets {
+		for key, value := range values {
+			entries = append(entries, logOp{op: logOpPut, bucket: bucket, key: key, value: value})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].bucket != entries[j].bucket {
+			return entries[i].bucket < entries[j].bucket
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	tmp := s.path + ".compact"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	defer func() {
+		if !replaced {
+			file.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	// The records before end are never rewritten, they are read without the lock
+	index := newLogIndex()
+	var size int64
+	changes, batch := newMemChanges(), 0
+	flush := func() error {
+		record := encodeLogRecord(changes)
+		if _, err := file.Write(record); err != nil {
+			return err
+		}
+		ops, err := parseLogPayload(record[logHeaderSize:], size+logHeaderSize)
+		if err != nil {
+			return err
+		}
+		index.apply(ops)
+		size += int64(len(record))
+		changes, batch = newMemChanges(), 0
+		return nil
+	}
+	for _, entry := range entries {
+		value := make([]byte, entry.value.size)
+		if _, err := old.ReadAt(value, entry.value.offset); err != nil {
+			return err
+		}
+		changes.write(entry.bucket, entry.key, value)
+		batch += len(entry.key) + len(value)
+		if batch >= compactBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if !changes.empty() {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	tail := make([]byte, s.size-end)
+	if _, err := old.ReadAt(tail, end); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(bytes.NewReader(tail))
+	for offset := int64(0); offset < int64(len(tail)); {
+		ops, n, err := readLogRecord(reader, size+offset)
+		if err != nil {
+			return err
+		}
+		index.apply(ops)
+		offset += n
+	}
+	if _, err := file.Write(tail); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	replaced = true
+	old.Close()
+	s.file, s.index, s.size = file, index, size+int64(len(tail))
+	// The new log replaces the old one after a crash once the rename is synced
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir makes the files created or renamed in the directory durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Backup writes the records of the log to path, the updates wait meanwhile
+func (s *logStore) Backup(path string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return writeBackup(path, func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(s.file, 0, s.size))
+		return err
+	})
+}
+
+func (s *logStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	// A running compaction gives up once it sees the store closed
+	s.compaction.Wait()
+	return s.file.Close()
+}
+
+func newLogIndex() *logIndex {
+	return &logIndex{buckets: make(map[string]map[string]logValue)}
+}
+
+// apply applies the changes of a record in their order
+func (ix *logIndex) apply(ops []logOp) {
+	for _, op := range ops {
+		values := ix.buckets[op.bucket]
+		switch op.op {
+		case logOpClear:
+			for key, value := range values {
+				ix.live -= logEntrySize(op.bucket, key, value)
+			}
+			delete(ix.buckets, op.bucket)
+			continue
+		case logOpPut:
+			if values == nil {
+				values = make(map[string]logValue)
+				ix.buckets[op.bucket] = values
+			}
+		}
+		if old, ok := values[op.key]; ok {
+			ix.live -= logEntrySize(op.bucket, op.key, old)
+			delete(values, op.key)
+		}
+		if op.op == logOpPut {
+			values[op.key] = op.value
+			ix.live += logEntrySize(op.bucket, op.key, op.value)
+		}
+	}
+}
+
+// logEntrySize is about the size of the put of the key in a record
+func logEntrySize(bucket, key string, value logValue) int64 {
+	return int64(1 + 3*binary.MaxVarintLen32 + len(bucket) + len(key) + value.size)
+}
+
+// encodeLogRecord encodes the changes as the length and the checksum of the payload followed
+// by the payload: the cleared buckets then the writes, sorted so that a record is deterministic
+func encodeLogRecord(changes *memChanges) []byte {
+	var payload bytes.Buffer
+	writeBytes := func(data []byte) {
+		var size [binary.MaxVarintLen64]byte
+		payload.Write(size[:binary.PutUvarint(size[:], uint64(len(data)))])
+		payload.Write(data)
+	}
+
+	var cleared []string
+	for bucket := range changes.cleared {
+		cleared = append(cleared, bucket)
+	}
+	sort.Strings(cleared)
+	for _, bucket := range cleared {
+		payload.WriteByte(logOpClear)
+		writeBytes([]byte(bucket))
+	}
+
+	var buckets []string
+	for bucket := range changes.writes {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		var keys []string
+		for key := range changes.writes[bucket] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := changes.writes[bucket][key]
+			if value == nil {
+				payload.WriteByte(logOpDelete)
+			} else {
+				payload.WriteByte(logOpPut)
+			}
+			writeBytes([]byte(bucket))
+			writeBytes([]byte(key))
+			if value != nil {
+				writeBytes(value)
+			}
+		}
+	}
+
+	record := make([]byte, logHeaderSize, logHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(record[0:], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...)
+}
+
+// readLogRecord decodes the next record of the log at offset and returns its size
+func readLogRecord(reader *bufio.Reader, offset int64) ([]logOp, int64, error) {
+	var header [logHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	ops, err := parseLogPayload(payload, offset+logHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ops, int64(len(header) + len(payload)), nil
+}
+
+// parseLogPayload decodes the changes of the payload of a record found at offset in the log
+func parseLogPayload(payload []byte, offset int64) ([]logOp, error) {
+	var ops []logOp
+	r := bytes.NewReader(payload)
+	readSize := func() (int, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > uint64(r.Len()) {
+			return 0, errCorruptRecord
+		}
+		return int(size), nil
+	}
+	readBytes := func() (string, error) {
+		size, err := readSize()
+		if err != nil {
+			return "", err
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		return string(data), err
+	}
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		bucket, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if op == logOpClear {
+			ops = append(ops, logOp{op: op, bucket: bucket})
+			continue
+		}
+		key, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		change := logOp{op: op, bucket: bucket, key: key}
+		switch op {
+		case logOpPut:
+			size, err := readSize()
+			if err != nil {
+				return nil, err
+			}
+			change.value = logValue{offset: offset + int64(len(payload)-r.Len()), size: size}
+			_, _ = r.Seek(int64(size), io.SeekCurrent)
+		case logOpDelete:
+		default:
+			return nil, errCorruptRecord
+		}
+		ops = append(ops, change)
+	}
+	return ops, nil
+}
@@ -0,0 +1,526 @@
+package blockchain
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTxInMempool     = errors.New("transaction already in mempool")
+	ErrMempoolConflict = errors.New("transaction spends an output already spent in mempool")
+	ErrMissingInputs   = errors.New("transaction spends an unknown or spent output")
+	ErrMempoolFull     = errors.New("mempool is full and the fee rate is too low")
+	ErrReplacement     = errors.New("replacement transaction rejected")
+)
+
+// maxReplacedTxs bounds the number of transactions evicted by a single replacement
+const maxReplacedTxs = 100
+
+// MempoolConfig holds the limits of the memory pool
+type MempoolConfig struct {
+	// MaxCount is the maximum number of transactions
+	MaxCount int
+	// MaxSize is the maximum total size of the serialized transactions in bytes
+	MaxSize int
+	// Expiry is how long a transaction can wait to be mined
+	Expiry time.Duration
+}
+
+var DefaultMempoolConfig = MempoolConfig{
+	MaxCount: 5000,
+	MaxSize:  5 * 1024 * 1024,
+	Expiry:   14 * 24 * time.Hour,
+}
+
+// MempoolEntry is a transaction waiting to be mined
+type MempoolEntry struct {
+	Tx *Transaction
+	// Fee is the sum of the inputs minus the sum of the outputs
+	Fee   int
+	Size  int
+	Added time.Time
+	seq   uint64
+	// ancestorFee and ancestorSize sum the transaction and its unconfirmed ancestors, they are
+	// kept up to date as the pool changes
+	ancestorFee  int
+	ancestorSize int
+}
+
+// FeeRate returns the fee paid per 1000 bytes
+func (e *MempoolEntry) FeeRate() float64 {
+	return float64(e.Fee) * 1000 / float64(e.Size)
+}
+
+// Mempool holds the validated transactions waiting to be mined. A transaction can spend
+// the outputs of the chain or of another transaction of the pool, but two transactions
+// of the pool can never spend the same output
+type Mempool struct {
+	mu      sync.Mutex
+	utxoSet *UTXOSet
+	config  MempoolConfig
+	entries map[string]*MempoolEntry
+	// spends maps an outpoint to the id of the pool transaction spending it
+	spends    map[string]string
+	totalSize int
+	nextSeq   uint64
+}
+
+// NewMempool creates an empty memory pool validating the transactions against utxoSet
+func NewMempool(utxoSet *UTXOSet, config MempoolConfig) *Mempool {
+	return &Mempool{
+		utxoSet: utxoSet,
+		config:  config,
+		entries: make(map[string]*MempoolEntry),
+		spends:  make(map[string]string),
+	}
+}
+
+func outpoint(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+// Add validates the transaction and adds it to the pool. When the pool is over its limits
+// the transactions with the lowest fee rate are evicted, which can be the new one
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mp.entries[txID]; ok {
+		return ErrTxInMempool
+	}
+
+	fee, conflicts, err := mp.checkInputs(tx)
+	if err != nil {
+		return err
+	}
+
+	entry := &MempoolEntry{Tx: tx, Fee: fee, Size: len(tx.Serialize()), Added: time.Now()}
+	if entry.Size > MaxBlockSize-coinbaseReserve {
+		return fmt.Errorf("%w: transaction does not fit in a block", ErrInvalidTx)
+	}
+	mp.nextSeq++
+	entry.seq = mp.nextSeq
+	if len(conflicts) > 0 {
+		replaced, err := mp.checkReplacement(entry, conflicts)
+		if err != nil {
+			return err
+		}
+		for _, id := range replaced {
+			mp.remove(id)
+		}
+	}
+	mp.insert(txID, entry)
+
+	for len(mp.entries) > mp.config.MaxCount || mp.totalSize > mp.config.MaxSize {
+		evicted := mp.removeWithDescendants(mp.lowestFeeRate())
+		for _, id := range evicted {
+			if id == txID {
+				return ErrMempoolFull
+			}
+		}
+	}
+	return nil
+}
+
+// checkInputs validates the inputs against the UTXO set and the pool, returns the fee of tx
+// and the ids of the pool transactions spending the same outputs
+func (mp *Mempool) checkInputs(tx *Transaction) (int, []string, error) {
+	if tx.IsCoinbase() {
+		return 0, nil, fmt.Errorf("%w: coinbase transaction outside of a block", ErrInvalidTx)
+	}
+	if len(tx.Vin) == 0 {
+		return 0, nil, fmt.Errorf("%w: transaction has no input", ErrInvalidTx)
+	}
+
+	prevOuts := make(map[string]TXOutput)
+	inputValue := 0
+	var conflicts []string
+	for _, vin := range tx.Vin {
+		op := outpoint(vin.Txid, vin.Vout)
+		if _, ok := prevOuts[op]; ok {
+			return 0, nil, fmt.Errorf("%w: %s is spent twice", ErrInvalidTx, op)
+		}
+		if conflict, ok := mp.spends[op]; ok {
+			conflicts = append(conflicts, conflict)
+		}
+
+		var prevOut TXOutput
+		if parent, ok := mp.entries[hex.EncodeToString(vin.Txid)]; ok {
+			// Unconfirmed parent
+			if vin.Vout < 0 || vin.Vout >= len(parent.Tx.Vout) {
+				return 0, nil, fmt.Errorf("%w: %s", ErrMissingInputs, op)
+			}
+			prevOut = parent.Tx.Vout[vin.Vout]
+		} else {
+			// The UTXO set holds the confirmed outputs, even the ones of pruned blocks
+			out, ok, err := mp.utxoSet.FindOutput(vin.Txid, vin.Vout)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !ok {
+				return 0, nil, fmt.Errorf("%w: %s", ErrMissingInputs, op)
+			}
+			prevOut = out
+		}
+
+		if !prevOut.IsLockedWithKey(HashPubKey(vin.PubKey)) {
+			return 0, nil, fmt.Errorf("%w: %s is not owned by the signer", ErrInvalidTx, op)
+		}
+		inputValue += prevOut.Value
+		prevOuts[op] = prevOut
+	}
+
+	outputValue := 0
+	for _, out := range tx.Vout {
+		if out.Value <= 0 {
+			return 0, nil, fmt.Errorf("%w: output value must be positive", ErrInvalidTx)
+		}
+		outputValue += out.Value
+	}
+	if outputValue > inputValue {
+		return 0, nil, fmt.Errorf("%w: outputs are greater than inputs", ErrInvalidTx)
+	}
+
+	if !tx.VerifyOutputs(prevOuts) {
+		return 0, nil, fmt.Errorf("%w: wrong signature", ErrInvalidTx)
+	}
+	return inputValue - outputValue, conflicts, nil
+}
+
+// checkReplacement applies the replace-by-fee rules to a transaction spending the same outputs
+// as the conflicts. It returns the ids of the transactions to evict: the conflicts and their descendants
+func (mp *Mempool) checkReplacement(entry *MempoolEntry, conflicts []string) ([]string, error) {
+	replaced := make(map[string]bool)
+	var ids []string
+	for _, conflict := range conflicts {
+		if !mp.entries[conflict].Tx.Replaceable {
+			return nil, fmt.Errorf("%w: %s", ErrMempoolConflict, conflict)
+		}
+		found := map[string]bool{conflict: true}
+		mp.descendants(conflict, found)
+		for id := range found {
+			if !replaced[id] {
+				replaced[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) > maxReplacedTxs {
+		return nil, fmt.Errorf("%w: it would evict %d transactions", ErrReplacement, len(ids))
+	}
+
+	replacedFee := 0
+	for _, id := range ids {
+		replacedFee += mp.entries[id].Fee
+	}
+	// The replacement pays for the bandwidth of the evicted transactions and its own
+	if entry.Fee <= replacedFee {
+		return nil, fmt.Errorf("%w: fee %d is not higher than the replaced fees %d", ErrReplacement, entry.Fee, replacedFee)
+	}
+	for _, conflict := range conflicts {
+		if entry.FeeRate() <= mp.entries[conflict].FeeRate() {
+			return nil, fmt.Errorf("%w: fee rate is not higher than %s", ErrReplacement, conflict)
+		}
+	}
+	for _, vin := range entry.Tx.Vin {
+		if replaced[hex.EncodeToString(vin.Txid)] {
+			return nil, fmt.Errorf("%w: it spends a replaced transaction", ErrReplacement)
+		}
+	}
+	return ids, nil
+}
+
+func (mp *Mempool) insert(txID string, entry *MempoolEntry) {
+	mp.entries[txID] = entry
+	mp.totalSize += entry.Size
+	for _, vin := range entry.Tx.Vin {
+		mp.spends[outpoint(vin.Txid, vin.Vout)] = txID
+	}
+
+	// The children of a transaction arrive after it, so it has no descendant yet
+	ancestors := make(map[string]bool)
+	mp.ancestors(txID, ancestors)
+	entry.ancestorFee, entry.ancestorSize = entry.Fee, entry.Size
+	for id := range ancestors {
+		entry.ancestorFee += mp.entries[id].Fee
+		entry.ancestorSize += mp.entries[id].Size
+	}
+}
+
+// remove drops the transaction, the descendants left in the pool no longer count it
+func (mp *Mempool) remove(txID string) bool {
+	entry, ok := mp.entries[txID]
+	if !ok {
+		return false
+	}
+	descendants := make(map[string]bool)
+	mp.descendants(txID, descendants)
+	for id := range descendants {
+		mp.entries[id].ancestorFee -= entry.Fee
+		mp.entries[id].ancestorSize -= entry.Size
+	}
+	delete(mp.entries, txID)
+	mp.totalSize -= entry.Size
+	for _, vin := range entry.Tx.Vin {
+		delete(mp.spends, outpoint(vin.Txid, vin.Vout))
+	}
+	return true
+}
+
+// removeWithDescendants removes the transaction and every pool transaction spending its outputs
+func (mp *Mempool) removeWithDescendants(txID string) []string {
+	entry, ok := mp.entries[txID]
+	if !ok {
+		return nil
+	}
+	removed := []string{txID}
+	mp.remove(txID)
+
+	for vout := range entry.Tx.Vout {
+		if child, ok := mp.spends[outpoint(entry.Tx.ID, vout)]; ok {
+			removed = append(removed, mp.removeWithDescendants(child)...)
+		}
+	}
+	return removed
+}
+
+// descendants adds to found the pool transactions depending on the transaction
+func (mp *Mempool) descendants(txID string, found map[string]bool) {
+	entry := mp.entries[txID]
+	for vout := range entry.Tx.Vout {
+		if child, ok := mp.spends[outpoint(entry.Tx.ID, vout)]; ok && !found[child] {
+			found[child] = true
+			mp.descendants(child, found)
+		}
+	}
+}
+
+// ancestors adds to found the pool transactions the transaction depends on
+func (mp *Mempool) ancestors(txID string, found map[string]bool) {
+	for _, vin := range mp.entries[txID].Tx.Vin {
+		parent := hex.EncodeToString(vin.Txid)
+		if _, ok := mp.entries[parent]; ok && !found[parent] {
+			found[parent] = true
+			mp.ancestors(parent, found)
+		}
+	}
+}
+
+func (mp *Mempool) lowestFeeRate() string {
+	var lowest string
+	var lowestEntry *MempoolEntry
+	for txID, entry := range mp.entries {
+		if lowestEntry == nil || entry.FeeRate() < lowestEntry.FeeRate() {
+			lowest, lowestEntry = txID, entry
+		}
+	}
+	return lowest
+}
+
+// Get returns the transaction if it is in the pool
+func (mp *Mempool) Get(txID string) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, ok := mp.entries[txID]
+	if !ok {
+		return nil, false
+	}
+	return entry.Tx, true
+}
+
+// Has tells if the transaction is in the pool
+func (mp *Mempool) Has(txID string) bool {
+	_, ok := mp.Get(txID)
+	return ok
+}
+
+// Count returns the number of transactions of the pool
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.entries)
+}
+
+// Size returns the total size of the transactions of the pool
+func (mp *Mempool) Size() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.totalSize
+}
+
+// Entries returns the entries in the order they were added, a parent always precedes its children
+func (mp *Mempool) Entries() []MempoolEntry {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entries := make([]MempoolEntry, 0, len(mp.entries))
+	for _, entry := range mp.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	return entries
+}
+
+// Transactions returns the transactions in the order they were added
+func (mp *Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, entry := range mp.Entries() {
+		txs = append(txs, entry.Tx)
+	}
+	return txs
+}
+
+// MiningOrder returns the transactions sorted for mining. A transaction is selected with its
+// unconfirmed ancestors, by the fee rate of the whole package, so a child paying a high fee
+// gets its parent mined (child pays for parent). A parent always precedes its children
+func (mp *Mempool) MiningOrder() []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	// The packages start from the ancestor aggregates, they shrink as their ancestors are selected
+	packages := make(map[string]*packageCandidate, len(mp.entries))
+	queue := make(packageQueue, 0, len(mp.entries))
+	for txID, entry := range mp.entries {
+		candidate := &packageCandidate{txID, entry.seq, entry.ancestorFee, entry.ancestorSize}
+		packages[txID] = candidate
+		queue = append(queue, *candidate)
+	}
+	heap.Init(&queue)
+
+	selected := make(map[string]bool)
+	var txs []*Transaction
+	for queue.Len() > 0 {
+		best := heap.Pop(&queue).(packageCandidate)
+		// Skip the selected transactions and the outdated copies of a shrunk package
+		if selected[best.txID] || best != *packages[best.txID] {
+			continue
+		}
+
+		ancestors := make(map[string]bool)
+		mp.ancestors(best.txID, ancestors)
+		pkg := []string{best.txID}
+		for id := range ancestors {
+			if !selected[id] {
+				pkg = append(pkg, id)
+			}
+		}
+		sort.Slice(pkg, func(i, j int) bool {
+			return mp.entries[pkg[i]].seq < mp.entries[pkg[j]].seq
+		})
+		for _, id := range pkg {
+			selected[id] = true
+			txs = append(txs, mp.entries[id].Tx)
+		}
+
+		for _, id := range pkg {
+			descendants := make(map[string]bool)
+			mp.descendants(id, descendants)
+			for descendant := range descendants {
+				if selected[descendant] {
+					continue
+				}
+				candidate := packages[descendant]
+				candidate.fee -= mp.entries[id].Fee
+				candidate.size -= mp.entries[id].Size
+				heap.Push(&queue, *candidate)
+			}
+		}
+	}
+	return txs
+}
+
+// packageCandidate is a transaction with its ancestors not selected yet for mining
+type packageCandidate struct {
+	txID string
+	seq  uint64
+	fee  int
+	size int
+}
+
+func (c packageCandidate) feeRate() float64 {
+	return float64(c.fee) * 1000 / float64(c.size)
+}
+
+// packageQueue pops the package with the highest fee rate, ties are broken by arrival order
+// to keep the selection deterministic
+type packageQueue []packageCandidate
+
+func (q packageQueue) Len() int { return len(q) }
+
+func (q packageQueue) Less(i, j int) bool {
+	if q[i].feeRate() != q[j].feeRate() {
+		return q[i].feeRate() > q[j].feeRate()
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q packageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packageQueue) Push(x interface{}) { *q = append(*q, x.(packageCandidate)) }
+
+func (q *packageQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Remove drops the transactions and the ones spending their outputs
+func (mp *Mempool) Remove(txIDs ...string) []string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var removed []string
+	for _, txID := range txIDs {
+		removed = append(removed, mp.removeWithDescendants(txID)...)
+	}
+	return removed
+}
+
+// RemoveBlockTxs drops the transactions confirmed by the block, and the pool transactions
+// conflicting with them along with their descendants. Returns the ids of the dropped transactions
+func (mp *Mempool) RemoveBlockTxs(block *Block) []string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var removed []string
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		// The children of a confirmed transaction stay valid
+		if mp.remove(txID) {
+			removed = append(removed, txID)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if conflict, ok := mp.spends[outpoint(vin.Txid, vin.Vout)]; ok {
+				removed = append(removed, mp.removeWithDescendants(conflict)...)
+			}
+		}
+	}
+	return removed
+}
+
+// Expire drops the transactions waiting for longer than the expiry and their descendants
+func (mp *Mempool) Expire(now time.Time) []string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var removed []string
+	for txID, entry := range mp.entries {
+		if now.Sub(entry.Added) > mp.config.Expiry {
+			removed = append(removed, mp.removeWithDescendants(txID)...)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestChain creates a chain in a temporary directory, its first block pays wallet
+func newTestChain(t *testing.T, wallet *Wallet) *Blockchain {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	_ = os.Chdir(dir)
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	bc, err := CreateBlockchain("test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = bc.Close() })
+	_, err = bc.MineBlock([]*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)})
+	assert.NoError(t, err)
+	return bc
+}
+
+func TestMempoolRejectsConflicts(t *testing.T) {
+	sender, receiver := NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+	mp := NewMempool(utxoSet, DefaultMempoolConfig)
+
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(tx))
+	assert.ErrorIs(t, mp.Add(tx), ErrTxInMempool)
+
+	// Spends the same coinbase output
+	conflict, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 20, utxoSet)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, mp.Add(conflict), ErrMempoolConflict)
+
+	// Signed by a key which does not own the output
+	stolen := *conflict
+	stolen.Vin = []TXInput{{Txid: tx.Vin[0].Txid, Vout: tx.Vin[0].Vout, PubKey: receiver.PublicKey}}
+	mp.Remove(hex.EncodeToString(tx.ID))
+	assert.ErrorIs(t, mp.Add(&stolen), ErrInvalidTx)
+
+	assert.NoError(t, mp.Add(conflict))
+	assert.Equal(t, 1, mp.Count())
+	assert.Len(t, mp.Expire(time.Now().Add(DefaultMempoolConfig.Expiry+time.Second)), 1)
+	assert.Equal(t, 0, mp.Count())
+}
+
+func TestMempoolReplaceByFee(t *testing.T) {
+	sender, receiver := NewWallet(), NewWallet()
+	bc := newTestChain(t, sender)
+	utxoSet := &UTXOSet{bc}
+	mp := NewMempool(utxoSet, DefaultMempoolConfig)
+
+	tx, err := NewReplaceableUTXOTransaction(sender, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(tx))
+
+	_, err = NewFeeBumpTransaction(sender, tx, 0, bc)
+	assert.ErrorIs(t, err, ErrFeeNotHigher)
+	bumped, err := NewFeeBumpTransaction(sender, tx, 5, bc)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(bumped))
+	assert.False(t, mp.Has(hex.EncodeToString(tx.ID)))
+	assert.True(t, mp.Has(hex.EncodeToString(bumped.ID)))
+
+	// The child pays for its parent, both are mined together with the parent first
+	child, err := NewChildPaysForParentTransaction(receiver, bumped, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(child))
+	order := mp.MiningOrder()
+	assert.Equal(t, []*Transaction{bumped, child}, order)
+}
+
+func TestMempoolKeepsAncestorAggregates(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	sender, other, receiver := NewWallet(), NewWallet(), NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	_, err = bc.Generate(1, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	_, err = bc.Generate(1, string(other.GetAddress()))
+	assert.NoError(t, err)
+	utxoSet := &UTXOSet{bc}
+	mp := NewMempool(utxoSet, DefaultMempoolConfig)
+
+	parent, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 30, utxoSet)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(parent))
+	unrelated, err := NewUTXOTransaction(other, string(receiver.GetAddress()), 10, utxoSet)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(unrelated))
+	assert.Equal(t, []*Transaction{parent, unrelated}, mp.MiningOrder())
+
+	// The child raises the fee rate of the package of its parent above the unrelated one
+	child, err := NewChildPaysForParentTransaction(receiver, parent, 20)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(child))
+	assert.Equal(t, []*Transaction{parent, child, unrelated}, mp.MiningOrder())
+	entries := mp.Entries()
+	assert.Equal(t, entries[0].Fee+entries[2].Fee, entries[2].ancestorFee)
+	assert.Equal(t, entries[0].Size+entries[2].Size, entries[2].ancestorSize)
+
+	// The confirmed parent no longer counts in the package of the child
+	mp.RemoveBlockTxs(&Block{Transactions: []*Transaction{parent}})
+	entries = mp.Entries()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, entries[1].Fee, entries[1].ancestorFee)
+	assert.Equal(t, entries[1].Size, entries[1].ancestorSize)
+	assert.Equal(t, []*Transaction{child, unrelated}, mp.MiningOrder())
+}
@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrStoreClosed = errors.New("store is closed")
+
+// memStore keeps the buckets in memory, it is the store of the tests. An update is applied
+// once its function succeeds, the views run concurrently between the updates
+type memStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+	closed  bool
+}
+
+// memTables are the committed keys read by the transactions of the stores keeping their
+// pending changes in memory
+type memTables interface {
+	get(bucket, key string) []byte
+	// keys returns the keys of the bucket in no particular order
+	keys(bucket string) []string
+}
+
+// txTables are the keys of a store transaction, a memTx over them is a scratch transaction
+// whose writes are kept in memory and dropped with it
+type txTables struct {
+	tx StoreTx
+}
+
+func (t txTables) get(bucket, key string) []byte {
+	return t.tx.Get(bucket, []byte(key))
+}
+
+func (t txTables) keys(bucket string) []string {
+	var keys []string
+	_ = t.tx.ForEach(bucket, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	return keys
+}
+
+// newScratchTx returns a transaction reading tx, nothing is ever written to tx
+func newScratchTx(tx StoreTx) StoreTx {
+	return &memTx{tables: txTables{tx}, changes: newMemChanges()}
+}
+
+// memChanges are the pending changes of an update. A deleted key maps to nil, the cleared
+// buckets are emptied before the writes are applied
+type memChanges struct {
+	cleared map[string]bool
+	writes  map[string]map[string][]byte
+}
+
+func newMemChanges() *memChanges {
+	return &memChanges{
+		cleared: make(map[string]bool),
+		writes:  make(map[string]map[string][]byte),
+	}
+}
+
+// empty tells whether the update changes nothing
+func (c *memChanges) empty() bool {
+	return len(c.cleared) == 0 && len(c.writes) == 0
+}
+
+// write records the value of the key, nil deletes it
+func (c *memChanges) write(bucket, key string, value []byte) {
+	writes := c.writes[bucket]
+	if writes == nil {
+		writes = make(map[string][]byte)
+		c.writes[bucket] = writes
+	}
+	writes[key] = value
+}
+
+// NewMemoryStore creates an empty store living in memory
+func NewMemoryStore() ChainStore {
+	return newMemStore()
+}
+
+func newMemStore() *memStore {
+	return &memStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return fn(&memTx{tables: s})
+}
+
+func (s *memStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	tx := &memTx{tables: s, changes: newMemChanges()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.apply(tx.changes)
+	return nil
+}
+
+func (s *memStore) get(bucket, key string) []byte {
+	return s.buckets[bucket][key]
+}
+
+func (s *memStore) keys(bucket string) []string {
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *memStore) apply(changes *memChanges) {
+	for bucket := range changes.cleared {
+		delete(s.buckets, bucket)
+	}
+	for bucket, writes := range changes.writes {
+		b := s.buckets[bucket]
+		if b == nil {
+			b = make(map[string][]byte)
+			s.buckets[bucket] = b
+		}
+		for key, value := range writes {
+			if value == nil {
+				delete(b, key)
+			} else {
+				b[key] = value
+			}
+		}
+	}
+}
+
+func (s *memStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+type memTx struct {
+	tables memTables
+	// changes is nil for a view
+	changes *memChanges
+}
+
+func (t *memTx) Get(bucket string, key []byte) []byte {
+	if t.changes != nil {
+		if value, ok := t.changes.writes[bucket][string(key)]; ok {
+			return value
+		}
+		if t.changes.cleared[bucket] {
+			return nil
+		}
+	}
+	return t.tables.get(bucket, string(key))
+}
+
+func (t *memTx) Put(bucket string, key, value []byte) error {
+	return t.write(bucket, key, append([]byte{}, value...))
+}
+
+func (t *memTx) Delete(bucket string, key []byte) error {
+	return t.write(bucket, key, nil)
+}
+
+func (t *memTx) write(bucket string, key, value []byte) error {
+	if t.changes == nil {
+		return ErrReadOnlyTx
+	}
+	t.changes.write(bucket, string(key), value)
+	return nil
+}
+
+func (t *memTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	keys := make(map[string]bool)
+	if t.changes == nil || !t.changes.cleared[bucket] {
+		for _, key := range t.tables.keys(bucket) {
+			keys[key] = true
+		}
+	}
+	if t.changes != nil {
+		for key := range t.changes.writes[bucket] {
+			keys[key] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		value := t.Get(bucket, []byte(key))
+		if value == nil {
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memTx) ClearBucket(bucket string) error {
+	if t.changes == nil {
+		return ErrReadOnlyTx
+	}
+	t.changes.cleared[bucket] = true
+	delete(t.changes.writes, bucket)
+	return nil
+}
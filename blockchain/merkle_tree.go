@@ -1,9 +1,18 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+var ErrNotInTree = errors.New("transaction is not in the merkle tree")
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+	// levels holds the nodes of every level starting from the leaves, odd levels are padded
+	levels [][]*MerkleNode
+	leaves int
 }
 
 type MerkleNode struct {
@@ -12,33 +21,44 @@ type MerkleNode struct {
 	Data  Hash
 }
 
-func NewMerkleTree(transactions [][]byte) *MerkleTree {
-	var nodes []MerkleNode
+// MerkleProof proves that a transaction is part of the block committing to a merkle root
+type MerkleProof struct {
+	// Index is the position of the transaction in the block
+	Index int
+	// Siblings are the hashes combined with the transaction hash from the leaf to the root
+	Siblings []Hash
+}
 
-	// Append last transaction so that list of transaction is even
-	if len(transactions)%2 != 0 {
-		transactions = append(transactions, transactions[len(transactions)-1])
+// NewMerkleTree builds the tree level by level, the last node of a level with an odd
+// number of nodes is duplicated. An empty tree has the hash of empty data as root
+func NewMerkleTree(transactions [][]byte) *MerkleTree {
+	if len(transactions) == 0 {
+		return &MerkleTree{RootNode: NewMerkleNode(nil, nil, nil)}
 	}
 
+	var nodes []*MerkleNode
 	for _, datum := range transactions {
-		node := NewMerkleNode(nil, nil, datum)
-		nodes = append(nodes, *node)
+		nodes = append(nodes, NewMerkleNode(nil, nil, datum))
 	}
 
-	for i := 0; i < len(transactions)/2; i++ {
-		var newLevel []MerkleNode
+	tree := &MerkleTree{leaves: len(nodes)}
+	for {
+		if len(nodes) > 1 && len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+		tree.levels = append(tree.levels, nodes)
+		if len(nodes) == 1 {
+			break
+		}
 
+		var newLevel []*MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			newLevel = append(newLevel, *node)
+			newLevel = append(newLevel, NewMerkleNode(nodes[j], nodes[j+1], nil))
 		}
-
 		nodes = newLevel
 	}
-
-	mTree := MerkleTree{&nodes[0]}
-
-	return &mTree
+	tree.RootNode = nodes[0]
+	return tree
 }
 
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
@@ -48,7 +68,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		mNode.Data = hash[:]
 	} else {
-		prevHashes := append(left.Data, right.Data...)
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
 		hash := sha256.Sum256(prevHashes)
 		mNode.Data = hash[:]
 	}
@@ -58,3 +78,36 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 
 	return &mNode
 }
+
+// Proof returns the proof of the leaf at index
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= t.leaves {
+		return nil, ErrNotInTree
+	}
+
+	proof := &MerkleProof{Index: index}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		proof.Siblings = append(proof.Siblings, level[index^1].Data)
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyProof checks that the serialized transaction is committed by the merkle root
+func VerifyProof(root Hash, txData []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 {
+		return false
+	}
+
+	hash := NewMerkleNode(nil, nil, txData).Data
+	index := proof.Index
+	for _, sibling := range proof.Siblings {
+		if index%2 == 0 {
+			hash = NewMerkleNode(&MerkleNode{Data: hash}, &MerkleNode{Data: sibling}, nil).Data
+		} else {
+			hash = NewMerkleNode(&MerkleNode{Data: sibling}, &MerkleNode{Data: hash}, nil).Data
+		}
+		index /= 2
+	}
+	return index == 0 && bytes.Equal(hash, root)
+}
@@ -46,3 +46,38 @@ func TestNewMerkleNode(t *testing.T) {
 		"Root hash is correct",
 	)
 }
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		var data [][]byte
+		for i := 0; i < count; i++ {
+			data = append(data, []byte{byte(i)})
+		}
+		tree := NewMerkleTree(data)
+
+		for i := range data {
+			proof, err := tree.Proof(i)
+			assert.NoError(t, err)
+			assert.True(t, VerifyProof(tree.RootNode.Data, data[i], proof), "leaf %d of %d", i, count)
+			assert.False(t, VerifyProof(tree.RootNode.Data, []byte("other"), proof))
+		}
+		_, err := tree.Proof(count)
+		assert.ErrorIs(t, err, ErrNotInTree)
+	}
+}
+
+func TestBlockProof(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	block := &Block{}
+	for i := 0; i < 5; i++ {
+		block.Transactions = append(block.Transactions, NewCoinbaseTX(address, "", i))
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	proof, err := block.Proof(block.Transactions[4].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, proof.Index)
+	assert.True(t, VerifyProof(block.MerkleRoot, block.Transactions[4].Serialize(), proof))
+	_, err = block.Proof([]byte("unknown"))
+	assert.ErrorIs(t, err, ErrNotInTree)
+}
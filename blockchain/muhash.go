@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// muHashBytes is the size of a MuHash3072 element
+const muHashBytes = 384
+
+// muHashPrime is the modulus of MuHash3072, 2^3072 - 1103717
+var muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 8*muHashBytes), big.NewInt(1103717))
+
+// MuHash is a rolling hash of a set: the elements are multiplied modulo a prime so they can be
+// added and removed in any order, the digest only depends on the resulting set
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+// NewMuHash returns the hash of the empty set
+func NewMuHash() *MuHash {
+	return &MuHash{numerator: big.NewInt(1), denominator: big.NewInt(1)}
+}
+
+// Add adds the element to the set
+func (h *MuHash) Add(data []byte) {
+	h.numerator.Mul(h.numerator, muHashElement(data))
+	h.numerator.Mod(h.numerator, muHashPrime)
+}
+
+// Remove removes an element added before from the set
+func (h *MuHash) Remove(data []byte) {
+	h.denominator.Mul(h.denominator, muHashElement(data))
+	h.denominator.Mod(h.denominator, muHashPrime)
+}
+
+// Digest returns the 32 bytes hash of the set
+func (h *MuHash) Digest() []byte {
+	inverse := new(big.Int).ModInverse(h.denominator, muHashPrime)
+	value := new(big.Int).Mul(h.numerator, inverse)
+	value.Mod(value, muHashPrime)
+	digest := sha256.Sum256(value.FillBytes(make([]byte, muHashBytes)))
+	return digest[:]
+}
+
+// muHashElement expands the SHA-256 of the data to a number of the group
+func muHashElement(data []byte) *big.Int {
+	seed := sha256.Sum256(data)
+	expanded := make([]byte, 0, muHashBytes)
+	block := make([]byte, len(seed)+4)
+	copy(block, seed[:])
+	for i := uint32(0); len(expanded) < muHashBytes; i++ {
+		binary.BigEndian.PutUint32(block[len(seed):], i)
+		sum := sha256.Sum256(block)
+		expanded = append(expanded, sum[:]...)
+	}
+	element := new(big.Int).SetBytes(expanded)
+	return element.Mod(element, muHashPrime)
+}
@@ -0,0 +1,55 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownNetwork = errors.New("unknown network")
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrNotRegTest     = errors.New("blocks can only be generated on demand in regtest mode")
+)
+
+// activeNetwork is selected once at startup, before any chain is opened
+var activeNetwork = MainNet
+
+// NetworkByName returns the network called name, the main network for an empty name
+func NetworkByName(name string) (ChainParams, error) {
+	switch name {
+	case "", MainNet.Name:
+		return MainNet, nil
+	case RegTest.Name:
+		return RegTest, nil
+	}
+	return ChainParams{}, fmt.Errorf("%w: %s", ErrUnknownNetwork, name)
+}
+
+// SetNetwork selects the network of the process
+func SetNetwork(network ChainParams) {
+	activeNetwork = network
+}
+
+// ActiveNetwork returns the network of the process
+func ActiveNetwork() ChainParams {
+	return activeNetwork
+}
+
+// IsRegTest tells whether the process runs on the regtest network
+func IsRegTest() bool {
+	return activeNetwork.Name == RegTest.Name
+}
+
+// DbFilePath returns the path of the chain database of the node on the active network
+func DbFilePath(nodeID string) string {
+	return NetworkFilePath(DbFile, nodeID)
+}
+
+// HeadersDbFilePath returns the path of the header chain of the node on the active network
+func HeadersDbFilePath(nodeID string) string {
+	return NetworkFilePath(HeadersDbFile, nodeID)
+}
+
+func targetBits() int {
+	return activeNetwork.TargetBits
+}
@@ -0,0 +1,42 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegTestGenerate(t *testing.T) {
+	wallet := NewWallet()
+	address := string(wallet.GetAddress())
+	mainChain := newTestChain(t, wallet)
+	_, err := mainChain.Generate(1, address)
+	assert.ErrorIs(t, err, ErrNotRegTest)
+
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	bc, err := CreateBlockchain("test")
+	assert.NoError(t, err)
+	defer bc.Close()
+	assert.FileExists(t, DbFilePath("test"))
+	assert.Equal(t, string(RegTest.GenesisHash), bc.GetLastHash())
+
+	_, err = bc.Generate(1, "invalid")
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	blocks, err := bc.Generate(3, address)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 3)
+	assert.Equal(t, 3, bc.GetBestHeight())
+	assert.Equal(t, int32(RegTest.TargetBits), blocks[2].Bits)
+
+	outs, err := UTXOSet{bc}.FindUTXO(HashPubKey(wallet.PublicKey))
+	assert.NoError(t, err)
+	balance := 0
+	for _, out := range outs {
+		balance += out.Value
+	}
+	assert.Equal(t, 3*RegTest.BlockSubsidy, balance)
+	_, err = os.Stat(filepath.Join(DefaultDataDir, "regtest"))
+	assert.NoError(t, err)
+}
@@ -2,41 +2,52 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const targetBits = 16
 const maxNonce = math.MaxInt64
 
+// checkInterval is the number of nonces a worker tries between two checks of the cancellation
+const checkInterval = 1 << 12
+
 type ProofOfWork struct {
-	block  *Block
+	header *BlockHeader
+	// hash is the hash claimed for the header
+	hash   Hash
 	target *big.Int
 }
 
 // NewProofOfWork Create new proof of work
 func NewProofOfWork(block *Block) *ProofOfWork {
-	pow := &ProofOfWork{block: block}
+	return newProofOfWork(&block.BlockHeader, block.Hash)
+}
+
+// NewHeaderProofOfWork checks the proof of work of a header received without its body
+func NewHeaderProofOfWork(header *BlockHeader) *ProofOfWork {
+	return newProofOfWork(header, header.BlockHash())
+}
+
+func newProofOfWork(header *BlockHeader, hash Hash) *ProofOfWork {
+	pow := &ProofOfWork{header: header, hash: hash}
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-targetBits()))
 	pow.target = target
 	return pow
 }
 
-// prepareData Prepare data for utils data contains PreviousBlockHash, HashTransactions, CurrentTimeStamp, targetBits, nonce
-func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	return bytes.Join(
-		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
-			IntToHex(int64(nonce)),
-		},
-		[]byte{})
+// headerPrefix is the part of the serialized header which does not depend on the nonce
+func (pow *ProofOfWork) headerPrefix() []byte {
+	return pow.header.Serialize()[:BlockHeaderLength-8]
 }
 
 // IntToHex convert int to hex
@@ -49,42 +60,99 @@ func IntToHex(num int64) []byte {
 	return buff.Bytes()
 }
 
-// Run runs the proof of work
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
+// MiningResult is the outcome of a proof of work search
+type MiningResult struct {
+	Nonce    int
+	Hash     []byte
+	Hashes   uint64
+	Duration time.Duration
+}
 
-	nonce := 0
-	fmt.Printf("Mining the block with data %v\n", pow.block.Transactions)
+// HashRate returns the number of hashes computed per second
+func (r *MiningResult) HashRate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Hashes) / r.Duration.Seconds()
+}
 
-	for nonce < maxNonce {
-		// Prepare data from block and nonce
-		data := pow.prepareData(nonce)
+// Run runs the proof of work on every core
+func (pow *ProofOfWork) Run() (int, []byte) {
+	result, err := pow.Mine(context.Background(), runtime.NumCPU())
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Nonce, result.Hash
+}
 
-		// Hash data with sha256
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
+// Mine searches the nonce with workers goroutines, worker i tries the nonces i, i+workers, ...
+// The search is abandoned with the context error when ctx is done, for example when the tip changed
+func (pow *ProofOfWork) Mine(ctx context.Context, workers int) (*MiningResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The merkle root is computed once, only the nonce changes between two hashes
+	prefix := pow.headerPrefix()
+	var target [32]byte
+	pow.target.FillBytes(target[:])
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	var hashes uint64
+	found := make(chan MiningResult, workers)
 
-		// Convert utils to big integer
-		hashInt.SetBytes(hash[:])
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			data := make([]byte, len(prefix)+8)
+			copy(data, prefix)
+			count := uint64(0)
+			for nonce := first; nonce < maxNonce && nonce >= 0; nonce += workers {
+				binary.BigEndian.PutUint64(data[len(prefix):], uint64(nonce))
+				hash := sha256.Sum256(data)
+				count++
+				if bytes.Compare(hash[:], target[:]) < 0 { // hash < target
+					found <- MiningResult{Nonce: nonce, Hash: hash[:]}
+					cancel()
+					break
+				}
+				if count%checkInterval == 0 {
+					atomic.AddUint64(&hashes, checkInterval)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+			atomic.AddUint64(&hashes, count%checkInterval)
+		}(i)
+	}
+	wg.Wait()
 
-		// Compare hashInt and target
-		if hashInt.Cmp(pow.target) == -1 { // hashInt < target
-			break
-		} else { // hashInt >= target
-			nonce++
-		}
+	select {
+	case result := <-found:
+		result.Hashes = atomic.LoadUint64(&hashes)
+		result.Duration = time.Since(start)
+		fmt.Printf("Mining successful: %d hashes in %s, %.0f hash/s\n\n", result.Hashes, result.Duration.Round(time.Millisecond), result.HashRate())
+		return &result, nil
+	default:
+		return nil, ctx.Err()
 	}
-	fmt.Print("Mining successful\n\n")
-	return nonce, hash[:]
 }
 
-// Validate validates utils of block bellow the target
+// Validate validates the header hash is bellow the target and matches the claimed hash
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
+	if int(pow.header.Bits) != targetBits() {
+		return false
+	}
+	hash := sha256.Sum256(pow.header.Serialize())
 	hashInt.SetBytes(hash[:])
-	return hashInt.Cmp(pow.target) == -1 // hashInt < target
+	return bytes.Equal(hash[:], pow.hash) && hashInt.Cmp(pow.target) == -1 // hashInt < target
 }
@@ -0,0 +1,29 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestProofOfWorkMine(t *testing.T) {
+	block := &Block{
+		BlockHeader:  BlockHeader{Version: blockVersion, Timestamp: 1, Bits: int32(targetBits())},
+		Transactions: []*Transaction{NewCoinbaseTX(string(NewWallet().GetAddress()), "", 0)},
+	}
+	block.MerkleRoot = block.HashTransactions()
+	pow := NewProofOfWork(block)
+
+	result, err := pow.Mine(context.Background(), 4)
+	assert.NoError(t, err)
+	block.Nonce, block.Hash = result.Nonce, result.Hash
+	assert.True(t, NewProofOfWork(block).Validate())
+	assert.NotZero(t, result.Hashes)
+
+	// A cancelled search gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block.Timestamp = 2
+	_, err = NewProofOfWork(block).Mine(ctx, 4)
+	assert.ErrorIs(t, err, context.Canceled)
+}
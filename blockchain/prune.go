@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBlockPruned       = errors.New("block body was pruned")
+	ErrPruneDepthTooLow  = errors.New("prune depth is below the reorganization safety depth")
+	ErrPruningConfigured = errors.New("pruning is already enabled with another depth")
+)
+
+// pruneDepthKey and prunedHeightKey are stored in the blocks bucket next to the tip
+var (
+	pruneDepthKey   = []byte("prune")
+	prunedHeightKey = []byte("pruned")
+)
+
+// EnablePruning turns the chain into a pruned chain keeping the bodies of the last depth blocks,
+// the older bodies are deleted right away and whenever the tip moves. The headers, the filters
+// and the UTXO set are kept. Pruning cannot be undone, the pruned bodies are gone
+func (bc *Blockchain) EnablePruning(depth int) error {
+	if depth < activeNetwork.MinPruneDepth {
+		return fmt.Errorf("%w: %d < %d", ErrPruneDepthTooLow, depth, activeNetwork.MinPruneDepth)
+	}
+	return bc.store.Update(func(tx StoreTx) error {
+		if current, ok := getInt(tx, pruneDepthKey); ok && current != depth {
+			return fmt.Errorf("%w: %d", ErrPruningConfigured, current)
+		}
+		if err := putInt(tx, pruneDepthKey, depth); err != nil {
+			return err
+		}
+		return pruneBodies(tx)
+	})
+}
+
+// PruneDepth returns the number of blocks whose bodies are kept below the tip, 0 when the
+// chain is not pruned
+func (bc *Blockchain) PruneDepth() int {
+	var depth int
+	_ = bc.store.View(func(tx StoreTx) error {
+		depth, _ = getInt(tx, pruneDepthKey)
+		return nil
+	})
+	return depth
+}
+
+// PrunedHeight returns the height of the highest block whose body was pruned, -1 when every
+// block of the chain can be served
+func (bc *Blockchain) PrunedHeight() int {
+	height := -1
+	_ = bc.store.View(func(tx StoreTx) error {
+		if pruned, ok := getInt(tx, prunedHeightKey); ok {
+			height = pruned
+		}
+		return nil
+	})
+	return height
+}
+
+// HasBlock tells whether the block is part of the chain, even if its body was pruned
+func (bc *Blockchain) HasBlock(hash []byte) bool {
+	found := false
+	_ = bc.store.View(func(tx StoreTx) error {
+		found = tx.Get(headersBucket, hash) != nil
+		return nil
+	})
+	return found
+}
+
+// pruneBodies deletes the bodies and the undo data of the best chain blocks deeper than the
+// prune depth, it runs in the transaction moving the tip
+func pruneBodies(tx StoreTx) error {
+	depth, ok := getInt(tx, pruneDepthKey)
+	if !ok {
+		return nil
+	}
+	hash := tx.Get(blocksBucket, []byte("l"))
+	if len(hash) == 0 {
+		return nil
+	}
+	_, tipHeight, err := getHeader(tx, hash)
+	if err != nil {
+		return err
+	}
+	// The UTXO set needs the bodies of the blocks it was not updated with yet
+	utxoTip := tx.Get(blocksBucket, utxoTipKey)
+	if len(utxoTip) == 0 {
+		return nil
+	}
+	_, utxoHeight, err := getHeader(tx, utxoTip)
+	if err != nil {
+		return err
+	}
+	target := tipHeight - depth
+	if utxoHeight < tipHeight {
+		target = utxoHeight - depth
+	}
+	pruned, ok := getInt(tx, prunedHeightKey)
+	if !ok {
+		pruned = -1
+	}
+	if target <= pruned {
+		return nil
+	}
+
+	for height := tipHeight; len(hash) > 0 && height > pruned; height-- {
+		header, _, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		if height <= target {
+			if err := tx.Delete(blocksBucket, hash); err != nil {
+				return err
+			}
+			if err := tx.Delete(undoBucket, hash); err != nil {
+				return err
+			}
+		}
+		hash = header.PrevBlockHash
+	}
+	return putInt(tx, prunedHeightKey, target)
+}
+
+func getInt(tx StoreTx, key []byte) (int, bool) {
+	data := tx.Get(blocksBucket, key)
+	if len(data) != 8 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint64(data)), true
+}
+
+func putInt(tx StoreTx, key []byte, value int) error {
+	return tx.Put(blocksBucket, key, IntToHex(int64(value)))
+}
@@ -0,0 +1,103 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func balanceOf(t *testing.T, bc *Blockchain, wallet *Wallet) int {
+	outs, err := UTXOSet{bc}.FindUTXO(HashPubKey(wallet.PublicKey))
+	assert.NoError(t, err)
+	balance := 0
+	for _, out := range outs {
+		balance += out.Value
+	}
+	return balance
+}
+
+func TestPrunedChainFollowsReorganizations(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet, other := NewWallet(), NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	assert.NoError(t, UTXOSet{bc}.Reindex())
+
+	assert.ErrorIs(t, bc.EnablePruning(RegTest.MinPruneDepth-1), ErrPruneDepthTooLow)
+	assert.NoError(t, bc.EnablePruning(RegTest.MinPruneDepth))
+	assert.ErrorIs(t, bc.EnablePruning(RegTest.MinPruneDepth+1), ErrPruningConfigured)
+	assert.Equal(t, -1, bc.PrunedHeight())
+
+	blocks, err := bc.Generate(12, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+	assert.Equal(t, 12-RegTest.MinPruneDepth, bc.PrunedHeight())
+	genesis := blocks[0].PrevBlockHash
+	_, err = bc.GetBlock(genesis)
+	assert.ErrorIs(t, err, ErrBlockPruned)
+	assert.True(t, bc.HasBlock(genesis))
+	_, err = bc.GetBlock(blocks[4].Hash)
+	assert.NoError(t, err)
+	hashes, err := bc.GetBlockHashes()
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 13)
+	assert.ErrorIs(t, UTXOSet{bc}.Reindex(), ErrBlockPruned)
+	assert.Equal(t, 12*RegTest.BlockSubsidy, balanceOf(t, bc, wallet))
+
+	// A longer branch paying other replaces the last block
+	prev := blocks[10]
+	for height := 12; height <= 13; height++ {
+		coinbase := NewCoinbaseTX(string(other.GetAddress()), "", 0)
+		block, err := NewBlockContext(context.Background(), []*Transaction{coinbase}, prev.Hash, height, time.Now().Unix())
+		assert.NoError(t, err)
+		assert.NoError(t, bc.AddBlock(block))
+		prev = block
+	}
+	assert.Equal(t, 13, bc.GetBestHeight())
+	// The headers served follow the new branch, a block of the old branch is unknown to it
+	headers := bc.GetHeadersAfter(blocks[10].Hash, MaxHeadersPerMessage)
+	assert.Len(t, headers, 2)
+	assert.Equal(t, prev.Hash, headers[1].BlockHash())
+	assert.Len(t, bc.GetHeadersAfter(blocks[11].Hash, MaxHeadersPerMessage), 14)
+	assert.NoError(t, UTXOSet{bc}.CatchUp())
+	assert.Equal(t, 11*RegTest.BlockSubsidy, balanceOf(t, bc, wallet))
+	assert.Equal(t, 2*RegTest.BlockSubsidy, balanceOf(t, bc, other))
+	assert.Equal(t, 13-RegTest.MinPruneDepth, bc.PrunedHeight())
+}
+
+func TestPrunedChainSpendsOutputsOfPrunedBlocks(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet, other := NewWallet(), NewWallet()
+	newPrunedChain := func() *Blockchain {
+		bc, err := CreateBlockchainInStore(NewMemoryStore())
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = bc.Close() })
+		assert.NoError(t, bc.EnablePruning(RegTest.MinPruneDepth))
+		return bc
+	}
+	bc, peer := newPrunedChain(), newPrunedChain()
+	blocks, err := bc.Generate(12, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+	for _, block := range blocks {
+		assert.NoError(t, peer.ValidateBlock(block))
+		assert.NoError(t, peer.AddBlock(block))
+	}
+	assert.Equal(t, 12-RegTest.MinPruneDepth, peer.PrunedHeight())
+
+	// The kept bodies pay less than the amount, the outputs of the pruned blocks are spent too
+	amount := 500
+	assert.Less(t, RegTest.MinPruneDepth*RegTest.BlockSubsidy, amount+CalcTxFee(amount))
+	tx, err := NewUTXOTransaction(wallet, string(other.GetAddress()), amount, &UTXOSet{bc})
+	assert.NoError(t, err)
+	assert.True(t, bc.VerifyTransaction(tx))
+	assert.NoError(t, NewMempool(&UTXOSet{peer}, DefaultMempoolConfig).Add(tx))
+
+	block, err := bc.MineBlock([]*Transaction{tx, NewCoinbaseTX(string(wallet.GetAddress()), "", CalcTxFee(amount))})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.ValidateBlock(block))
+	assert.NoError(t, peer.AddBlock(block))
+	assert.Equal(t, amount, balanceOf(t, peer, other))
+}
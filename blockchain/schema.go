@@ -0,0 +1,154 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// metaBucket describes the database itself, it holds the version of its layout
+const metaBucket = "meta"
+
+// SchemaVersion is the version of the layout written by this node. A change to the buckets or
+// to the encoding of what they hold bumps it and comes with a migration from the previous version
+const SchemaVersion = 2
+
+var schemaVersionKey = []byte("version")
+
+var (
+	ErrSchemaTooNew      = errors.New("the database was written by a newer version of the node")
+	ErrSchemaUnsupported = errors.New("the database layout cannot be migrated")
+)
+
+// migration upgrades the database from the previous version to version
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx StoreTx) error
+}
+
+// migrations are run in order from the version of the database, the databases written before
+// the version marker are at version 0
+var migrations = []migration{
+	{1, "record the block the UTXO set was built at", migrateV1},
+	{2, "index the blocks of the best chain by height", indexBestChain},
+}
+
+// migrateV1 brings the databases written before the version marker to version 1, the UTXO
+// set is rebuilt so that it records the block it was built at. The first releases stored the
+// blocks whole, their hashes were not computed over a block header so no header can be rebuilt
+// for them which hashes to the same value, the peers would reject such blocks. These databases
+// are refused and the node syncs the chain again from an empty one
+func migrateV1(tx StoreTx) error {
+	tip := tx.Get(blocksBucket, []byte("l"))
+	if len(tip) == 0 {
+		return nil
+	}
+	if tx.Get(headersBucket, tip) == nil {
+		return fmt.Errorf("%w: the blocks are stored whole by a release without block headers, remove the database and sync the chain again", ErrSchemaUnsupported)
+	}
+	if len(tx.Get(blocksBucket, utxoTipKey)) > 0 {
+		return nil
+	}
+	return reindexUTXO(tx)
+}
+
+// StoreSchemaVersion returns the version of the layout of the store, 0 when it has no marker
+func StoreSchemaVersion(store ChainStore) (int, error) {
+	version := 0
+	err := store.View(func(tx StoreTx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(tx StoreTx) int {
+	data := tx.Get(metaBucket, schemaVersionKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(data))
+}
+
+func putSchemaVersion(tx StoreTx) error {
+	return tx.Put(metaBucket, schemaVersionKey, IntToHex(SchemaVersion))
+}
+
+// storeBackup is implemented by the stores kept in a file
+type storeBackup interface {
+	// Backup writes a consistent copy of the store to path
+	Backup(path string) error
+}
+
+// upgradeStore migrates the store to SchemaVersion in a single transaction. A store holding a
+// chain is first copied next to path when path is set, the copy is removed when the migrations
+// fail since the database is left as it was
+func upgradeStore(store ChainStore, path string) error {
+	version, err := StoreSchemaVersion(store)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: version %d, this node supports up to %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	empty := true
+	err = store.View(func(tx StoreTx) error {
+		empty = len(tx.Get(blocksBucket, []byte("l"))) == 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	backup := ""
+	if s, ok := store.(storeBackup); ok && path != "" && !empty {
+		backup = fmt.Sprintf("%s.v%d.bak", path, version)
+		if err := s.Backup(backup); err != nil {
+			return fmt.Errorf("backing up the database before migrating it: %w", err)
+		}
+		log.Printf("Database backed up to %s before migrating it from version %d\n", backup, version)
+	}
+
+	err = store.Update(func(tx StoreTx) error {
+		for _, m := range migrations {
+			if m.version <= version {
+				continue
+			}
+			log.Printf("Migrating the database to version %d: %s\n", m.version, m.description)
+			if err := m.migrate(tx); err != nil {
+				return fmt.Errorf("migrating the database to version %d: %w", m.version, err)
+			}
+		}
+		return putSchemaVersion(tx)
+	})
+	if err != nil && backup != "" {
+		_ = os.Remove(backup)
+	}
+	return err
+}
+
+// writeBackup writes the copy of a file to path with write, nothing is left on failure
+func writeBackup(path string, write func(w io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
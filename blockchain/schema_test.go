@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnversionedStoreIsMigrated(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet := NewWallet()
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := OpenBoltStore(path)
+	assert.NoError(t, err)
+	bc, err := CreateBlockchainInStore(store)
+	assert.NoError(t, err)
+	_, err = bc.Generate(2, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+	version, err := StoreSchemaVersion(store)
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersion, version)
+
+	// A database written before the version marker does not tell where its UTXO set is,
+	// nor indexes its blocks by height
+	err = store.Update(func(tx StoreTx) error {
+		assert.NoError(t, tx.ClearBucket(metaBucket))
+		assert.NoError(t, tx.ClearBucket(heightsBucket))
+		return tx.Delete(blocksBucket, utxoTipKey)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, upgradeStore(store, path))
+	_, err = os.Stat(path + ".v0.bak")
+	assert.NoError(t, err)
+	version, err = StoreSchemaVersion(store)
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersion, version)
+	info, err := UTXOSet{bc}.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, info.Height)
+	assert.Equal(t, 2*RegTest.BlockSubsidy, balanceOf(t, bc, wallet))
+	assert.Len(t, bc.GetHeadersAfter(nil, MaxHeadersPerMessage), 3)
+
+	// A newer layout is refused and left untouched
+	err = store.Update(func(tx StoreTx) error {
+		return tx.Put(metaBucket, schemaVersionKey, IntToHex(SchemaVersion+1))
+	})
+	assert.NoError(t, err)
+	_, err = NewBlockchainFromStore(store)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+	version, err = StoreSchemaVersion(store)
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersion+1, version)
+	assert.NoError(t, bc.Close())
+}
+
+// legacyBlock is a block as the first releases stored it, whole in the blocks bucket
+type legacyBlock struct {
+	Timestamp     int64
+	Transactions  []*Transaction
+	PrevBlockHash Hash
+	Hash          Hash
+	Nonce         int
+	Height        int
+}
+
+// putLegacyBlock stores the block whole as the first releases did
+func putLegacyBlock(t *testing.T, tx StoreTx, block *legacyBlock) {
+	var data bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&data).Encode(block))
+	assert.NoError(t, tx.Put(blocksBucket, block.Hash, data.Bytes()))
+}
+
+func TestWholeBlockLayoutIsRefused(t *testing.T) {
+	wallet := NewWallet()
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := OpenBoltStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	hash := func(height byte) Hash { return bytes.Repeat([]byte{height + 1}, 32) }
+	coinbase := []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)}
+	err = store.Update(func(tx StoreTx) error {
+		putLegacyBlock(t, tx, &legacyBlock{Transactions: coinbase, Hash: hash(0)})
+		putLegacyBlock(t, tx, &legacyBlock{Transactions: coinbase, PrevBlockHash: hash(0), Hash: hash(1), Height: 1})
+		return tx.Put(blocksBucket, []byte("l"), hash(1))
+	})
+	assert.NoError(t, err)
+
+	// No header hashes to the legacy hashes, the chain has to be synced again
+	_, err = NewBlockchainFromStore(store)
+	assert.ErrorIs(t, err, ErrSchemaUnsupported)
+	assert.ErrorIs(t, upgradeStore(store, path), ErrSchemaUnsupported)
+	_, err = os.Stat(path + ".v0.bak")
+	assert.True(t, os.IsNotExist(err))
+	version, err := StoreSchemaVersion(store)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	err = store.View(func(tx StoreTx) error {
+		assert.NotNil(t, tx.Get(blocksBucket, hash(1)))
+		assert.Nil(t, tx.Get(headersBucket, hash(1)))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestFailedMigrationDropsTheBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := OpenBoltStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	err = store.Update(func(tx StoreTx) error {
+		if err := tx.Put(blocksBucket, []byte("h"), []byte("gob block")); err != nil {
+			return err
+		}
+		return tx.Put(blocksBucket, []byte("l"), []byte("h"))
+	})
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, upgradeStore(store, path), ErrSchemaUnsupported)
+	_, err = os.Stat(path + ".v0.bak")
+	assert.True(t, os.IsNotExist(err))
+	version, err := StoreSchemaVersion(store)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	// An empty database only gets the version marker
+	empty, err := OpenBoltStore(filepath.Join(t.TempDir(), "empty.db"))
+	assert.NoError(t, err)
+	defer empty.Close()
+	assert.NoError(t, upgradeStore(empty, path))
+	_, err = os.Stat(path + ".v0.bak")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,169 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"time"
+)
+
+// The store backends
+const (
+	BoltBackend   = "bolt"
+	LogBackend    = "log"
+	MemoryBackend = "memory"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown store backend")
+	ErrReadOnlyTx     = errors.New("cannot write in a read-only transaction")
+	ErrStoreInUse     = errors.New("the database is opened by another process")
+)
+
+// boltOpenTimeout is how long opening a Bolt database waits for the process holding it
+const boltOpenTimeout = time.Second
+
+// ChainStore persists the chain in buckets of keys: the block bodies and the tip in the blocks
+// bucket, the headers and filters indexes, and the UTXO set. Every access runs in a transaction,
+// the writes of an update are applied all together or not at all
+type ChainStore interface {
+	View(fn func(tx StoreTx) error) error
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx reads and writes the buckets of a store, a missing bucket is empty. The values
+// read are only valid until the end of the transaction
+type StoreTx interface {
+	Get(bucket string, key []byte) []byte
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+	// ForEach calls fn on the keys of the bucket in ascending order until it fails
+	ForEach(bucket string, fn func(key, value []byte) error) error
+	// ClearBucket deletes every key of the bucket
+	ClearBucket(bucket string) error
+}
+
+// storeBackend is the backend of the chains opened by the process
+var storeBackend = BoltBackend
+
+// SetStoreBackend selects the backend of the chains opened from now on
+func SetStoreBackend(backend string) error {
+	switch backend {
+	case BoltBackend, LogBackend, MemoryBackend:
+		storeBackend = backend
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+}
+
+// OpenStore opens the store of the backend at path, the memory backend ignores path
+func OpenStore(backend, path string) (ChainStore, error) {
+	switch backend {
+	case BoltBackend:
+		return OpenBoltStore(path)
+	case LogBackend:
+		return OpenLogStore(path)
+	case MemoryBackend:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+}
+
+// boltStore keeps every bucket in a bucket of a Bolt database
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the Bolt database at path, it is created when missing. A database is
+// opened by one process at a time, ErrStoreInUse is returned when another one holds it
+func OpenBoltStore(path string) (ChainStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%w: %s", ErrStoreInUse, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Backup writes the database as of a read transaction to path
+func (s *boltStore) Backup(path string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return writeBackup(path, func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Get(bucket string, key []byte) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Get(key)
+}
+
+func (t boltTx) Put(bucket string, key, value []byte) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (t boltTx) Delete(bucket string, key []byte) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func (t boltTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(fn)
+}
+
+func (t boltTx) ClearBucket(bucket string) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	err := t.tx.DeleteBucket([]byte(bucket))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
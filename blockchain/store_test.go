@@ -0,0 +1,230 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreUpdateIsAtomic(t *testing.T) {
+	stores := map[string]ChainStore{MemoryBackend: NewMemoryStore()}
+	for _, backend := range []string{BoltBackend, LogBackend} {
+		store, err := OpenStore(backend, filepath.Join(t.TempDir(), "chain.db"))
+		assert.NoError(t, err)
+		stores[backend] = store
+	}
+
+	for backend, store := range stores {
+		failure := errors.New("failure")
+		err := store.Update(func(tx StoreTx) error {
+			assert.NoError(t, tx.Put("a", []byte("k2"), []byte("v2")))
+			assert.NoError(t, tx.Put("a", []byte("k1"), []byte("v1")))
+			return nil
+		})
+		assert.NoError(t, err, backend)
+		err = store.Update(func(tx StoreTx) error {
+			assert.NoError(t, tx.Delete("a", []byte("k1")))
+			assert.NoError(t, tx.Put("a", []byte("k3"), []byte("v3")))
+			assert.Nil(t, tx.Get("a", []byte("k1")), backend)
+			return failure
+		})
+		assert.ErrorIs(t, err, failure, backend)
+
+		var keys []string
+		err = store.View(func(tx StoreTx) error {
+			assert.ErrorIs(t, tx.Put("a", []byte("k"), []byte("v")), ErrReadOnlyTx, backend)
+			assert.Nil(t, tx.Get("missing", []byte("k1")), backend)
+			return tx.ForEach("a", func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		})
+		assert.NoError(t, err, backend)
+		assert.Equal(t, []string{"k1", "k2"}, keys, backend)
+
+		err = store.Update(func(tx StoreTx) error { return tx.ClearBucket("a") })
+		assert.NoError(t, err, backend)
+		err = store.View(func(tx StoreTx) error {
+			assert.Nil(t, tx.Get("a", []byte("k2")), backend)
+			return nil
+		})
+		assert.NoError(t, err, backend)
+		assert.NoError(t, store.Close(), backend)
+	}
+}
+
+func TestBoltStoreInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := OpenBoltStore(path)
+	assert.NoError(t, err)
+	_, err = OpenBoltStore(path)
+	assert.ErrorIs(t, err, ErrStoreInUse)
+	assert.NoError(t, store.Close())
+}
+
+func TestLogStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.log")
+	store, err := OpenLogStore(path)
+	assert.NoError(t, err)
+	for _, key := range []string{"k1", "k2"} {
+		err = store.Update(func(tx StoreTx) error { return tx.Put("a", []byte(key), []byte(key)) })
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, store.Close())
+
+	// Cut the last record as a crash while writing it would
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-3))
+
+	store, err = OpenLogStore(path)
+	assert.NoError(t, err)
+	err = store.View(func(tx StoreTx) error {
+		assert.Equal(t, []byte("k1"), tx.Get("a", []byte("k1")))
+		assert.Nil(t, tx.Get("a", []byte("k2")))
+		return nil
+	})
+	assert.NoError(t, err)
+	err = store.Update(func(tx StoreTx) error { return tx.Put("a", []byte("k3"), []byte("k3")) })
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	store, err = OpenLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	err = store.View(func(tx StoreTx) error {
+		assert.Equal(t, []byte("k3"), tx.Get("a", []byte("k3")))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestLogStoreRefusesCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.log")
+	store, err := OpenLogStore(path)
+	assert.NoError(t, err)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		err = store.Update(func(tx StoreTx) error { return tx.Put("a", []byte(key), []byte(key)) })
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, store.Close())
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	// A damaged last record is torn by a crash and dropped
+	torn := append([]byte{}, data...)
+	torn[len(torn)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, torn, 0600))
+	store, err = OpenLogStore(path)
+	assert.NoError(t, err)
+	err = store.View(func(tx StoreTx) error {
+		assert.Equal(t, []byte("k2"), tx.Get("a", []byte("k2")))
+		assert.Nil(t, tx.Get("a", []byte("k3")))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	// A damaged record followed by others is refused and the log is left as it is
+	corrupt := append([]byte{}, data...)
+	corrupt[logHeaderSize+1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, corrupt, 0600))
+	_, err = OpenLogStore(path)
+	assert.ErrorIs(t, err, ErrCorruptLog)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+}
+
+func TestLogStoreReadErrorsFailTheTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.log")
+	store, err := OpenLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	err = store.Update(func(tx StoreTx) error { return tx.Put("a", []byte("k"), []byte("v")) })
+	assert.NoError(t, err)
+
+	// The values indexed are no longer in the file
+	assert.NoError(t, os.Truncate(path, 0))
+	err = store.View(func(tx StoreTx) error {
+		assert.Nil(t, tx.Get("a", []byte("k")))
+		return nil
+	})
+	assert.ErrorIs(t, err, io.EOF)
+	err = store.Update(func(tx StoreTx) error {
+		if tx.Get("a", []byte("k")) == nil {
+			return tx.Put("a", []byte("k2"), []byte("v"))
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, io.EOF)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestLogStoreCompactsInTheBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.log")
+	store, err := OpenLogStore(path)
+	assert.NoError(t, err)
+	value := bytes.Repeat([]byte{1}, 64<<10)
+	for i := 0; i < 64; i++ {
+		value[0] = byte(i)
+		err = store.Update(func(tx StoreTx) error {
+			assert.NoError(t, tx.Put("a", []byte("k"), value))
+			assert.NoError(t, tx.Put("b", []byte{byte(i)}, value[:1]))
+			if i%2 == 1 {
+				return tx.Delete("b", []byte{byte(i - 1)})
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	// The updates written while compacting are left in the log, the next update compacts it
+	// again when it is still stale
+	store.(*logStore).compaction.Wait()
+	assert.NoError(t, store.Update(func(tx StoreTx) error { return tx.Put("a", []byte("k"), value) }))
+	store.(*logStore).compaction.Wait()
+
+	// Only about one copy of the value is left, the values are read from the log
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(compactLogSize))
+	check := func(store ChainStore) {
+		err := store.View(func(tx StoreTx) error {
+			assert.Equal(t, value, tx.Get("a", []byte("k")))
+			var keys int
+			assert.NoError(t, tx.ForEach("b", func(k, v []byte) error {
+				assert.Equal(t, []byte{k[0]}, v)
+				keys++
+				return nil
+			}))
+			assert.Equal(t, 32, keys)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	check(store)
+	assert.NoError(t, store.Close())
+
+	store, err = OpenLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	check(store)
+}
+
+func TestBlockchainInMemoryStore(t *testing.T) {
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+
+	assert.Equal(t, 0, bc.GetBestHeight())
+	assert.Equal(t, string(MainNet.GenesisHash), bc.GetLastHash())
+	info, err := UTXOSet{bc}.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, MainNet.GenesisReward, info.TotalAmount)
+}
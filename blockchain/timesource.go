@@ -0,0 +1,169 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// medianTimeBlocks is the number of blocks the median time past is computed on
+	medianTimeBlocks = 11
+	// MaxFutureBlockTime is how far ahead of the network-adjusted time a block can be stamped
+	MaxFutureBlockTime = 2 * time.Hour
+	// maxTimeOffset is the largest peer clock offset the network-adjusted time follows
+	maxTimeOffset = 70 * time.Minute
+	// minTimeSamples is the number of peer samples required to adjust the time
+	minTimeSamples = 5
+	// maxTimeSamples bounds the number of peers sampled
+	maxTimeSamples = 200
+)
+
+var (
+	ErrTimeTooOld = errors.New("block timestamp is not after the median time past")
+	ErrTimeTooNew = errors.New("block timestamp is too far in the future")
+)
+
+// TimeSource gives the network-adjusted time used to check the block timestamps
+type TimeSource interface {
+	AdjustedTime() time.Time
+}
+
+// MedianTimeSource adjusts the local clock by the median of the clock offsets reported by the
+// peers. Offsets larger than maxTimeOffset are ignored, the local clock is likely right then
+type MedianTimeSource struct {
+	mu      sync.Mutex
+	offsets map[string]time.Duration
+}
+
+// NewMedianTimeSource creates a time source without any peer sample
+func NewMedianTimeSource() *MedianTimeSource {
+	return &MedianTimeSource{offsets: make(map[string]time.Duration)}
+}
+
+// AddTimeSample records the offset of the clock of the peer, a peer is sampled once
+func (s *MedianTimeSource) AddTimeSample(peer string, offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.offsets[peer]; ok || len(s.offsets) >= maxTimeSamples {
+		return
+	}
+	s.offsets[peer] = offset
+}
+
+// Offset returns the median of the peer offsets, zero until enough peers were sampled
+func (s *MedianTimeSource) Offset() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.offsets) < minTimeSamples {
+		return 0
+	}
+	var offsets []time.Duration
+	for _, offset := range s.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if median > maxTimeOffset || median < -maxTimeOffset {
+		return 0
+	}
+	return median
+}
+
+// AdjustedTime returns the local time corrected by the median peer offset
+func (s *MedianTimeSource) AdjustedTime() time.Time {
+	return time.Now().Add(s.Offset())
+}
+
+type localTimeSource struct{}
+
+func (localTimeSource) AdjustedTime() time.Time {
+	return time.Now()
+}
+
+// SetTimeSource sets the network-adjusted time used to check the block timestamps,
+// the local clock is used by default
+func (bc *Blockchain) SetTimeSource(ts TimeSource) {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	bc.timeSource = ts
+}
+
+func (bc *Blockchain) adjustedTime() time.Time {
+	bc.tipMu.RLock()
+	defer bc.tipMu.RUnlock()
+	if bc.timeSource == nil {
+		return localTimeSource{}.AdjustedTime()
+	}
+	return bc.timeSource.AdjustedTime()
+}
+
+// headerLookup reads the header of a block and its height
+type headerLookup func(hash []byte) (*BlockHeader, int, error)
+
+// MedianTimePast returns the median timestamp of the block and its ancestors, up to
+// medianTimeBlocks blocks. A new block on top of it must be stamped after that time
+func (bc *Blockchain) MedianTimePast(hash []byte) (int64, error) {
+	return medianTimePast(bc.GetBlockHeader, hash)
+}
+
+func medianTimePast(lookup headerLookup, hash []byte) (int64, error) {
+	var timestamps []int64
+	for len(hash) > 0 && len(timestamps) < medianTimeBlocks {
+		header, _, err := lookup(hash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		hash = header.PrevBlockHash
+	}
+	if len(timestamps) == 0 {
+		return 0, nil
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkTimestamp applies the timestamp rules to the header of a block
+func (bc *Blockchain) checkTimestamp(header *BlockHeader) error {
+	return checkHeaderTime(bc.GetBlockHeader, header, bc.adjustedTime())
+}
+
+func checkHeaderTime(lookup headerLookup, header *BlockHeader, now time.Time) error {
+	maxTime := now.Add(MaxFutureBlockTime).Unix()
+	if header.Timestamp > maxTime {
+		return fmt.Errorf("%w: %d is after %d", ErrTimeTooNew, header.Timestamp, maxTime)
+	}
+	if len(header.PrevBlockHash) == 0 {
+		return nil
+	}
+	mtp, err := medianTimePast(lookup, header.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp <= mtp {
+		return fmt.Errorf("%w: %d is not after %d", ErrTimeTooOld, header.Timestamp, mtp)
+	}
+	return nil
+}
+
+// nextBlockTime returns the timestamp of a block mined now on top of prevHash, it is
+// the adjusted time unless the median time past is ahead of it
+func (bc *Blockchain) nextBlockTime(prevHash []byte) (int64, error) {
+	timestamp := bc.adjustedTime().Unix()
+	if len(prevHash) == 0 {
+		return timestamp, nil
+	}
+	mtp, err := bc.MedianTimePast(prevHash)
+	if err != nil {
+		return 0, err
+	}
+	if timestamp <= mtp {
+		timestamp = mtp + 1
+	}
+	return timestamp, nil
+}
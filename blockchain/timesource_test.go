@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMedianTimeSource(t *testing.T) {
+	ts := NewMedianTimeSource()
+	for i := 0; i < minTimeSamples-1; i++ {
+		ts.AddTimeSample(fmt.Sprint(i), time.Minute)
+	}
+	assert.Zero(t, ts.Offset())
+
+	ts.AddTimeSample("4", 2*time.Minute)
+	ts.AddTimeSample("4", time.Hour)
+	assert.Equal(t, time.Minute, ts.Offset())
+
+	// The local clock wins against peers too far away
+	far := NewMedianTimeSource()
+	for i := 0; i < minTimeSamples; i++ {
+		far.AddTimeSample(fmt.Sprint(i), 3*time.Hour)
+	}
+	assert.Zero(t, far.Offset())
+}
+
+func TestBlockTimestampRules(t *testing.T) {
+	wallet := NewWallet()
+	bc := newTestChain(t, wallet)
+	tip, err := bc.GetBlock(bc.tip())
+	assert.NoError(t, err)
+	coinbase := func() []*Transaction {
+		return []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)}
+	}
+
+	old, err := NewBlockContext(context.Background(), coinbase(), tip.Hash, 2, tip.Timestamp)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bc.ValidateBlock(old), ErrTimeTooOld)
+
+	future := time.Now().Add(MaxFutureBlockTime + time.Minute).Unix()
+	early, err := NewBlockContext(context.Background(), coinbase(), tip.Hash, 2, future)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bc.ValidateBlock(early), ErrTimeTooNew)
+
+	// Blocks mined in a row stay after the median time past
+	for i := 0; i < 3; i++ {
+		block, err := bc.MineBlock(coinbase())
+		assert.NoError(t, err)
+		mtp, err := bc.MedianTimePast(block.PrevBlockHash)
+		assert.NoError(t, err)
+		assert.Greater(t, block.Timestamp, mtp)
+	}
+}
@@ -3,7 +3,6 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
@@ -24,9 +23,10 @@ type Transaction struct {
 	ToAddress      string
 	Amount         int
 	TransactionFee int
+	// Replaceable signals that the transaction can be replaced by a higher fee one while unconfirmed
+	Replaceable bool
 }
 
-const rewardInitValue = 100
 const randomFactor = 20
 
 func Now() int64 {
@@ -34,7 +34,6 @@ func Now() int64 {
 }
 
 // NewCoinbaseTX  creates a new coinbase transaction
-// If fee = -1 mean that is genesis transaction
 func NewCoinbaseTX(to, data string, fee int) *Transaction {
 	if data == "" {
 		randData := make([]byte, randomFactor)
@@ -48,11 +47,7 @@ func NewCoinbaseTX(to, data string, fee int) *Transaction {
 
 	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
 
-	// Change reward amount to fee
-	rewardAmount := rewardInitValue
-	if fee != -1 {
-		rewardAmount = int(float32(fee) * 1.5)
-	}
+	rewardAmount := coinbaseReward(fee)
 
 	txout := NewTXOutput(rewardAmount, to)
 
@@ -72,22 +67,70 @@ func NewCoinbaseTX(to, data string, fee int) *Transaction {
 	return &tx
 }
 
+// coinbaseReward returns the reward of a block collecting fee
+func coinbaseReward(fee int) int {
+	return int(float32(fee)*1.5) + activeNetwork.BlockSubsidy
+}
+
 // NewUTXOTransaction new transaction for sending money from, to address with amount of money
 // include process of sign transaction
 // and returns a brand new transaction
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) (*Transaction, error) {
+	return newUTXOTransaction(wallet, to, amount, UTXOSet, false)
+}
+
+// NewReplaceableUTXOTransaction is like NewUTXOTransaction, but the transaction can be
+// replaced by a higher fee one while unconfirmed (see NewFeeBumpTransaction)
+func NewReplaceableUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) (*Transaction, error) {
+	return newUTXOTransaction(wallet, to, amount, UTXOSet, true)
+}
+
+func newUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet, replaceable bool) (*Transaction, error) {
+	if !ValidateAddress(to) {
+		return nil, ErrInvalidAddress
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidTx)
+	}
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	acc, validOutputs, err := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+CalcTxFee(amount))
+	if err != nil {
+		return nil, err
+	}
+
+	if acc < amount+CalcTxFee(amount) {
+		return nil, ErrInsufficientFunds
+	}
+
+	tx := buildUTXOTransaction(wallet, to, amount, acc, validOutputs, replaceable)
+	if err := UTXOSet.Blockchain.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// NewTransactionFromOutputs spends the given outputs of the wallet worth acc, prevTXs are the
+// transactions of the outputs. It lets a wallet without the chain build its transactions
+func NewTransactionFromOutputs(wallet *Wallet, to string, amount, acc int, outputs map[string][]int, prevTXs map[string]Transaction) (*Transaction, error) {
+	if acc < amount+CalcTxFee(amount) {
+		return nil, ErrInsufficientFunds
+	}
+	tx := buildUTXOTransaction(wallet, to, amount, acc, outputs, false)
+	if err := tx.Sign(wallet.PrivateKey, prevTXs); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// buildUTXOTransaction returns the unsigned transaction spending the outputs worth acc,
+// the remainder goes back to the wallet
+func buildUTXOTransaction(wallet *Wallet, to string, amount, acc int, validOutputs map[string][]int, replaceable bool) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 	fee := CalcTxFee(amount)
-	pubKeyHash := HashPubKey(wallet.PublicKey)
 	from := fmt.Sprintf("%s", wallet.GetAddress())
 	totalAmount := amount + fee
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, totalAmount)
-
-	if acc < totalAmount {
-		log.Panic("Insufficient funds")
-		return nil
-	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
@@ -118,11 +161,10 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 		ToAddress:      to,
 		Amount:         amount,
 		TransactionFee: fee,
+		Replaceable:    replaceable,
 	}
 
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
-
 	return &tx
 }
 
@@ -210,77 +252,115 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
 	}
 
-	txCopy := Transaction{ID: tx.ID, Vin: inputs, Vout: outputs, Timestamp: tx.Timestamp, FromAddress: tx.FromAddress, ToAddress: tx.ToAddress}
+	txCopy := Transaction{ID: tx.ID, Vin: inputs, Vout: outputs, Timestamp: tx.Timestamp, FromAddress: tx.FromAddress, ToAddress: tx.ToAddress, Replaceable: tx.Replaceable}
 
 	return txCopy
 }
 
-// Sign signs transaction with private key and previous transactions
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign signs transaction with private key and previous transactions, ErrInvalidTx is returned
+// when an input does not refer to an output of the previous transactions
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
+	}
+	prevOuts, ok := tx.prevOutputs(prevTXs)
+	if !ok {
+		return fmt.Errorf("%w: previous transaction of %x is not correct", ErrInvalidTx, tx.ID)
+	}
+	return tx.SignOutputs(privKey, prevOuts)
+}
+
+// SignOutputs signs transaction with private key, prevOuts maps the outpoint of each input to
+// the output it spends. ErrInvalidTx is returned when an input has no output
+func (tx *Transaction) SignOutputs(privKey ecdsa.PrivateKey, prevOuts map[string]TXOutput) error {
+	if tx.IsCoinbase() {
+		return nil
 	}
 
 	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+		if _, ok := prevOuts[outpoint(vin.Txid, vin.Vout)]; !ok {
+			return fmt.Errorf("%w: previous output of %x is not found", ErrInvalidTx, tx.ID)
 		}
 	}
 
 	txCopy := tx.TrimmedCopy()
 
 	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
 		txCopy.Vin[inID].Signature = nil
 
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOuts[outpoint(vin.Txid, vin.Vout)].PubKeyHash
 		dataToSign := fmt.Sprintf("%x\n", txCopy)
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		// r and s are padded to the curve size, Verify splits the signature in two halves
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 
 		tx.Vin[inID].Signature = signature
 		txCopy.Vin[inID].PubKey = nil
 
 	}
+	return nil
+}
+
+// prevOutputs returns the outputs of the previous transactions spent by the inputs by outpoint,
+// false when an input does not refer to an output of the previous transactions
+func (tx *Transaction) prevOutputs(prevTXs map[string]Transaction) (map[string]TXOutput, bool) {
+	prevOuts := make(map[string]TXOutput)
+	for _, vin := range tx.Vin {
+		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		if prevTx.ID == nil || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return nil, false
+		}
+		prevOuts[outpoint(vin.Txid, vin.Vout)] = prevTx.Vout[vin.Vout]
+	}
+	return prevOuts, true
 }
 
-// Verify verifies transaction
+// Verify verifies transaction, it is false when an input does not refer to an output of the
+// previous transactions
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
+	prevOuts, ok := tx.prevOutputs(prevTXs)
+	return ok && tx.VerifyOutputs(prevOuts)
+}
 
-	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
-		}
+// VerifyOutputs verifies transaction, prevOuts maps the outpoint of each input to the output it
+// spends. It is false when an input has no output
+func (tx *Transaction) VerifyOutputs(prevOuts map[string]TXOutput) bool {
+	if tx.IsCoinbase() {
+		return true
 	}
 
 	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
 
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		prevOut, ok := prevOuts[outpoint(vin.Txid, vin.Vout)]
+		if !ok {
+			return false
+		}
 		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
 
-		r, s, x, y := big.Int{}, big.Int{}, big.Int{}, big.Int{}
+		r, s := big.Int{}, big.Int{}
 		sigLen := len(vin.Signature)
 		r.SetBytes(vin.Signature[:(sigLen / 2)])
 		s.SetBytes(vin.Signature[(sigLen / 2):])
 
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
+		rawPubKey, ok := parsePublicKey(vin.PubKey)
+		if !ok {
+			return false
+		}
 
 		dataToVerify := fmt.Sprintf("%x\n", txCopy)
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		if ecdsa.Verify(rawPubKey, []byte(dataToVerify), &r, &s) == false {
 			return false
 		}
 		txCopy.Vin[inID].PubKey = nil
@@ -290,14 +370,10 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 }
 
 // DeserializeTransaction deserializes a transaction
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return transaction
+	return transaction, err
 }
@@ -15,6 +15,48 @@ type TXOutput struct {
 
 type TXOutputs struct {
 	Outputs []TXOutput
+	// Indexes holds the index in the transaction of each output, spent outputs are not stored
+	Indexes []int
+}
+
+// Add appends the output found at index vout of its transaction
+func (o *TXOutputs) Add(vout int, out TXOutput) {
+	o.Outputs = append(o.Outputs, out)
+	o.Indexes = append(o.Indexes, vout)
+}
+
+// insert adds the output at index vout of its transaction, keeping the outputs ordered by index
+func (o *TXOutputs) insert(vout int, out TXOutput) {
+	if o.Indexes == nil {
+		for i := range o.Outputs {
+			o.Indexes = append(o.Indexes, i)
+		}
+	}
+	i := 0
+	for i < len(o.Indexes) && o.Indexes[i] < vout {
+		i++
+	}
+	o.Outputs = append(o.Outputs[:i], append([]TXOutput{out}, o.Outputs[i:]...)...)
+	o.Indexes = append(o.Indexes[:i], append([]int{vout}, o.Indexes[i:]...)...)
+}
+
+// Index returns the index in the transaction of the i-th stored output
+func (o *TXOutputs) Index(i int) int {
+	// Sets written before the indexes were stored keep every output of the transaction
+	if o.Indexes == nil {
+		return i
+	}
+	return o.Indexes[i]
+}
+
+// Find returns the output at index vout of the transaction if it is unspent
+func (o *TXOutputs) Find(vout int) (TXOutput, bool) {
+	for i, out := range o.Outputs {
+		if o.Index(i) == vout {
+			return out, true
+		}
+	}
+	return TXOutput{}, false
 }
 
 // IsLockedWithKey checks if the output can be used by the owner of the pubkey
@@ -45,11 +87,10 @@ func (o *TXOutputs) Serialize() []byte {
 	return buff.Bytes()
 }
 
-func DeserializeOutputs(data []byte) TXOutputs {
+func DeserializeOutputs(data []byte) (TXOutputs, error) {
 	var outputs TXOutputs
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	err := dec.Decode(&outputs)
-	utils.HandleError(err)
-	return outputs
+	return outputs, err
 }
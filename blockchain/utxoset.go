@@ -1,10 +1,11 @@
 package blockchain
 
 import (
-	"blockchaincore/utils"
+	"bytes"
+	"encoding/gob"
 	"encoding/hex"
-	"github.com/boltdb/bolt"
-	"log"
+	"errors"
+	"fmt"
 )
 
 type UTXOSet struct {
@@ -13,157 +14,396 @@ type UTXOSet struct {
 
 const utxoBucket = "utxo"
 
-// Reindex rebuilds the UTXO set
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Db
-	bucketName := []byte(utxoBucket)
+// undoBucket maps a block hash to the outputs spent by the block, they are restored when the
+// block is disconnected
+const undoBucket = "undo"
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
-		}
-
-		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
-	}
+// utxoTipKey holds the hash of the last block applied to the UTXO set, in the blocks bucket
+var utxoTipKey = []byte("u")
 
-	UTXO := u.Blockchain.FindUTXO()
+var ErrNoUndoData = errors.New("no undo data for the block")
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+// spentOutput is an output spent by a block, as stored in its undo data
+type spentOutput struct {
+	Txid   []byte
+	Index  int
+	Output TXOutput
+}
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panic(err)
-			}
+// Reindex rebuilds the UTXO set from the whole chain, ErrBlockPruned is returned on a pruned chain
+func (u UTXOSet) Reindex() error {
+	return u.Blockchain.store.Update(reindexUTXO)
+}
 
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
+// reindexUTXO rebuilds the UTXO set from the chain ending at the tip
+func reindexUTXO(tx StoreTx) error {
+	tip := tx.Get(blocksBucket, []byte("l"))
+	UTXO, err := findUTXO(tx, tip)
+	if err != nil {
+		return err
+	}
+	if err := tx.ClearBucket(utxoBucket); err != nil {
+		return err
+	}
+	for txID, outs := range UTXO {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
 		}
 
+		if err := tx.Put(utxoBucket, key, outs.Serialize()); err != nil {
+			return err
+		}
+	}
+	if len(tip) == 0 {
 		return nil
-	})
+	}
+	return tx.Put(blocksBucket, utxoTipKey, tip)
 }
 
-func (u *UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+func (u *UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.Db
+	db := u.Blockchain.store
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	err := db.View(func(tx StoreTx) error {
+		return tx.ForEach(utxoBucket, func(k, v []byte) error {
 			txId := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
-			for outIdx, out := range outs.Outputs {
+			for i, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOutputs[txId] = append(unspentOutputs[txId], outIdx)
+					unspentOutputs[txId] = append(unspentOutputs[txId], outs.Index(i))
 				}
 			}
-		}
-		return nil
+			return nil
+		})
 	})
-	utils.HandleError(err)
-	return accumulated, unspentOutputs
+	if err != nil {
+		return 0, nil, err
+	}
+	return accumulated, unspentOutputs, nil
 }
 
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
 	var UTXOs []TXOutput
-	db := u.Blockchain.Db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+	db := u.Blockchain.store
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
+	err := db.View(func(tx StoreTx) error {
+		return tx.ForEach(utxoBucket, func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
 			for _, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
-		}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return UTXOs, nil
+}
 
-		return nil
+// Update applies the block following the tip of the UTXO set: the spent outputs are removed
+// and kept as the undo data of the block, the new outputs are added. It does nothing when the
+// block was applied already, as the blocks connected to the chain are
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Blockchain.store.Update(func(dbTx StoreTx) error {
+		if bytes.Equal(dbTx.Get(blocksBucket, utxoTipKey), block.Hash) {
+			return nil
+		}
+		return applyBlock(dbTx, block)
 	})
-	utils.HandleError(err)
-	return UTXOs
-}
-
-// TODO: NOT WORK
-// Update When new block is mined UTXO set is updated
-// Update by removing spent outputs and adding unspent outputs from newly mined transactions
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Db
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					log.Println("outsBytes: ", outsBytes)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						utils.HandleError(err)
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						utils.HandleError(err)
-					}
+}
+
+// applyBlock updates the UTXO set with the block in the transaction connecting it
+func applyBlock(dbTx StoreTx, block *Block) error {
+	var spent []spentOutput
+	for _, tx := range block.Transactions {
+		txSpent, err := applyTx(dbTx, tx)
+		if err != nil {
+			return err
+		}
+		spent = append(spent, txSpent...)
+	}
+
+	var undo bytes.Buffer
+	if err := gob.NewEncoder(&undo).Encode(spent); err != nil {
+		return err
+	}
+	if err := dbTx.Put(undoBucket, block.Hash, undo.Bytes()); err != nil {
+		return err
+	}
+	return dbTx.Put(blocksBucket, utxoTipKey, block.Hash)
+}
+
+// applyTx removes the outputs spent by the transaction from the UTXO set and adds its outputs,
+// it returns the spent outputs
+func applyTx(dbTx StoreTx, tx *Transaction) ([]spentOutput, error) {
+	var spent []spentOutput
+	if !tx.IsCoinbase() {
+		for _, vin := range tx.Vin {
+			updatedOuts := TXOutputs{}
+			outsBytes := dbTx.Get(utxoBucket, vin.Txid)
+			if outsBytes == nil {
+				return nil, fmt.Errorf("%w: output %x:%d is not unspent", ErrInvalidBlockTx, vin.Txid, vin.Vout)
+			}
+			outs, err := DeserializeOutputs(outsBytes)
+			if err != nil {
+				return nil, err
+			}
+
+			found := false
+			for i, out := range outs.Outputs {
+				if outs.Index(i) != vin.Vout {
+					updatedOuts.Add(outs.Index(i), out)
+				} else {
+					spent = append(spent, spentOutput{Txid: vin.Txid, Index: vin.Vout, Output: out})
+					found = true
 				}
 			}
+			if !found {
+				return nil, fmt.Errorf("%w: output %x:%d is not unspent", ErrInvalidBlockTx, vin.Txid, vin.Vout)
+			}
+
+			if len(updatedOuts.Outputs) == 0 {
+				err = dbTx.Delete(utxoBucket, vin.Txid)
+			} else {
+				err = dbTx.Put(utxoBucket, vin.Txid, updatedOuts.Serialize())
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	newOutputs := TXOutputs{}
+	for outIdx, out := range tx.Vout {
+		newOutputs.Add(outIdx, out)
+	}
+	return spent, dbTx.Put(utxoBucket, tx.ID, newOutputs.Serialize())
+}
+
+// revertBlock reverts applyBlock: the outputs created by the block are removed and the outputs
+// it spent are restored from its undo data. ErrNoUndoData is returned when the set was built
+// by Reindex after the block
+func revertBlock(dbTx StoreTx, block *Block) error {
+	data := dbTx.Get(undoBucket, block.Hash)
+	if data == nil {
+		return fmt.Errorf("%w: %x", ErrNoUndoData, block.Hash)
+	}
+	var spent []spentOutput
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&spent); err != nil {
+		return err
+	}
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+	for _, tx := range block.Transactions {
+		if err := dbTx.Delete(utxoBucket, tx.ID); err != nil {
+			return err
+		}
+	}
+	for i := len(spent) - 1; i >= 0; i-- {
+		outs := TXOutputs{}
+		if outsBytes := dbTx.Get(utxoBucket, spent[i].Txid); outsBytes != nil {
+			var err error
+			if outs, err = DeserializeOutputs(outsBytes); err != nil {
+				return err
 			}
+		}
+		outs.insert(spent[i].Index, spent[i].Output)
+		if err := dbTx.Put(utxoBucket, spent[i].Txid, outs.Serialize()); err != nil {
+			return err
+		}
+	}
 
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			utils.HandleError(err)
+	if err := dbTx.Delete(undoBucket, block.Hash); err != nil {
+		return err
+	}
+	return dbTx.Put(blocksBucket, utxoTipKey, block.PrevBlockHash)
+}
+
+// CatchUp brings the UTXO set to the tip of the chain, see catchUpUTXO
+func (u UTXOSet) CatchUp() error {
+	return u.Blockchain.store.Update(catchUpUTXO)
+}
+
+// catchUpUTXO brings the UTXO set to the tip of the chain: the blocks of a branch left by a
+// reorganization are reverted, then the blocks up to the tip are applied. The set is rebuilt
+// from the whole chain when it was never built or misses undo data
+func catchUpUTXO(tx StoreTx) error {
+	from := tx.Get(blocksBucket, utxoTipKey)
+	tip := tx.Get(blocksBucket, []byte("l"))
+	if len(from) == 0 {
+		return reindexUTXO(tx)
+	}
+	if len(tip) == 0 || bytes.Equal(from, tip) {
+		return nil
+	}
+	disconnect, connect, err := branches(tx, from, tip)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range disconnect {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		if err := revertBlock(tx, block); errors.Is(err, ErrNoUndoData) {
+			return reindexUTXO(tx)
+		} else if err != nil {
+			return err
+		}
+	}
+	for i := len(connect) - 1; i >= 0; i-- {
+		block, err := getBlock(tx, connect[i])
+		if err != nil {
+			return err
 		}
+		if err := applyBlock(tx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utxoViewAt returns a scratch transaction over dbTx holding the UTXO set after the block hash,
+// an empty hash is the empty set before the genesis block. The blocks of the best chain above
+// the common ancestor are reverted with their undo data and the blocks of the branch of hash
+// are applied, nothing is written to dbTx
+func utxoViewAt(dbTx StoreTx, hash []byte) (StoreTx, error) {
+	view := newScratchTx(dbTx)
+	if len(hash) == 0 {
+		return view, view.ClearBucket(utxoBucket)
+	}
+	if bytes.Equal(dbTx.Get(blocksBucket, utxoTipKey), hash) {
+		return view, nil
+	}
+	if err := view.Put(blocksBucket, []byte("l"), hash); err != nil {
+		return nil, err
+	}
+	return view, catchUpUTXO(view)
+}
+
+// CheckTip repairs a UTXO set which does not match the tip of the chain, as left by a crash of
+// a version connecting the blocks and updating the set apart. It tells whether a repair was needed
+func (u UTXOSet) CheckTip() (bool, error) {
+	consistent := false
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		consistent = bytes.Equal(tx.Get(blocksBucket, utxoTipKey), tx.Get(blocksBucket, []byte("l")))
 		return nil
 	})
-	utils.HandleError(err)
+	if err != nil || consistent {
+		return false, err
+	}
+	return true, u.CatchUp()
+}
 
+// branches returns the blocks from a down to the common ancestor of a and b excluded, and the
+// same for b
+func branches(tx StoreTx, a, b []byte) ([][]byte, [][]byte, error) {
+	var aBranch, bBranch [][]byte
+	_, aHeight, err := getHeader(tx, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, bHeight, err := getHeader(tx, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	for !bytes.Equal(a, b) {
+		if aHeight >= bHeight {
+			aBranch = append(aBranch, a)
+			header, _, err := getHeader(tx, a)
+			if err != nil {
+				return nil, nil, err
+			}
+			a, aHeight = header.PrevBlockHash, aHeight-1
+		} else {
+			bBranch = append(bBranch, b)
+			header, _, err := getHeader(tx, b)
+			if err != nil {
+				return nil, nil, err
+			}
+			b, bHeight = header.PrevBlockHash, bHeight-1
+		}
+		if len(a) == 0 && len(b) == 0 {
+			break
+		}
+	}
+	return aBranch, bBranch, nil
 }
 
-func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.Db
-	counter := 0
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+// FindOutput returns the output at index vout of the transaction if it is unspent
+func (u UTXOSet) FindOutput(txID []byte, vout int) (TXOutput, bool, error) {
+	var out TXOutput
+	found := false
 
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		var err error
+		out, found, err = findOutput(tx, txID, vout)
+		return err
+	})
+	return out, found, err
+}
+
+// FindPrevOutputs returns the outputs spent by the inputs of tx by outpoint, ErrMissingInputs is
+// returned when an input refers to an unknown or spent output. Only the UTXO set is read, the
+// outputs of the pruned blocks are found too
+func (u UTXOSet) FindPrevOutputs(tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
+	err := u.Blockchain.store.View(func(dbTx StoreTx) error {
+		for _, vin := range tx.Vin {
+			op := outpoint(vin.Txid, vin.Vout)
+			out, ok, err := findOutput(dbTx, vin.Txid, vin.Vout)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%w: %s", ErrMissingInputs, op)
+			}
+			prevOuts[op] = out
 		}
 		return nil
 	})
-	utils.HandleError(err)
-	return counter
+	if err != nil {
+		return nil, err
+	}
+	return prevOuts, nil
+}
+
+// findOutput returns the output at index vout of the transaction if the UTXO set holds it
+func findOutput(dbTx StoreTx, txID []byte, vout int) (TXOutput, bool, error) {
+	outsBytes := dbTx.Get(utxoBucket, txID)
+	if outsBytes == nil {
+		return TXOutput{}, false, nil
+	}
+	outs, err := DeserializeOutputs(outsBytes)
+	if err != nil {
+		return TXOutput{}, false, err
+	}
+	out, found := outs.Find(vout)
+	return out, found, nil
+}
+
+func (u UTXOSet) CountTransactions() (int, error) {
+	db := u.Blockchain.store
+	counter := 0
+	err := db.View(func(tx StoreTx) error {
+		return tx.ForEach(utxoBucket, func(k, v []byte) error {
+			counter++
+			return nil
+		})
+	})
+	return counter, err
 }
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBlockConnectionIsAtomic(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	wallet := NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	blocks, err := bc.Generate(1, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+
+	// A block spending an unknown output is rejected, the tip and the UTXO set stay as they were
+	spend := &Transaction{Vin: []TXInput{{Txid: []byte("unknown"), Vout: 0}}, Vout: []TXOutput{*NewTXOutput(1, string(wallet.GetAddress()))}}
+	spend.ID = spend.Hash()
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 0)
+	bad, err := NewBlockContext(context.Background(), []*Transaction{coinbase, spend}, blocks[0].Hash, 2, time.Now().Unix())
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bc.AddBlock(bad), ErrInvalidBlockTx)
+	assert.False(t, bc.HasBlock(bad.Hash))
+	assert.Equal(t, 1, bc.GetBestHeight())
+
+	// The tip moved without the UTXO set, as a crash between two transactions left it
+	next, err := NewBlockContext(context.Background(), []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "", 0)}, blocks[0].Hash, 2, time.Now().Unix())
+	assert.NoError(t, err)
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, next); err != nil {
+			return err
+		}
+		return tx.Put(blocksBucket, []byte("l"), next.Hash)
+	})
+	assert.NoError(t, err)
+	reopened, err := NewBlockchainFromStore(bc.store)
+	assert.NoError(t, err)
+	repaired, err := UTXOSet{reopened}.CheckTip()
+	assert.NoError(t, err)
+	assert.True(t, repaired)
+	repaired, err = UTXOSet{reopened}.CheckTip()
+	assert.NoError(t, err)
+	assert.False(t, repaired)
+	assert.Equal(t, 2*RegTest.BlockSubsidy, balanceOf(t, reopened, wallet))
+}
@@ -0,0 +1,289 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// snapshotMagic starts a UTXO snapshot, it is followed by the version of the format
+const snapshotMagic = "utxo"
+const snapshotVersion = byte(1)
+
+// maxSnapshotField bounds the transaction ids and public key hashes read from a snapshot
+const maxSnapshotField = 1024
+
+var (
+	ErrUTXOSetNotBuilt      = errors.New("the UTXO set was never built")
+	ErrInvalidSnapshot      = errors.New("invalid UTXO snapshot")
+	ErrSnapshotHashMismatch = errors.New("UTXO snapshot hash mismatch")
+)
+
+// UTXOSetInfo describes the UTXO set as of a block
+type UTXOSetInfo struct {
+	BlockHash []byte
+	Height    int
+	// Transactions is the number of transactions with unspent outputs
+	Transactions int
+	Outputs      int
+	// TotalAmount is the sum of the unspent outputs, the supply of coins
+	TotalAmount int
+	// Hash is the MuHash of the unspent outputs, it does not depend on how they are stored
+	Hash []byte
+}
+
+// utxoElement is the encoding of an unspent output added to the MuHash of the set
+func utxoElement(txID []byte, vout int, out TXOutput) []byte {
+	var buf bytes.Buffer
+	buf.Write(txID)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(vout))
+	_ = binary.Write(&buf, binary.BigEndian, int64(out.Value))
+	buf.Write(out.PubKeyHash)
+	return buf.Bytes()
+}
+
+// Info returns the block, the size, the supply and the hash of the UTXO set
+func (u UTXOSet) Info() (*UTXOSetInfo, error) {
+	var info *UTXOSetInfo
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		var err error
+		info, err = u.info(tx, nil)
+		return err
+	})
+	return info, err
+}
+
+// utxoTip returns the last block applied to the UTXO set and its height
+func utxoTip(tx StoreTx) ([]byte, int, error) {
+	tip := tx.Get(blocksBucket, utxoTipKey)
+	if len(tip) == 0 {
+		return nil, 0, ErrUTXOSetNotBuilt
+	}
+	_, height, err := getHeader(tx, tip)
+	if err != nil {
+		return nil, 0, err
+	}
+	return append([]byte{}, tip...), height, nil
+}
+
+// info walks the UTXO set in key order, each transaction is passed to visit when set
+func (u UTXOSet) info(tx StoreTx, visit func(txID []byte, outs TXOutputs) error) (*UTXOSetInfo, error) {
+	tip, height, err := utxoTip(tx)
+	if err != nil {
+		return nil, err
+	}
+	info := &UTXOSetInfo{BlockHash: tip, Height: height}
+	hash := NewMuHash()
+	err = tx.ForEach(utxoBucket, func(k, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		info.Transactions++
+		for i, out := range outs.Outputs {
+			info.Outputs++
+			info.TotalAmount += out.Value
+			hash.Add(utxoElement(k, outs.Index(i), out))
+		}
+		if visit != nil {
+			return visit(k, outs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	info.Hash = hash.Digest()
+	return info, nil
+}
+
+// Dump writes a snapshot of the UTXO set: the block it was built at, the transactions ordered
+// by id with their outputs ordered by index, and the MuHash of the set. The same set always
+// gives the same snapshot
+func (u UTXOSet) Dump(w io.Writer) (*UTXOSetInfo, error) {
+	var info *UTXOSetInfo
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		tip, height, err := utxoTip(tx)
+		if err != nil {
+			return err
+		}
+		count := 0
+		err = tx.ForEach(utxoBucket, func(k, v []byte) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		out := bufio.NewWriter(w)
+		out.WriteString(snapshotMagic)
+		out.WriteByte(snapshotVersion)
+		writeSnapshotBytes(out, tip)
+		_ = binary.Write(out, binary.BigEndian, int64(height))
+		_ = binary.Write(out, binary.BigEndian, uint64(count))
+		info, err = u.info(tx, func(txID []byte, outs TXOutputs) error {
+			writeSnapshotBytes(out, txID)
+			_ = binary.Write(out, binary.BigEndian, uint32(len(outs.Outputs)))
+			for _, i := range sortedOutputs(outs) {
+				_ = binary.Write(out, binary.BigEndian, uint32(outs.Index(i)))
+				_ = binary.Write(out, binary.BigEndian, int64(outs.Outputs[i].Value))
+				writeSnapshotBytes(out, outs.Outputs[i].PubKeyHash)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		out.Write(info.Hash)
+		return out.Flush()
+	})
+	return info, err
+}
+
+// Load replaces the UTXO set by the snapshot, the set is left untouched when the snapshot is
+// invalid. The block of the snapshot must be known by the chain, the blocks following it are
+// applied by CatchUp. trustedHash, when set, is the MuHash the snapshot must have
+func (u UTXOSet) Load(r io.Reader, trustedHash []byte) (*UTXOSetInfo, error) {
+	in := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic || header[len(snapshotMagic)] != snapshotVersion {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidSnapshot)
+	}
+	blockHash, err := readSnapshotBytes(in)
+	if err != nil {
+		return nil, err
+	}
+	var height int64
+	var count uint64
+	if err := readSnapshot(in, &height, &count); err != nil {
+		return nil, err
+	}
+
+	info := &UTXOSetInfo{BlockHash: blockHash, Height: int(height)}
+	err = u.Blockchain.store.Update(func(tx StoreTx) error {
+		if _, known, err := getHeader(tx, blockHash); err != nil || known != info.Height {
+			return fmt.Errorf("%w: block %x at height %d is not in the chain", ErrInvalidSnapshot, blockHash, height)
+		}
+		if err := tx.ClearBucket(utxoBucket); err != nil {
+			return err
+		}
+
+		hash := NewMuHash()
+		var last []byte
+		for ; count > 0; count-- {
+			txID, outs, err := readSnapshotOutputs(in)
+			if err != nil {
+				return err
+			}
+			if last != nil && bytes.Compare(txID, last) <= 0 {
+				return fmt.Errorf("%w: transactions are not ordered", ErrInvalidSnapshot)
+			}
+			last = txID
+			info.Transactions++
+			for i, out := range outs.Outputs {
+				info.Outputs++
+				info.TotalAmount += out.Value
+				hash.Add(utxoElement(txID, outs.Index(i), out))
+			}
+			if err := tx.Put(utxoBucket, txID, outs.Serialize()); err != nil {
+				return err
+			}
+		}
+
+		info.Hash = hash.Digest()
+		digest := make([]byte, len(info.Hash))
+		if _, err := io.ReadFull(in, digest); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		if !bytes.Equal(digest, info.Hash) {
+			return fmt.Errorf("%w: the outputs do not match the hash of the snapshot", ErrSnapshotHashMismatch)
+		}
+		if trustedHash != nil && !bytes.Equal(trustedHash, info.Hash) {
+			return fmt.Errorf("%w: got %x, trusted %x", ErrSnapshotHashMismatch, info.Hash, trustedHash)
+		}
+		return tx.Put(blocksBucket, utxoTipKey, blockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// sortedOutputs returns the positions of the outputs ordered by their index in the transaction
+func sortedOutputs(outs TXOutputs) []int {
+	order := make([]int, len(outs.Outputs))
+	for i := range order {
+		order[i] = i
+		for j := i; j > 0 && outs.Index(order[j]) < outs.Index(order[j-1]); j-- {
+			order[j], order[j-1] = order[j-1], order[j]
+		}
+	}
+	return order
+}
+
+func readSnapshotOutputs(in io.Reader) ([]byte, TXOutputs, error) {
+	outs := TXOutputs{}
+	txID, err := readSnapshotBytes(in)
+	if err != nil {
+		return nil, outs, err
+	}
+	var n uint32
+	if err := readSnapshot(in, &n); err != nil {
+		return nil, outs, err
+	}
+	if n == 0 || n > maxSnapshotField {
+		return nil, outs, fmt.Errorf("%w: %d outputs", ErrInvalidSnapshot, n)
+	}
+	for ; n > 0; n-- {
+		var index uint32
+		var value int64
+		if err := readSnapshot(in, &index, &value); err != nil {
+			return nil, outs, err
+		}
+		if k := len(outs.Indexes); k > 0 && int(index) <= outs.Indexes[k-1] {
+			return nil, outs, fmt.Errorf("%w: outputs are not ordered", ErrInvalidSnapshot)
+		}
+		pubKeyHash, err := readSnapshotBytes(in)
+		if err != nil {
+			return nil, outs, err
+		}
+		outs.Add(int(index), TXOutput{Value: int(value), PubKeyHash: pubKeyHash})
+	}
+	return txID, outs, nil
+}
+
+func writeSnapshotBytes(w io.Writer, data []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint32(len(data)))
+	_, _ = w.Write(data)
+}
+
+func readSnapshotBytes(in io.Reader) ([]byte, error) {
+	var n uint32
+	if err := readSnapshot(in, &n); err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotField {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrInvalidSnapshot, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	return data, nil
+}
+
+func readSnapshot(in io.Reader, values ...interface{}) error {
+	for _, value := range values {
+		if err := binary.Read(in, binary.BigEndian, value); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMuHashIsOrderIndependent(t *testing.T) {
+	a, b := NewMuHash(), NewMuHash()
+	a.Add([]byte("x"))
+	a.Add([]byte("y"))
+	b.Add([]byte("y"))
+	b.Add([]byte("x"))
+	assert.Equal(t, a.Digest(), b.Digest())
+
+	b.Add([]byte("z"))
+	assert.NotEqual(t, a.Digest(), b.Digest())
+	b.Remove([]byte("z"))
+	assert.Equal(t, a.Digest(), b.Digest())
+}
+
+func TestUTXOSnapshotRoundTrip(t *testing.T) {
+	SetNetwork(RegTest)
+	defer SetNetwork(MainNet)
+	sender, receiver := NewWallet(), NewWallet()
+	bc, err := CreateBlockchainInStore(NewMemoryStore())
+	assert.NoError(t, err)
+	defer bc.Close()
+	utxoSet := UTXOSet{bc}
+	empty, err := NewBlockchainFromStore(NewMemoryStore())
+	assert.NoError(t, err)
+	_, err = UTXOSet{empty}.Info()
+	assert.ErrorIs(t, err, ErrUTXOSetNotBuilt)
+
+	_, err = bc.Generate(2, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	tx, err := NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, &utxoSet)
+	assert.NoError(t, err)
+	block, err := bc.MineBlock([]*Transaction{tx, NewCoinbaseTX(string(sender.GetAddress()), "", tx.TransactionFee)})
+	assert.NoError(t, err)
+
+	info, err := utxoSet.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, info.Height)
+	assert.Equal(t, block.Hash, info.BlockHash)
+	assert.Equal(t, RegTest.GenesisReward+3*RegTest.BlockSubsidy, info.TotalAmount)
+
+	var snapshot, again bytes.Buffer
+	dumped, err := utxoSet.Dump(&snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, info, dumped)
+	_, err = utxoSet.Dump(&again)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot.Bytes(), again.Bytes())
+
+	// The snapshot is checked against the trusted hash before replacing the set
+	_, err = utxoSet.Load(bytes.NewReader(snapshot.Bytes()), make([]byte, 32))
+	assert.ErrorIs(t, err, ErrSnapshotHashMismatch)
+	corrupted := append([]byte{}, snapshot.Bytes()...)
+	corrupted[len(corrupted)-40] ^= 1
+	_, err = utxoSet.Load(bytes.NewReader(corrupted), nil)
+	assert.Error(t, err)
+	current, err := utxoSet.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, info, current)
+
+	// A snapshot of an older block is caught up with the chain
+	_, err = bc.Generate(1, string(receiver.GetAddress()))
+	assert.NoError(t, err)
+	loaded, err := utxoSet.Load(bytes.NewReader(snapshot.Bytes()), info.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, info, loaded)
+	assert.NoError(t, utxoSet.CatchUp())
+	current, err = utxoSet.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, current.Height)
+	assert.Equal(t, 10+RegTest.BlockSubsidy, balanceOf(t, bc, receiver))
+}
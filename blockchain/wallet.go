@@ -9,18 +9,22 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ripemd160"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
+	"sort"
 )
 
 const walletVersion = byte(0x00)
 const WalletFile = "wallet_%s.dat"
 const addressChecksumLen = 4
 
+var ErrInvalidPrivateKey = errors.New("invalid private key")
+
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
@@ -48,8 +52,33 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 		fmt.Println("An error occured while generating a new key pair", err)
 	}
 
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pubKey
+	return *private, publicKeyBytes(&private.PublicKey)
+}
+
+// publicKeyBytes returns X followed by Y, both padded to the curve size. The wallets created
+// by older versions keep their unpadded key, so their address does not change
+func publicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, 64)
+	pub.X.FillBytes(pubKey[:32])
+	pub.Y.FillBytes(pubKey[32:])
+	return pubKey
+}
+
+// parsePublicKey reads a public key made of X followed by Y. An unpadded key of an older wallet
+// is shorter than 64 bytes, X ends where the point is on the curve
+func parsePublicKey(pubKey []byte) (*ecdsa.PublicKey, bool) {
+	curve := elliptic.P256()
+	for xLen := len(pubKey) - 32; xLen <= 32 && xLen <= len(pubKey); xLen++ {
+		if xLen < 0 {
+			continue
+		}
+		x := new(big.Int).SetBytes(pubKey[:xLen])
+		y := new(big.Int).SetBytes(pubKey[xLen:])
+		if curve.IsOnCurve(x, y) {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+		}
+	}
+	return nil, false
 }
 
 func (w Wallet) GetAddress() []byte {
@@ -127,19 +156,20 @@ func (ws *Wallets) GetAddresses() []string {
 	for address := range ws.Wallets {
 		addresses = append(addresses, address)
 	}
+	sort.Strings(addresses)
 
 	return addresses
 }
 
 func (ws *Wallets) LoadFromFile(nodeID string) error {
-	walletFile := fmt.Sprintf(WalletFile, nodeID)
+	walletFile := NetworkFilePath(WalletFile, nodeID)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	var wallets Wallets
@@ -147,7 +177,7 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	ws.Wallets = wallets.Wallets
@@ -155,33 +185,36 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	return nil
 }
 
-func (ws Wallets) SaveToFile(nodeID string) {
+func (ws Wallets) SaveToFile(nodeID string) error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(WalletFile, nodeID)
+	walletFile := NetworkFilePath(WalletFile, nodeID)
 	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
+	if err := CreateNetworkDir(); err != nil {
+		return err
 	}
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 }
 
-func (ws *Wallets) FromPrivateKey(privateKey string) *Wallet {
+// FromPrivateKey adds the wallet of the hex encoded private key, ErrInvalidPrivateKey is
+// returned when the key cannot be decoded
+func (ws *Wallets) FromPrivateKey(privateKey string) (*Wallet, error) {
 	wallet := &Wallet{}
-	privKey, _ := ToECDSAFromHex(privateKey)
+	privKey, err := ToECDSAFromHex(privateKey)
+	if err != nil {
+		return nil, err
+	}
 	wallet.PrivateKey = *privKey
-	var pubKey []byte
-	pubKey = append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
-	wallet.PublicKey = pubKey
+	wallet.PublicKey = publicKeyBytes(&privKey.PublicKey)
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 	ws.Wallets[address] = wallet
-	return wallet
+	return wallet, nil
 }
 
 func PrivateKeyToBytes(prv *ecdsa.PrivateKey) []byte {
@@ -193,7 +226,11 @@ func PrivateKeyToBytes(prv *ecdsa.PrivateKey) []byte {
 
 func ToECDSAFromHex(hexString string) (*ecdsa.PrivateKey, error) {
 	pk := new(ecdsa.PrivateKey)
-	pk.D, _ = new(big.Int).SetString(hexString, 16)
+	d, ok := new(big.Int).SetString(hexString, 16)
+	if !ok || d.Sign() <= 0 || d.Cmp(elliptic.P256().Params().N) >= 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	pk.D = d
 	pk.PublicKey.Curve = elliptic.P256()
 	pk.PublicKey.X, pk.PublicKey.Y = pk.PublicKey.Curve.ScalarBaseMult(pk.D.Bytes())
 	return pk, nil
@@ -5,7 +5,9 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
@@ -23,3 +25,61 @@ func TestFromPrivateKey(t *testing.T) {
 		t.Error("privateKeyToBytes not equal")
 	}
 }
+
+func TestShortKeysAndSignaturesArePadded(t *testing.T) {
+	// About one key in 128 has a coordinate shorter than the curve size
+	var key *ecdsa.PrivateKey
+	for key == nil || (key.X.BitLen() > 248 && key.Y.BitLen() > 248) {
+		key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	wallet, err := (&Wallets{Wallets: map[string]*Wallet{}}).FromPrivateKey(fmt.Sprintf("%x", key.D))
+	assert.NoError(t, err)
+	assert.Len(t, wallet.PublicKey, 64)
+	assert.True(t, ValidateAddress(string(wallet.GetAddress())))
+
+	bc := newTestChain(t, wallet)
+	receiver := NewWallet()
+	short := false
+	for i := 0; i < 2000 && !short; i++ {
+		tx, err := NewUTXOTransaction(wallet, string(receiver.GetAddress()), 10, &UTXOSet{bc})
+		assert.NoError(t, err)
+		signature := tx.Vin[0].Signature
+		assert.Len(t, signature, 64)
+		assert.True(t, bc.VerifyTransaction(tx))
+		short = signature[0] == 0 || signature[32] == 0
+	}
+	assert.True(t, short)
+}
+
+func TestAddressesOfOlderVersionsAreKept(t *testing.T) {
+	// Wallets created by the first release, with their key as saved in the wallet file
+	wallet := func(privateKey, publicKey string) *Wallet {
+		key, err := ToECDSAFromHex(privateKey)
+		assert.NoError(t, err)
+		pubKey, err := hex.DecodeString(publicKey)
+		assert.NoError(t, err)
+		return &Wallet{PrivateKey: *key, PublicKey: pubKey}
+	}
+	plain := wallet("1bbcad29320f20847a515cc854063cda0ddaea20cdcff45eb6b5e0e9ee15fbd4",
+		"4f2715514159a5d8619c1bfa6522a40b964423e2970d70cc4eaa35da6726b269b3ae85bfd85d28060367cad10ffaf7f2e333840f2a782f0453bc75d9054d93c9")
+	assert.Equal(t, "1HPXNAo8QA2cULHsNEhc52n8eeeU1Mg4iB", string(plain.GetAddress()))
+	assert.True(t, ValidateAddress("1HPXNAo8QA2cULHsNEhc52n8eeeU1Mg4iB"))
+
+	// Its Y is shorter than the curve size, the saved key is not padded
+	short := wallet("0a33cbe3498687e6b497e0b0491cd53f3cd6c46a7cacc024c77bcf7bb4cce1a3",
+		"ca6780f35d5696e8b8343a1991dbbdccd9029f0d737e3b6c0fbcadc00671549ea04f246b798a31864e2b4556df36d2ed84d37c50b696f0683f1bbd8ca81cb4")
+	assert.Len(t, short.PublicKey, 63)
+	assert.Equal(t, "1HTqbk4zAKgZ4tUexvHgj8LQ2yunzt7ENH", string(short.GetAddress()))
+	assert.True(t, ValidateAddress("1HTqbk4zAKgZ4tUexvHgj8LQ2yunzt7ENH"))
+	bc := newTestChain(t, short)
+	tx, err := NewUTXOTransaction(short, string(plain.GetAddress()), 10, &UTXOSet{bc})
+	assert.NoError(t, err)
+	assert.True(t, bc.VerifyTransaction(tx))
+
+	// The public key hash starts with a zero byte, the old address never validated
+	zeroHash := wallet("85cde9a4a421ab0fb0fca1263d05c3066d2afd60a375cd3ee7ecdfe838efc4a4",
+		"a592adc17a9ac3e103a79e97ad4573c1dc83eccf3ed7c8b2e09c3d64d9db700c31688b11c85fb4ab8f32eb1f48d097f4f8d74498563e8216d7191a08e4e45436")
+	assert.False(t, ValidateAddress("1woZJ4kNWtuepHrMWRA15jk73bfHiQhP"))
+	assert.Equal(t, "11woZJ4kNWtuepHrMWRA15jk73bfHiQhP", string(zeroHash.GetAddress()))
+	assert.True(t, ValidateAddress(string(zeroHash.GetAddress())))
+}
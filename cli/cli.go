@@ -2,17 +2,22 @@ package cli
 
 import (
 	"blockchaincore/blockchain"
+	"blockchaincore/config"
 	"blockchaincore/p2pserver"
 	"blockchaincore/utils"
 	"blockchaincore/web"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type CLI struct {
@@ -30,28 +35,87 @@ func (cli *CLI) ValidateArgs() bool {
 }
 
 func (cli *CLI) printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("Usage: [-datadir DIR] [-conf FILE] [-network NAME] [-port PORT] COMMAND")
+	fmt.Println("  -datadir DIR holds a directory per network with the chain, the wallets, the peers and the log, " + blockchain.DefaultDataDir + " by default")
+	fmt.Println("  -conf FILE is the YAML config file, DIR/" + config.FileName + " by default, see dumpconfig")
+	fmt.Println("  -network NAME runs on main or regtest, -port PORT is the port of the node")
+	fmt.Println("Commands:")
+	fmt.Println("  createblockchain - Create a blockchain holding the genesis block of the network")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getbalance -address ADDRESS -spv - Get balance of ADDRESS. -spv verifies it from the headers and merkle proofs sent by the central node, without the chain. The central node can hide transactions, it is trusted")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  gettxoutsetinfo - Print the block, the number of outputs, the supply and the hash of the UTXO set")
+	fmt.Println("  dumputxo -file FILE - Write a snapshot of the UTXO set to FILE")
+	fmt.Println("  loadutxo -file FILE -hash HASH - Replace the UTXO set by the snapshot in FILE, -hash is the trusted hash of the snapshot")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine -rbf -spv - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set. -rbf allows to bump the fee later")
+	fmt.Println("    -spv spends the outputs verified by a light client, without the chain")
+	fmt.Println("  bumpfee -txid TXID -fee FEE - Replace the unconfirmed transaction sent with -rbf by one paying FEE")
+	fmt.Println("  cpfp -txid TXID -fee FEE - Spend the wallet outputs of the unconfirmed transaction with a child paying FEE")
+	fmt.Println("  startnode -miner ADDRESS -minerapi ADDR -webport PORT -prune N -encrypt -requireencryption -allowpeers KEYS - Start a node listening on its port. -miner enables mining")
+	fmt.Println("    -minerapi ADDR serves GET /getblocktemplate and POST /submitblock to external miners on ADDR")
+	fmt.Println("    -webport PORT serves the web wallet and explorer from the chain of the node, in the same process")
+	fmt.Println("    -encrypt encrypts the p2p messages, -requireencryption rejects the plaintext ones, -allowpeers only accepts the comma separated peer public keys")
+	fmt.Println("  runweb -port PORT -spv - Start the web wallet, -spv runs it on a light client instead of the chain")
+	fmt.Println("  generate N [ADDRESS] - Mine N blocks right away paying ADDRESS, the first wallet address by default. Regtest only")
+	fmt.Println("  dumpconfig - Print the settings in effect as a config file and check them")
+	fmt.Println("The settings of the config file are overridden by the variables " + strings.Join(config.EnvOverrides(), ", ") + ", then by the flags")
+	fmt.Println("The regtest network has a trivial difficulty, its own genesis and databases. The chain is stored by the bolt, log or memory backend")
+}
+
+// writeCommands open the chain of the node for writing, send does too when it mines
+var writeCommands = map[string]bool{
+	"startnode":        true,
+	"init":             true,
+	"createblockchain": true,
+	"reindexutxo":      true,
+	"loadutxo":         true,
+	"generate":         true,
+	"sync":             true,
+	"clear":            true,
+	"runweb":           true,
 }
 
 func (cli *CLI) Run() {
 	cli.ValidateArgs()
 
-	// Node id is node port
-	nodeID := os.Getenv("NODE_ID")
-
-	if nodeID == "" {
+	globalFlags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	dataDir := globalFlags.String("datadir", blockchain.DefaultDataDir, "Directory of the chain, the wallets, the peers and the log of the node")
+	configFile := globalFlags.String("conf", "", "Config file, "+config.FileName+" in the data directory by default")
+	networkName := globalFlags.String("network", "", "Network to run on: main or regtest")
+	port := globalFlags.String("port", "", "Port of the node, it overrides NODE_ID")
+	utils.HandleError(globalFlags.Parse(os.Args[1:]))
+	args := globalFlags.Args()
+	if len(args) == 0 {
 		cli.printUsage()
-		fmt.Println("NODE_ID is not set!")
 		os.Exit(1)
 	}
+	cfg := cli.loadConfig(globalFlags, *dataDir, *configFile, *networkName, *port)
+	if args[0] == "dumpconfig" {
+		cli.dumpConfig(cfg)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		cli.printUsage()
+		log.Panicln(err)
+	}
+	utils.HandleError(cfg.Apply())
+
+	// Node id is node port
+	nodeID := cfg.P2P.Port
+	// The web server reads the node id from the environment
+	utils.HandleError(os.Setenv("NODE_ID", nodeID))
+	utils.HandleError(blockchain.CreateNetworkDir())
+	log.SetFlags(cfg.Log.Flags())
+	// The wallets and light clients reach the nodes requiring encryption
+	p2pserver.SetWalletTransport(cli.newTransport(nodeID, cfg.P2P.Encrypt, cfg.P2P.RequireEncryption, strings.Join(cfg.P2P.AllowPeers, ",")))
+	if cfg.Log.File {
+		logFile, err := os.OpenFile(blockchain.NetworkFilePath(blockchain.LogFile, nodeID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		utils.HandleError(err)
+		defer logFile.Close()
+		log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -59,82 +123,139 @@ func (cli *CLI) Run() {
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	txOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	cpfpCmd := flag.NewFlagSet("cpfp", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	runWebCmd := flag.NewFlagSet("runweb", flag.ExitOnError)
 	clearBlockChainCmd := flag.NewFlagSet("clear", flag.ExitOnError)
 	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
 
 	// Flags
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	getBalanceSPV := getBalanceCmd.Bool("spv", false, "Verify the balance with a light client")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "File to write the snapshot to")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "File to read the snapshot from")
+	loadUTXOHash := loadUTXOCmd.String("hash", "", "Trusted hash of the snapshot, in hex")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
-	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	sendRBF := sendCmd.Bool("rbf", false, "Allow to replace the transaction by a higher fee one")
+	sendSPV := sendCmd.Bool("spv", false, "Spend the outputs verified by a light client")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "Id of the transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New fee of the transaction")
+	cpfpTxID := cpfpCmd.String("txid", "", "Id of the unconfirmed parent transaction")
+	cpfpFee := cpfpCmd.Int("fee", 0, "Fee of the child transaction")
+	// The defaults of the flags come from the config
+	webPort := ""
+	if cfg.API.Enabled {
+		webPort = cfg.API.Port
+	}
+	startNodeMiner := startNodeCmd.String("miner", cfg.Mining.Address, "Enable mining mode and send reward to ADDRESS")
+	startNodeEncrypt := startNodeCmd.Bool("encrypt", cfg.P2P.Encrypt, "Encrypt the messages sent to the peers")
+	startNodeRequireEncryption := startNodeCmd.Bool("requireencryption", cfg.P2P.RequireEncryption, "Reject the plaintext messages of the peers")
+	startNodeAllowPeers := startNodeCmd.String("allowpeers", strings.Join(cfg.P2P.AllowPeers, ","), "Comma separated public keys of the only peers allowed")
+	startNodeMinerAPI := startNodeCmd.String("minerapi", cfg.Mining.MinerAPI, "Serve getblocktemplate and submitblock to external miners on ADDR")
+	startNodeWebPort := startNodeCmd.String("webport", webPort, "Serve the web wallet and explorer on PORT")
+	startNodePrune := startNodeCmd.Int("prune", cfg.Prune, "Keep the bodies of the last N blocks only, pruning cannot be undone")
 	syncBlockChainCmd := flag.NewFlagSet("sync", flag.ExitOnError)
-	portStartWebServer := runWebCmd.String("port", "8080", "Port to start web server on")
+	portStartWebServer := runWebCmd.String("port", cfg.API.Port, "Port to start web server on")
+	runWebSPV := runWebCmd.Bool("spv", cfg.API.SPV, "Run the wallet on a light client")
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "startnode":
-		err := startNodeCmd.Parse(os.Args[2:])
+		err := startNodeCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "cpfp":
+		err := cpfpCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxoutsetinfo":
+		err := txOutSetInfoCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "sync":
-		err := syncBlockChainCmd.Parse(os.Args[1:])
+		err := syncBlockChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "runweb":
-		err := runWebCmd.Parse(os.Args[2:])
+		err := runWebCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "clear":
-		err := clearBlockChainCmd.Parse(os.Args[2:])
+		err := clearBlockChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "init":
-		err := initCmd.Parse(os.Args[2:])
+		err := initCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
@@ -144,20 +265,31 @@ func (cli *CLI) Run() {
 		os.Exit(1)
 	}
 
+	// The commands writing the chain lock the directory of the network, the others can read it
+	// while a node runs. The files of older versions are only moved under the lock
+	if writeCommands[args[0]] || *sendMine {
+		lock, err := blockchain.LockNetworkDir()
+		utils.HandleError(err)
+		defer lock.Release()
+		utils.HandleError(blockchain.MoveLegacyFiles(nodeID))
+	} else if pending := blockchain.PendingLegacyFiles(nodeID); len(pending) > 0 {
+		log.Printf("%s written by an older version are moved to %s by the commands writing the chain, run init or startnode first\n", strings.Join(pending, ", "), blockchain.NetworkDir())
+	}
+
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		if *getBalanceSPV {
+			cli.getBalanceSPV(*getBalanceAddress, nodeID)
+		} else {
+			cli.getBalance(*getBalanceAddress, nodeID)
+		}
 	}
 
 	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			os.Exit(1)
-		}
-		cli.createBlockchain(*createBlockchainAddress, nodeID)
+		cli.createBlockchain(nodeID)
 	}
 
 	if createWalletCmd.Parsed() {
@@ -176,16 +308,57 @@ func (cli *CLI) Run() {
 		cli.reindexUTXO(nodeID)
 	}
 
+	if txOutSetInfoCmd.Parsed() {
+		cli.txOutSetInfo(nodeID)
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpUTXO(*dumpUTXOFile, nodeID)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadUTXO(*loadUTXOFile, *loadUTXOHash, nodeID)
+	}
+
 	if sendCmd.Parsed() {
 		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		if *sendSPV {
+			cli.sendSPV(*sendFrom, *sendTo, *sendAmount, nodeID)
+		} else {
+			cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine, *sendRBF)
+		}
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+
+	if cpfpCmd.Parsed() {
+		if *cpfpTxID == "" || *cpfpFee <= 0 {
+			cpfpCmd.Usage()
+			os.Exit(1)
+		}
+		cli.childPaysForParent(*cpfpTxID, *cpfpFee, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
-		cli.startNode(nodeID, *startNodeMiner)
+		transport := cli.newTransport(nodeID, *startNodeEncrypt, *startNodeRequireEncryption, *startNodeAllowPeers)
+		cli.startNode(nodeID, *startNodeMiner, *startNodeMinerAPI, *startNodeWebPort, *startNodePrune, transport)
 	}
 	if syncBlockChainCmd.Parsed() {
 		cli.SynBlockChain()
@@ -193,7 +366,7 @@ func (cli *CLI) Run() {
 
 	if runWebCmd.Parsed() {
 		log.Println("Start web")
-		web.StartWebServer(*portStartWebServer)
+		web.StartWebServer(*portStartWebServer, *runWebSPV)
 	}
 
 	if clearBlockChainCmd.Parsed() {
@@ -204,20 +377,74 @@ func (cli *CLI) Run() {
 		cli.InitBlockChain()
 	}
 
+	if generateCmd.Parsed() {
+		count, err := strconv.Atoi(generateCmd.Arg(0))
+		if err != nil || count <= 0 || generateCmd.NArg() > 2 {
+			fmt.Println("Usage: generate N [ADDRESS]")
+			os.Exit(1)
+		}
+		cli.generate(count, generateCmd.Arg(1), nodeID)
+	}
+
+}
+
+// loadConfig reads the config file given by -conf, the one of the data directory by default,
+// then applies the environment variables and the global flags set on the command line
+func (cli *CLI) loadConfig(globalFlags *flag.FlagSet, dataDir, configFile, network, port string) *config.Config {
+	if dir := os.Getenv("DATA_DIR"); dir != "" && !isFlagSet(globalFlags, "datadir") {
+		dataDir = dir
+	}
+	path := configFile
+	if path == "" {
+		path = filepath.Join(dataDir, config.FileName)
+	}
+	cfg, err := config.Load(path, configFile != "")
+	utils.HandleError(err)
+
+	globalFlags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "datadir":
+			cfg.DataDir = dataDir
+		case "network":
+			cfg.Network = network
+		case "port":
+			cfg.P2P.Port = port
+		}
+	})
+	return cfg
+}
+
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// dumpConfig prints the settings in effect as a config file, then checks them
+func (cli *CLI) dumpConfig(cfg *config.Config) {
+	utils.HandleError(cfg.Dump(os.Stdout))
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("#", err)
+		os.Exit(1)
+	}
 }
 
 func (cli *CLI) getBalance(address string, nodeID string) int {
 	if !blockchain.ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := blockchain.NewBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{bc}
-	defer bc.Db.Close()
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	defer bc.Close()
 
 	balance := 0
 	pubKeyHash := utils.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	utils.HandleError(err)
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -228,14 +455,13 @@ func (cli *CLI) getBalance(address string, nodeID string) int {
 }
 
 func (cli *CLI) printChain(nodeID string) {
-	bc := blockchain.NewBlockchain(nodeID)
-	defer bc.Db.Close()
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
 
 	bci := bc.Iterator()
 
-	for {
-		block := bci.Next()
-
+	for block := bci.Next(); block != nil; block = bci.Next() {
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
@@ -245,27 +471,80 @@ func (cli *CLI) printChain(nodeID string) {
 			fmt.Println(tx)
 		}
 		fmt.Printf("\n\n")
+	}
+	utils.HandleError(bci.Err())
+}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+func (cli *CLI) createBlockchain(nodeID string) {
+	bc, err := blockchain.CreateBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+
+	fmt.Printf("Done! Genesis block %x\n", blockchain.ActiveNetwork().GenesisHash)
+}
+
+// generate mines count blocks paying address, the first address of the wallet file by default
+func (cli *CLI) generate(count int, address, nodeID string) {
+	if address == "" {
+		wallets, err := blockchain.NewWallets(nodeID)
+		utils.HandleError(err)
+		addresses := wallets.GetAddresses()
+		if len(addresses) == 0 {
+			log.Panic("ERROR: No address in the wallet file, create a wallet or pass an address")
 		}
+		address = addresses[0]
 	}
+
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+
+	blocks, err := bc.Generate(count, address)
+	for _, block := range blocks {
+		fmt.Printf("%x\n", block.Hash)
+	}
+	utils.HandleError(err)
 }
 
-func (cli *CLI) createBlockchain(address string, nodeID string) {
-	if !blockchain.ValidateAddress(address) {
-		log.Panic("ERROR: Address is not valid")
+// getBalanceSPV syncs a light client watching the address and prints its verified balance
+func (cli *CLI) getBalanceSPV(address string, nodeID string) int {
+	lc, err := p2pserver.OpenLightClient(nodeID)
+	utils.HandleError(err)
+	defer lc.Close()
+
+	utils.HandleError(lc.Watch(address))
+	utils.HandleError(lc.Sync())
+	balance, err := lc.Balance(address)
+	utils.HandleError(err)
+
+	fmt.Printf("Balance of '%s': %d (verified up to block %d)\n", address, balance, lc.Height())
+	return balance
+}
+
+// sendSPV spends the outputs of the sender verified by a light client
+func (cli *CLI) sendSPV(from, to string, amount int, nodeID string) {
+	wallets, err := blockchain.NewWallets(nodeID)
+	utils.HandleError(err)
+	wallet := wallets.GetWallet(from)
+	if wallet == nil {
+		log.Println("ERROR: Sender address is not found in wallet file")
+		return
 	}
-	bc := blockchain.CreateBlockchain(address, nodeID)
-	defer bc.Db.Close()
 
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	lc, err := p2pserver.OpenLightClient(nodeID)
+	utils.HandleError(err)
+	defer lc.Close()
 
-	fmt.Println("Done!")
+	utils.HandleError(lc.Watch(from))
+	utils.HandleError(lc.Sync())
+	tx, err := lc.NewTransaction(wallet, to, amount)
+	utils.HandleError(err)
+	cli.broadcast(tx, nodeID)
+
+	log.Println("Success!")
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow, replaceable bool) {
 	if !blockchain.ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -273,9 +552,10 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
 
-	bc := blockchain.NewBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{bc}
-	defer bc.Db.Close()
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	defer bc.Close()
 
 	wallets, err := blockchain.NewWallets(nodeID)
 	utils.HandleError(err)
@@ -286,40 +566,183 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		return
 	}
 
-	tx := blockchain.NewUTXOTransaction(wallet, to, amount, &UTXOSet)
+	var tx *blockchain.Transaction
+	if replaceable {
+		tx, err = blockchain.NewReplaceableUTXOTransaction(wallet, to, amount, &UTXOSet)
+	} else {
+		tx, err = blockchain.NewUTXOTransaction(wallet, to, amount, &UTXOSet)
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		return
+	}
 
 	if mineNow {
 		cbTx := blockchain.NewCoinbaseTX(from, "", 0)
 		txs := []*blockchain.Transaction{cbTx, tx}
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err := bc.MineBlock(txs)
+		utils.HandleError(err)
 	} else {
-		log.Println("Sending tx to the network...")
-		p2pserver.SendTx(p2pserver.CentralNode, tx)
-		log.Println("Sent tx to transaction pools")
+		cli.broadcast(tx, nodeID)
 	}
 
 	log.Println("Success!")
 
 }
 
+// broadcast sends the transaction to the network and records it, so its fee can be bumped later
+func (cli *CLI) broadcast(tx *blockchain.Transaction, nodeID string) {
+	sent, err := blockchain.LoadSentTransactions(nodeID)
+	utils.HandleError(err)
+	sent.Add(tx)
+	utils.HandleError(sent.SaveToFile(nodeID))
+
+	log.Println("Sending tx to the network...")
+	p2pserver.SendTx(p2pserver.ActiveNodeConfig().CentralNode, tx)
+	log.Printf("Sent tx %x to transaction pools\n", tx.ID)
+}
+
+// findSentTransaction returns a transaction sent from this node and the wallet which sent it
+func (cli *CLI) findSentTransaction(txID, nodeID string) (*blockchain.Transaction, *blockchain.Wallet) {
+	sent, err := blockchain.LoadSentTransactions(nodeID)
+	utils.HandleError(err)
+	tx, ok := sent.Get(txID)
+	if !ok {
+		log.Println("ERROR: Transaction was not sent from this node")
+		return nil, nil
+	}
+
+	wallets, err := blockchain.NewWallets(nodeID)
+	utils.HandleError(err)
+	wallet := wallets.GetWallet(tx.FromAddress)
+	if wallet == nil {
+		log.Println("ERROR: Sender address is not found in wallet file")
+		return nil, nil
+	}
+	return tx, wallet
+}
+
+func (cli *CLI) bumpFee(txID string, fee int, nodeID string) {
+	original, wallet := cli.findSentTransaction(txID, nodeID)
+	if original == nil {
+		return
+	}
+
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	tx, err := blockchain.NewFeeBumpTransaction(wallet, original, fee, bc)
+	bc.Close()
+	if err != nil {
+		log.Println("ERROR:", err)
+		return
+	}
+	cli.broadcast(tx, nodeID)
+}
+
+func (cli *CLI) childPaysForParent(txID string, fee int, nodeID string) {
+	parent, _ := cli.findSentTransaction(txID, nodeID)
+	if parent == nil {
+		return
+	}
+
+	// The child is paid to the wallet receiving the outputs, the sender for the change
+	wallets, err := blockchain.NewWallets(nodeID)
+	utils.HandleError(err)
+	for _, address := range []string{parent.ToAddress, parent.FromAddress} {
+		wallet := wallets.GetWallet(address)
+		if wallet == nil {
+			continue
+		}
+		tx, err := blockchain.NewChildPaysForParentTransaction(wallet, parent, fee)
+		if err != nil {
+			log.Println("ERROR:", err)
+			return
+		}
+		cli.broadcast(tx, nodeID)
+		return
+	}
+	log.Println("ERROR: No wallet of this node receives an output of the transaction")
+}
+
 func (cli *CLI) createWallet(nodeID string) {
 	wallets, _ := blockchain.NewWallets(nodeID)
 	address, pri, pub := wallets.CreateWallet()
-	wallets.SaveToFile(nodeID)
+	utils.HandleError(wallets.SaveToFile(nodeID))
 
 	log.Printf("Your new wallet:\n address: %s\nprivate key: %s, public key: %s", address, pri, pub)
 }
 
 func (cli *CLI) reindexUTXO(nodeID string) {
-	bc := blockchain.NewBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	utils.HandleError(UTXOSet.Reindex())
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	utils.HandleError(err)
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CLI) txOutSetInfo(nodeID string) {
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+
+	info, err := blockchain.UTXOSet{Blockchain: bc}.Info()
+	utils.HandleError(err)
+	printUTXOSetInfo(info)
+}
+
+func (cli *CLI) dumpUTXO(file, nodeID string) {
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+
+	f, err := os.Create(file)
+	utils.HandleError(err)
+	defer f.Close()
+	info, err := blockchain.UTXOSet{Blockchain: bc}.Dump(f)
+	utils.HandleError(err)
+	utils.HandleError(f.Sync())
+	printUTXOSetInfo(info)
+}
+
+func (cli *CLI) loadUTXO(file, trustedHash, nodeID string) {
+	var trusted []byte
+	if trustedHash != "" {
+		var err error
+		trusted, err = hex.DecodeString(trustedHash)
+		utils.HandleError(err)
+	}
+	bc, err := blockchain.NewBlockchain(nodeID)
+	utils.HandleError(err)
+	defer bc.Close()
+
+	f, err := os.Open(file)
+	utils.HandleError(err)
+	defer f.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	info, err := UTXOSet.Load(f, trusted)
+	utils.HandleError(err)
+	printUTXOSetInfo(info)
+
+	// The blocks mined after the snapshot are applied on top of it
+	utils.HandleError(UTXOSet.CatchUp())
+	info, err = UTXOSet.Info()
+	utils.HandleError(err)
+	fmt.Printf("The UTXO set is at height %d\n", info.Height)
+}
+
+func printUTXOSetInfo(info *blockchain.UTXOSetInfo) {
+	fmt.Printf("Block:        %x\n", info.BlockHash)
+	fmt.Printf("Height:       %d\n", info.Height)
+	fmt.Printf("Transactions: %d\n", info.Transactions)
+	fmt.Printf("Outputs:      %d\n", info.Outputs)
+	fmt.Printf("Total amount: %d\n", info.TotalAmount)
+	fmt.Printf("Hash:         %x\n", info.Hash)
+}
+
 func (cli *CLI) listAddresses(nodeID string) {
 	wallet, err := blockchain.NewWallets(nodeID)
 	if err != nil {
@@ -332,7 +755,27 @@ func (cli *CLI) listAddresses(nodeID string) {
 	}
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+// newTransport builds the p2p transport of the node, the identity key is only loaded when encryption is on
+func (cli *CLI) newTransport(nodeID string, encrypt, requireEncryption bool, allowPeers string) *p2pserver.Transport {
+	// An allow-list is pointless if plaintext peers are accepted
+	transport := &p2pserver.Transport{RequireEncryption: requireEncryption || allowPeers != ""}
+	if !encrypt && !requireEncryption && allowPeers == "" {
+		return transport
+	}
+
+	identity, err := p2pserver.LoadOrCreateIdentity(nodeID)
+	utils.HandleError(err)
+	transport.Identity = identity
+
+	for _, key := range strings.Split(allowPeers, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			utils.HandleError(transport.AllowPeer(key))
+		}
+	}
+	return transport
+}
+
+func (cli *CLI) startNode(nodeID, minerAddress, minerAPIAddr, webPort string, prune int, transport *p2pserver.Transport) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if blockchain.ValidateAddress(minerAddress) {
@@ -341,7 +784,29 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	p2pserver.StartServer(nodeID, minerAddress)
+
+	// The p2p server and the web server share the chain opened once by the node
+	node, err := p2pserver.OpenNode(nodeID, minerAddress)
+	utils.HandleError(err)
+	defer node.Blockchain().Close()
+	go p2pserver.HandleClose(node.Blockchain())
+	node.SetTransport(transport)
+	p2pserver.SetWalletTransport(transport)
+	if transport.Identity != nil {
+		fmt.Println("Node public key: ", transport.Identity.PublicKeyHex())
+	}
+	if prune > 0 {
+		utils.HandleError(node.Blockchain().EnablePruning(prune))
+		fmt.Printf("Pruning is on, the bodies of the last %d blocks are kept\n", prune)
+	}
+	if webPort != "" {
+		go func() {
+			log.Println("Web server stopped:", web.StartNodeWebServer(webPort, node))
+		}()
+	}
+	if err := node.Run(minerAPIAddr); err != nil {
+		log.Panic(err)
+	}
 }
 
 func (cli *CLI) SynBlockChain() {
@@ -355,7 +820,7 @@ func (cli *CLI) SynBlockChain() {
 		log.Panic(err)
 	}
 	defer ln.Close()
-	p2pserver.GetBlockFromCentralNode(ln)
+	utils.HandleError(p2pserver.SyncFromCentralNode(ln))
 }
 
 func (cli *CLI) ClearBlockChain() {
@@ -363,12 +828,12 @@ func (cli *CLI) ClearBlockChain() {
 	if nodeID == "" {
 		log.Panic("NODE_ID not set")
 	}
-	err := os.Remove(fmt.Sprintf(blockchain.DbFile, nodeID))
+	err := os.Remove(blockchain.DbFilePath(nodeID))
 	if err != nil {
 		log.Panic(err)
 	}
 	log.Println("Blockchain is cleared")
-	err = os.Remove(fmt.Sprintf(blockchain.WalletFile, nodeID))
+	err = os.Remove(blockchain.NetworkFilePath(blockchain.WalletFile, nodeID))
 	if err != nil {
 		log.Panic(err)
 		return
@@ -380,34 +845,32 @@ func (cli *CLI) InitBlockChain() {
 	nodeID := os.Getenv("NODE_ID")
 	wallets, _ := blockchain.NewWallets(nodeID)
 	address, pri, pub := wallets.CreateWallet()
-	wallets.SaveToFile(nodeID)
+	utils.HandleError(wallets.SaveToFile(nodeID))
 
-	cli.createBlockchain(address, nodeID)
-	balance := cli.getBalance(address, nodeID)
-	log.Printf("Your \nNew address: %s\n pubKey: %s\n, priKey: %s\n and be reward %d",
-		address, pub, pri, balance)
+	cli.createBlockchain(nodeID)
+	log.Printf("Your \nNew address: %s\n pubKey: %s\n, priKey: %s\n",
+		address, pub, pri)
 
-	data, _ := json.Marshal(utils.WalletData{
-		Address:    address,
-		PrivateKey: pri,
-		PublicKey:  pub,
-	})
-	ioutil.WriteFile("wallet1.json", data, 0644)
+	writeWalletFile("wallet1.json", address, pri, pub)
 
 	address, pri, pub = wallets.CreateWallet()
-
-	data, _ = json.Marshal(utils.WalletData{
-		Address:    address,
-		PrivateKey: pri,
-		PublicKey:  pub,
-	})
-	ioutil.WriteFile("wallet2.json", data, 0644)
+	writeWalletFile("wallet2.json", address, pri, pub)
 	address, pri, pub = wallets.CreateWallet()
-	data, _ = json.Marshal(utils.WalletData{
+	writeWalletFile("wallet3.json", address, pri, pub)
+}
+
+// writeWalletFile writes the keys of a wallet to name in the directory of the network, only
+// the user running the node can read it
+func writeWalletFile(name, address, pri, pub string) {
+	data, err := json.Marshal(utils.WalletData{
 		Address:    address,
 		PrivateKey: pri,
 		PublicKey:  pub,
 	})
-	ioutil.WriteFile("wallet3.json", data, 0644)
-
+	utils.HandleError(err)
+	path := filepath.Join(blockchain.NetworkDir(), name)
+	utils.HandleError(ioutil.WriteFile(path, data, 0600))
+	// A file left by an earlier init keeps its mode when it is rewritten
+	utils.HandleError(os.Chmod(path, 0600))
+	log.Printf("Wallet keys written to %s\n", path)
 }
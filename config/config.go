@@ -0,0 +1,311 @@
+package config
+
+import (
+	"blockchaincore/blockchain"
+	"blockchaincore/p2pserver"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// FileName is the config file of a node, at the root of its data directory
+const FileName = "config.yaml"
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Config holds every setting of a node. The defaults are overridden by the config file, then by
+// the environment variables, then by the command line flags
+type Config struct {
+	// DataDir holds a directory per network, with the chain, the wallets, the peers and the log
+	DataDir string `yaml:"datadir"`
+	Network string `yaml:"network"`
+	// Store is the storage backend of the chain: bolt, log or memory
+	Store string `yaml:"store"`
+	// Prune keeps the bodies of the last Prune blocks only, 0 keeps every block
+	Prune   int     `yaml:"prune"`
+	P2P     P2P     `yaml:"p2p"`
+	Mining  Mining  `yaml:"mining"`
+	Mempool Mempool `yaml:"mempool"`
+	API     API     `yaml:"api"`
+	Log     Log     `yaml:"log"`
+}
+
+type P2P struct {
+	// Port is the port the node listens on, it also names the files of the node
+	Port        string   `yaml:"port"`
+	CentralNode string   `yaml:"centralnode"`
+	Peers       []string `yaml:"peers"`
+	Encrypt     bool     `yaml:"encrypt"`
+	// RequireEncryption rejects the plaintext messages of the peers
+	RequireEncryption bool `yaml:"requireencryption"`
+	// AllowPeers are the hex public keys of the only peers allowed, when set
+	AllowPeers []string `yaml:"allowpeers"`
+}
+
+type Mining struct {
+	// Address receives the rewards of the blocks, mining is off when it is empty
+	Address string `yaml:"address"`
+	// MinTxs is the number of pool transactions waited for before mining a block
+	MinTxs int `yaml:"mintxs"`
+	// MinerAPI serves block templates to external miners on this address, when set
+	MinerAPI string `yaml:"minerapi"`
+}
+
+type Mempool struct {
+	MaxCount int           `yaml:"maxcount"`
+	MaxSize  int           `yaml:"maxsize"`
+	Expiry   time.Duration `yaml:"expiry"`
+}
+
+type API struct {
+	// Enabled serves the web wallet and explorer from the chain of a running node
+	Enabled bool   `yaml:"enabled"`
+	Port    string `yaml:"port"`
+	// SPV runs the standalone web wallet on a light client
+	SPV bool `yaml:"spv"`
+}
+
+type Log struct {
+	// File copies the log to a file in the directory of the network
+	File bool `yaml:"file"`
+	// Timestamps prefixes the lines with the date and the time
+	Timestamps bool `yaml:"timestamps"`
+	// SourceLines prefixes the lines with the file and the line logging them
+	SourceLines bool `yaml:"sourcelines"`
+}
+
+// Flags returns the flags of the standard logger for the settings, no prefix at all when
+// both are off
+func (l Log) Flags() int {
+	flags := 0
+	if l.Timestamps {
+		flags |= log.LstdFlags
+	}
+	if l.SourceLines {
+		flags |= log.Lshortfile
+	}
+	return flags
+}
+
+// Default returns the settings of a node without config file, the port has no default
+func Default() *Config {
+	return &Config{
+		DataDir: blockchain.DefaultDataDir,
+		Network: blockchain.MainNet.Name,
+		Store:   blockchain.BoltBackend,
+		P2P: P2P{
+			CentralNode: p2pserver.DefaultCentralNode,
+		},
+		Mining: Mining{
+			MinTxs: p2pserver.DefaultNodeConfig.MineTxCount,
+		},
+		Mempool: Mempool{
+			MaxCount: blockchain.DefaultMempoolConfig.MaxCount,
+			MaxSize:  blockchain.DefaultMempoolConfig.MaxSize,
+			Expiry:   blockchain.DefaultMempoolConfig.Expiry,
+		},
+		API: API{
+			Port: "8080",
+		},
+		Log: Log{
+			File: true,
+		},
+	}
+}
+
+// envOverrides are the environment variables overriding the settings of the file
+var envOverrides = []struct {
+	name string
+	set  func(c *Config, value string)
+}{
+	{"DATA_DIR", func(c *Config, v string) { c.DataDir = v }},
+	{"NETWORK", func(c *Config, v string) { c.Network = v }},
+	{"CHAIN_STORE", func(c *Config, v string) { c.Store = v }},
+	{"NODE_ID", func(c *Config, v string) { c.P2P.Port = v }},
+	{"CENTRAL_NODE", func(c *Config, v string) { c.P2P.CentralNode = v }},
+	{"MINER_ADDRESS", func(c *Config, v string) { c.Mining.Address = v }},
+	{"WEB_PORT", func(c *Config, v string) { c.API.Port = v }},
+}
+
+// Load reads the config file at path over the defaults, then applies the environment variables.
+// A missing file is ignored unless it is required
+func Load(path string, required bool) (*Config, error) {
+	c := Default()
+	content, err := ioutil.ReadFile(path)
+	if err != nil && (required || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	if err == nil {
+		if err := c.decode(bytes.NewReader(content)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+		}
+	}
+	c.applyEnv()
+	return c, nil
+}
+
+// decode reads the YAML settings over c, an unknown setting is an error
+func (c *Config) decode(r io.Reader) error {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() {
+	for _, env := range envOverrides {
+		if value := os.Getenv(env.name); value != "" {
+			env.set(c, value)
+		}
+	}
+}
+
+// EnvOverrides returns the names of the environment variables overriding the config file
+func EnvOverrides() []string {
+	var names []string
+	for _, env := range envOverrides {
+		names = append(names, env.name)
+	}
+	return names
+}
+
+// Validate checks every setting, the error names the first invalid one
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return invalid("datadir", "must be set")
+	}
+	network, err := blockchain.NetworkByName(c.Network)
+	if err != nil {
+		return invalid("network", err.Error())
+	}
+	switch c.Store {
+	case blockchain.BoltBackend, blockchain.LogBackend, blockchain.MemoryBackend:
+	default:
+		return invalid("store", "unknown backend "+strconv.Quote(c.Store))
+	}
+	if c.Prune != 0 && c.Prune < network.MinPruneDepth {
+		return invalid("prune", fmt.Sprintf("must be 0 or at least %d on %s", network.MinPruneDepth, network.Name))
+	}
+
+	if c.P2P.Port == "" {
+		return invalid("p2p.port", "must be set, or NODE_ID")
+	}
+	if err := validatePort(c.P2P.Port); err != nil {
+		return invalid("p2p.port", err.Error())
+	}
+	if err := validateAddr(c.P2P.CentralNode); err != nil {
+		return invalid("p2p.centralnode", err.Error())
+	}
+	for _, peer := range c.P2P.Peers {
+		if err := validateAddr(peer); err != nil {
+			return invalid("p2p.peers", err.Error())
+		}
+	}
+	for _, key := range c.P2P.AllowPeers {
+		if decoded, err := hex.DecodeString(key); err != nil || len(decoded) != 32 {
+			return invalid("p2p.allowpeers", "not a hex public key: "+key)
+		}
+	}
+
+	if c.Mining.Address != "" && !blockchain.ValidateAddress(c.Mining.Address) {
+		return invalid("mining.address", "not a valid address")
+	}
+	if c.Mining.MinTxs < 1 {
+		return invalid("mining.mintxs", "must be at least 1")
+	}
+	if c.Mining.MinerAPI != "" {
+		if err := validateAddr(c.Mining.MinerAPI); err != nil {
+			return invalid("mining.minerapi", err.Error())
+		}
+	}
+
+	if c.Mempool.MaxCount < 1 {
+		return invalid("mempool.maxcount", "must be at least 1")
+	}
+	if c.Mempool.MaxSize < 1 {
+		return invalid("mempool.maxsize", "must be at least 1")
+	}
+	if c.Mempool.Expiry <= 0 {
+		return invalid("mempool.expiry", "must be positive")
+	}
+
+	if err := validatePort(c.API.Port); err != nil {
+		return invalid("api.port", err.Error())
+	}
+	if c.API.Enabled && c.API.Port == c.P2P.Port {
+		return invalid("api.port", "is the p2p port")
+	}
+	return nil
+}
+
+func invalid(setting, reason string) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidConfig, setting, reason)
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validateAddr checks a host:port address, the host can be empty to listen on every interface
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return validatePort(port)
+}
+
+// Dump writes the settings as a config file
+func (c *Config) Dump(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// NodeConfig returns the settings of the p2p nodes
+func (c *Config) NodeConfig() p2pserver.NodeConfig {
+	return p2pserver.NodeConfig{
+		CentralNode: c.P2P.CentralNode,
+		Peers:       c.P2P.Peers,
+		MineTxCount: c.Mining.MinTxs,
+		Mempool: blockchain.MempoolConfig{
+			MaxCount: c.Mempool.MaxCount,
+			MaxSize:  c.Mempool.MaxSize,
+			Expiry:   c.Mempool.Expiry,
+		},
+	}
+}
+
+// Apply selects the data directory, the network, the store backend and the node settings of
+// the process, the config must be valid
+func (c *Config) Apply() error {
+	network, err := blockchain.NetworkByName(c.Network)
+	if err != nil {
+		return err
+	}
+	if err := blockchain.SetStoreBackend(c.Store); err != nil {
+		return err
+	}
+	blockchain.SetDataDir(c.DataDir)
+	blockchain.SetNetwork(network)
+	p2pserver.SetNodeConfig(c.NodeConfig())
+	return nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	content := "network: regtest\np2p:\n  port: \"3001\"\n  peers: [\"localhost:3002\"]\nmempool:\n  expiry: 1h\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	t.Setenv("NODE_ID", "3005")
+
+	c, err := Load(path, true)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, "regtest", c.Network)
+	assert.Equal(t, "3005", c.P2P.Port)
+	assert.Equal(t, []string{"localhost:3002"}, c.P2P.Peers)
+	assert.Equal(t, time.Hour, c.Mempool.Expiry)
+	assert.Equal(t, Default().Mempool.MaxCount, c.Mempool.MaxCount)
+	assert.Equal(t, c.Mempool.Expiry, c.NodeConfig().Mempool.Expiry)
+
+	// The dump is a config file giving the same settings
+	var dump, redump bytes.Buffer
+	assert.NoError(t, c.Dump(&dump))
+	again := Default()
+	assert.NoError(t, again.decode(bytes.NewReader(dump.Bytes())))
+	assert.NoError(t, again.Dump(&redump))
+	assert.Equal(t, dump.String(), redump.String())
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"), true)
+	assert.Error(t, err)
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("p2p:\n  prot: 3001\n"), 0600))
+	_, err = Load(path, true)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestValidateNamesTheInvalidSetting(t *testing.T) {
+	invalid := map[string]func(c *Config){
+		"network":          func(c *Config) { c.Network = "test" },
+		"store":            func(c *Config) { c.Store = "sql" },
+		"prune":            func(c *Config) { c.Prune = 10 },
+		"p2p.port":         func(c *Config) { c.P2P.Port = "70000" },
+		"p2p.centralnode":  func(c *Config) { c.P2P.CentralNode = "localhost" },
+		"p2p.allowpeers":   func(c *Config) { c.P2P.AllowPeers = []string{"abcd"} },
+		"mining.address":   func(c *Config) { c.Mining.Address = "1abc" },
+		"mining.mintxs":    func(c *Config) { c.Mining.MinTxs = 0 },
+		"mempool.maxsize":  func(c *Config) { c.Mempool.MaxSize = 0 },
+		"mempool.expiry":   func(c *Config) { c.Mempool.Expiry = 0 },
+		"api.port":         func(c *Config) { c.API.Enabled, c.API.Port = true, "3000" },
+		"mining.minerapi":  func(c *Config) { c.Mining.MinerAPI = ":x" },
+		"mempool.maxcount": func(c *Config) { c.Mempool.MaxCount = -1 },
+	}
+	for setting, change := range invalid {
+		c := Default()
+		c.P2P.Port = "3000"
+		assert.NoError(t, c.Validate())
+		change(c)
+		err := c.Validate()
+		assert.ErrorIs(t, err, ErrInvalidConfig, setting)
+		assert.Contains(t, err.Error(), setting+" ", setting)
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	assert.Equal(t, 0, Log{}.Flags())
+	assert.Equal(t, log.LstdFlags, Log{Timestamps: true}.Flags())
+	assert.Equal(t, log.Lshortfile, Log{SourceLines: true}.Flags())
+	assert.Equal(t, log.LstdFlags|log.Lshortfile, Log{Timestamps: true, SourceLines: true}.Flags())
+}
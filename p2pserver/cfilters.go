@@ -0,0 +1,33 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"log"
+)
+
+///////////////////////////////////////////
+//SEND BLOCK FILTERS
+///////////////////////////////////////////
+
+func (n *Node) ReceiveGetCFilters(data []byte) {
+	var payload GetCFilters
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveGetCFilters: dropped invalid message:", err)
+		return
+	}
+
+	var filters []CFilter
+	for _, header := range n.bc.GetHeadersAfter(payload.LastHash, blockchain.MaxFiltersPerMessage) {
+		hash := header.BlockHash()
+		filter, err := n.bc.GetBlockFilter(hash)
+		if err != nil {
+			log.Printf("Cannot read the filter of block %x: %v\n", hash, err)
+			return
+		}
+		filters = append(filters, CFilter{hash, filter.Serialize()})
+	}
+	response := GobEncode(CFilters{n.address, filters})
+	request := append(sendCFiltersCmdSerial, response...)
+	n.SendData(payload.AddrFrom, request)
+}
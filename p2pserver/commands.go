@@ -9,13 +9,24 @@ const tx = "tx"
 const version = "version"
 const getBlocks = "getblocks"
 const getData = "getdata"
-const getBlockchain = "getbc"
-const receiveBlock = "recv_bc"
 
 const getAddr = "getaddr"
 
 const deleteTxPool = "del_tx_pool"
 
+const compactBlock = "cmpctblock"
+const getBlockTxn = "getblocktxn"
+const blockTxn = "blocktxn"
+
+const getHeaders = "getheaders"
+const headers = "headers"
+
+const getProofs = "getproofs"
+const proofs = "proofs"
+
+const getCFilters = "getcfilters"
+const cFilters = "cfilters"
+
 type Command struct {
 	Command string
 }
@@ -64,14 +75,35 @@ var getBlocksCmdSerial = getBlocksCmd.Bytes()
 var getDataCmd = NewCommand(getData)
 var getDataCmdSerial = getDataCmd.Bytes()
 
-var getBlockChainCmd = NewCommand(getBlockchain)
-var getBlockChainCmdSerial = getBlockChainCmd.Bytes()
-
-var receiveBlockChainCmd = NewCommand(receiveBlock)
-var receiveBlockChainCmdSerial = receiveBlockChainCmd.Bytes()
-
 var getAddresses = NewCommand(getAddr)
 var getAddressesSerial = getAddresses.Bytes()
 
 var deleteTxPoolCmd = NewCommand(deleteTxPool)
 var deleteTxPoolCmdSerial = deleteTxPoolCmd.Bytes()
+
+var sendCompactBlockCmd = NewCommand(compactBlock)
+var sendCompactBlockCmdSerial = sendCompactBlockCmd.Bytes()
+
+var getBlockTxnCmd = NewCommand(getBlockTxn)
+var getBlockTxnCmdSerial = getBlockTxnCmd.Bytes()
+
+var sendBlockTxnCmd = NewCommand(blockTxn)
+var sendBlockTxnCmdSerial = sendBlockTxnCmd.Bytes()
+
+var getHeadersCmd = NewCommand(getHeaders)
+var getHeadersCmdSerial = getHeadersCmd.Bytes()
+
+var sendHeadersCmd = NewCommand(headers)
+var sendHeadersCmdSerial = sendHeadersCmd.Bytes()
+
+var getProofsCmd = NewCommand(getProofs)
+var getProofsCmdSerial = getProofsCmd.Bytes()
+
+var sendProofsCmd = NewCommand(proofs)
+var sendProofsCmdSerial = sendProofsCmd.Bytes()
+
+var getCFiltersCmd = NewCommand(getCFilters)
+var getCFiltersCmdSerial = getCFiltersCmd.Bytes()
+
+var sendCFiltersCmd = NewCommand(cFilters)
+var sendCFiltersCmdSerial = sendCFiltersCmd.Bytes()
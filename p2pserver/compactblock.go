@@ -0,0 +1,268 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+const shortIDLength = 6
+
+const (
+	// maxPendingBlocks bounds the compact blocks waiting for their missing transactions
+	maxPendingBlocks = 16
+	// pendingBlockExpiry drops a compact block whose missing transactions never came
+	pendingBlockExpiry = time.Minute
+)
+
+// pendingCompactBlock is a compact block waiting for the transactions missing from the mempool
+type pendingCompactBlock struct {
+	cb      CompactBlock
+	txs     []*blockchain.Transaction
+	missing []int
+	// peer was asked for the missing transactions, only its answer is accepted
+	peer  string
+	asked time.Time
+}
+
+func pendingBlockKey(peer string, blockHash []byte) string {
+	return peer + "/" + hex.EncodeToString(blockHash)
+}
+
+// addPendingBlock keeps the block until its peer answers, the expired blocks are dropped
+// and the oldest one is evicted when maxPendingBlocks are already waiting
+func (n *Node) addPendingBlock(pending *pendingCompactBlock) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	oldest := ""
+	for key, p := range n.pendingBlocks {
+		if pending.asked.Sub(p.asked) > pendingBlockExpiry {
+			delete(n.pendingBlocks, key)
+			continue
+		}
+		if oldest == "" || p.asked.Before(n.pendingBlocks[oldest].asked) {
+			oldest = key
+		}
+	}
+	if len(n.pendingBlocks) >= maxPendingBlocks {
+		delete(n.pendingBlocks, oldest)
+	}
+	n.pendingBlocks[pendingBlockKey(pending.peer, pending.cb.Hash)] = pending
+}
+
+// takePendingBlock removes the block waiting for the answer of peer, nil when peer was
+// not asked for the transactions of the block or answers too late
+func (n *Node) takePendingBlock(peer string, blockHash []byte) *pendingCompactBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := pendingBlockKey(peer, blockHash)
+	pending := n.pendingBlocks[key]
+	if pending == nil {
+		return nil
+	}
+	delete(n.pendingBlocks, key)
+	if time.Since(pending.asked) > pendingBlockExpiry {
+		return nil
+	}
+	return pending
+}
+
+// shortTxID shortens the transaction id, it is salted with the block hash
+// so that colliding transactions cannot be crafted in advance
+func shortTxID(blockHash, txID []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, blockHash...), txID...))
+	return hash[:shortIDLength]
+}
+
+func newCompactBlock(addrFrom string, b *blockchain.Block) CompactBlock {
+	cb := CompactBlock{
+		AddrFrom: addrFrom,
+		Header:   b.BlockHeader.Serialize(),
+		Hash:     b.Hash,
+		Height:   b.Height,
+		ShortIDs: make([][]byte, len(b.Transactions)),
+	}
+	for i, tx := range b.Transactions {
+		// The coinbase is never in the peer mempool
+		if tx.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, PrefilledTx{i, tx.Serialize()})
+			continue
+		}
+		cb.ShortIDs[i] = shortTxID(b.Hash, tx.ID)
+	}
+	return cb
+}
+
+///////////////////////////////////////////
+//SEND COMPACT BLOCK AND HANDLE RECEIVE COMPACT BLOCK
+///////////////////////////////////////////
+
+// SendCompactBlock announces a freshly mined block, the peer rebuilds it from its mempool
+func (n *Node) SendCompactBlock(addr string, b *blockchain.Block) {
+	payload := GobEncode(newCompactBlock(n.address, b))
+	request := append(sendCompactBlockCmdSerial, payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) ReceiveCompactBlock(data []byte) {
+	var payload CompactBlock
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveCompactBlock: dropped invalid message:", err)
+		return
+	}
+	fmt.Printf("Received compact block %x with %d transactions\n", payload.Hash, len(payload.ShortIDs))
+
+	if _, _, err := n.bc.GetBlockHeader(payload.Hash); err == nil {
+		return
+	}
+	header, err := blockchain.DeserializeBlockHeader(payload.Header)
+	if err != nil {
+		log.Printf("Compact block %x has a wrong header\n", payload.Hash)
+		return
+	}
+	if _, _, err := n.bc.GetBlockHeader(header.PrevBlockHash); err != nil && len(header.PrevBlockHash) > 0 {
+		// We are behind, download the headers then the missing blocks
+		n.syncHeaders(payload.AddrFrom)
+		return
+	}
+
+	txs := make([]*blockchain.Transaction, len(payload.ShortIDs))
+	for _, prefilled := range payload.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= len(txs) {
+			log.Printf("Compact block %x has a wrong prefilled index\n", payload.Hash)
+			return
+		}
+		tx, err := blockchain.DeserializeTransaction(prefilled.Tx)
+		if err != nil {
+			log.Printf("Compact block %x has an invalid prefilled transaction: %v\n", payload.Hash, err)
+			return
+		}
+		txs[prefilled.Index] = &tx
+	}
+
+	memPool := make(map[string]*blockchain.Transaction)
+	for _, tx := range n.memPool.Transactions() {
+		memPool[string(shortTxID(payload.Hash, tx.ID))] = tx
+	}
+
+	var missing []int
+	for i, shortID := range payload.ShortIDs {
+		if txs[i] != nil {
+			continue
+		}
+		if tx, ok := memPool[string(shortID)]; ok {
+			txs[i] = tx
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		n.connectCompactBlock(payload, txs)
+		return
+	}
+
+	log.Printf("Requesting %d missing transactions of block %x\n", len(missing), payload.Hash)
+	n.addPendingBlock(&pendingCompactBlock{payload, txs, missing, payload.AddrFrom, time.Now()})
+	n.SendGetBlockTxn(payload.AddrFrom, payload.Hash, missing)
+}
+
+// connectCompactBlock adds the rebuilt block to the chain, the full block is requested
+// when the rebuilt one is not valid, for example because of a short id collision
+func (n *Node) connectCompactBlock(cb CompactBlock, txs []*blockchain.Transaction) {
+	header, err := blockchain.DeserializeBlockHeader(cb.Header)
+	if err != nil {
+		return
+	}
+	block := &blockchain.Block{
+		BlockHeader:  *header,
+		Transactions: txs,
+		Hash:         cb.Hash,
+		Height:       cb.Height,
+	}
+
+	if err := n.bc.ValidateBlock(block); err != nil {
+		log.Printf("Rebuilt block %x is not valid: %v, requesting the full block\n", block.Hash, err)
+		n.SendGetData(cb.AddrFrom, kindBlock, cb.Hash)
+		return
+	}
+
+	if err := n.bc.AddBlock(block); err != nil {
+		log.Printf("Cannot store block %x: %v\n", block.Hash, err)
+		return
+	}
+	n.abortMining()
+	n.removeBlockTxsFromMemPool(block)
+	fmt.Printf("Added compact block %x\n", block.Hash)
+}
+
+///////////////////////////////////////////
+//SEND MISSING TRANSACTIONS AND HANDLE RECEIVE MISSING TRANSACTIONS
+///////////////////////////////////////////
+
+func (n *Node) SendGetBlockTxn(addr string, blockHash []byte, indexes []int) {
+	payload := GobEncode(GetBlockTxn{n.address, blockHash, indexes})
+	request := append(getBlockTxnCmdSerial, payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) ReceiveGetBlockTxn(data []byte) {
+	var payload GetBlockTxn
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveGetBlockTxn: dropped invalid message:", err)
+		return
+	}
+
+	block, err := n.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		return
+	}
+
+	var txs [][]byte
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(block.Transactions) {
+			return
+		}
+		txs = append(txs, block.Transactions[i].Serialize())
+	}
+
+	response := GobEncode(BlockTxn{n.address, payload.BlockHash, txs})
+	request := append(sendBlockTxnCmdSerial, response...)
+	n.SendData(payload.AddrFrom, request)
+}
+
+func (n *Node) ReceiveBlockTxn(data []byte) {
+	var payload BlockTxn
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveBlockTxn: dropped invalid message:", err)
+		return
+	}
+
+	pending := n.takePendingBlock(payload.AddrFrom, payload.BlockHash)
+	if pending == nil {
+		log.Printf("Dropped unsolicited transactions of block %x from %s\n", payload.BlockHash, payload.AddrFrom)
+		return
+	}
+	if len(payload.Txs) != len(pending.missing) {
+		n.SendGetData(payload.AddrFrom, kindBlock, payload.BlockHash)
+		return
+	}
+
+	for i, index := range pending.missing {
+		tx, err := blockchain.DeserializeTransaction(payload.Txs[i])
+		if err != nil {
+			log.Println("ReceiveBlockTxn: dropped invalid message:", err)
+			return
+		}
+		pending.txs[index] = &tx
+	}
+	n.connectCompactBlock(pending.cb, pending.txs)
+}
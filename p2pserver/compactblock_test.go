@@ -0,0 +1,88 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newCompactBlockTest mines a block spending a transaction on the chain of the sender, the
+// peer node holds the chain without the block. The block is announced by an offline peer
+func newCompactBlockTest(t *testing.T) (*Node, *blockchain.Block, *blockchain.Transaction, string) {
+	blockchain.SetNetwork(blockchain.RegTest)
+	t.Cleanup(func() { blockchain.SetNetwork(blockchain.MainNet) })
+	sender, receiver := blockchain.NewWallet(), blockchain.NewWallet()
+
+	senderChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = senderChain.Close() })
+	funding, err := senderChain.Generate(1, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	peerChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = peerChain.Close() })
+	assert.NoError(t, peerChain.AddBlock(funding[0]))
+
+	tx, err := blockchain.NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, &blockchain.UTXOSet{Blockchain: senderChain})
+	assert.NoError(t, err)
+	block, err := senderChain.MineBlock([]*blockchain.Transaction{tx, blockchain.NewCoinbaseTX(string(sender.GetAddress()), "", tx.TransactionFee)})
+	assert.NoError(t, err)
+
+	offline := newTestListener(t)
+	offline.Close()
+	node := NewNode("localhost:1", offline.Addr().String(), "", peerChain)
+	return node, block, tx, offline.Addr().String()
+}
+
+func compactBlockMessage(from string, block *blockchain.Block) []byte {
+	return append(sendCompactBlockCmdSerial, GobEncode(newCompactBlock(from, block))...)
+}
+
+func blockTxnMessage(from string, block *blockchain.Block, txs ...*blockchain.Transaction) []byte {
+	var encoded [][]byte
+	for _, tx := range txs {
+		encoded = append(encoded, tx.Serialize())
+	}
+	return append(sendBlockTxnCmdSerial, GobEncode(BlockTxn{from, block.Hash, encoded})...)
+}
+
+func TestCompactBlockIsRebuiltFromTheMempool(t *testing.T) {
+	node, block, tx, peer := newCompactBlockTest(t)
+	assert.NoError(t, node.memPool.Add(tx))
+
+	node.ReceiveCompactBlock(compactBlockMessage(peer, block))
+	assert.Equal(t, string(block.Hash), node.bc.GetLastHash())
+	assert.Empty(t, node.pendingBlocks)
+	assert.Zero(t, node.memPool.Count())
+}
+
+func TestCompactBlockWaitsForTheMissingTransactions(t *testing.T) {
+	node, block, tx, peer := newCompactBlockTest(t)
+
+	node.ReceiveCompactBlock(compactBlockMessage(peer, block))
+	assert.NotEqual(t, string(block.Hash), node.bc.GetLastHash())
+	assert.Contains(t, node.pendingBlocks, pendingBlockKey(peer, block.Hash))
+
+	node.ReceiveBlockTxn(blockTxnMessage(peer, block, tx))
+	assert.Equal(t, string(block.Hash), node.bc.GetLastHash())
+	assert.Empty(t, node.pendingBlocks)
+}
+
+func TestUnsolicitedBlockTxnIsDropped(t *testing.T) {
+	node, block, tx, peer := newCompactBlockTest(t)
+
+	node.ReceiveCompactBlock(compactBlockMessage(peer, block))
+	node.ReceiveBlockTxn(blockTxnMessage("localhost:2", block, tx))
+	assert.NotEqual(t, string(block.Hash), node.bc.GetLastHash())
+	assert.Contains(t, node.pendingBlocks, pendingBlockKey(peer, block.Hash))
+
+	// The pending blocks are bounded and expire
+	asked := time.Now()
+	for i := 0; i < maxPendingBlocks; i++ {
+		node.addPendingBlock(&pendingCompactBlock{cb: CompactBlock{Hash: []byte{byte(i)}}, peer: peer, asked: asked})
+	}
+	assert.Len(t, node.pendingBlocks, maxPendingBlocks)
+	node.addPendingBlock(&pendingCompactBlock{cb: CompactBlock{Hash: block.Hash}, peer: peer, asked: asked.Add(2 * pendingBlockExpiry)})
+	assert.Len(t, node.pendingBlocks, 1)
+}
@@ -0,0 +1,104 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrHeadersNotConnected = errors.New("headers do not connect")
+
+///////////////////////////////////////////
+//SEND HEADERS AND HANDLE RECEIVE HEADERS
+///////////////////////////////////////////
+
+// SendGetHeaders asks the peer for the headers following lastHash
+func (n *Node) SendGetHeaders(addr string, lastHash []byte) {
+	payload := GobEncode(GetHeaders{n.address, lastHash})
+	request := append(getHeadersCmdSerial, payload...)
+	n.SendData(addr, request)
+}
+
+// syncHeaders asks the peer for the headers following our tip, their blocks are downloaded
+// once the headers are checked
+func (n *Node) syncHeaders(addr string) {
+	n.SendGetHeaders(addr, []byte(n.bc.GetLastHash()))
+}
+
+func (n *Node) ReceiveGetHeaders(data []byte) {
+	var payload GetHeaders
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveGetHeaders: dropped invalid message:", err)
+		return
+	}
+
+	var encoded [][]byte
+	for _, header := range n.bc.GetHeadersAfter(payload.LastHash, blockchain.MaxHeadersPerMessage) {
+		encoded = append(encoded, header.Serialize())
+	}
+	response := GobEncode(Headers{n.address, encoded})
+	request := append(sendHeadersCmdSerial, response...)
+	n.SendData(payload.AddrFrom, request)
+}
+
+// ReceiveHeaders stores the checked headers and downloads the blocks we do not have yet
+func (n *Node) ReceiveHeaders(data []byte) {
+	var payload Headers
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveHeaders: dropped invalid message:", err)
+		return
+	}
+	fmt.Printf("Received %d headers\n", len(payload.Headers))
+
+	headers, err := decodeHeaders(payload.Headers)
+	var missing [][]byte
+	if err == nil {
+		missing, err = n.bc.AddHeaders(headers)
+	}
+	if errors.Is(err, blockchain.ErrPrevBlockNotFound) {
+		err = ErrHeadersNotConnected
+	}
+	if err != nil {
+		log.Printf("Rejected headers from %s: %v\n", payload.AddrFrom, err)
+		return
+	}
+
+	// A full message means the peer may have more headers after these ones
+	more := len(headers) == blockchain.MaxHeadersPerMessage
+	if len(missing) == 0 {
+		if more {
+			n.SendGetHeaders(payload.AddrFrom, headers[len(headers)-1].BlockHash())
+			return
+		}
+		n.notifySyncDone()
+		return
+	}
+	n.setBlocksInTransit(payload.AddrFrom, missing[1:], more)
+	n.SendGetData(payload.AddrFrom, kindBlock, missing[0])
+}
+
+// decodeHeaders decodes a chain of headers, each one must have a valid proof of work
+// and follow the previous one
+func decodeHeaders(encoded [][]byte) ([]*blockchain.BlockHeader, error) {
+	var headers []*blockchain.BlockHeader
+	var prevHash []byte
+	for _, data := range encoded {
+		header, err := blockchain.DeserializeBlockHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if !blockchain.NewHeaderProofOfWork(header).Validate() {
+			return nil, blockchain.ErrInvalidProofOfWork
+		}
+		if prevHash != nil && !bytes.Equal(header.PrevBlockHash, prevHash) {
+			return nil, ErrHeadersNotConnected
+		}
+		prevHash = header.BlockHash()
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
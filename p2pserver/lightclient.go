@@ -0,0 +1,433 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"blockchaincore/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// lightClientTimeout is how long the light client waits for an answer of the full node
+const lightClientTimeout = 3 * time.Second
+
+var ErrNoAnswer = errors.New("the full node did not answer")
+
+///////////////////////////////////////////
+//SEND PROOFS TO THE LIGHT CLIENTS
+///////////////////////////////////////////
+
+func (n *Node) ReceiveGetProofs(data []byte) {
+	var payload GetProofs
+	err := GobDecode(data[commandLength:], &payload)
+	if err != nil {
+		log.Println("ReceiveGetProofs: dropped invalid message:", err)
+		return
+	}
+
+	var found []blockchain.TxProof
+	if len(payload.BlockHashes) > 0 {
+		found, err = n.bc.FindBlockTransactionProofs(payload.PubKeyHashes, payload.BlockHashes)
+	} else {
+		found, err = n.bc.FindTransactionProofs(payload.PubKeyHashes, payload.FromHash)
+	}
+	first := n.bc.PrunedHeight() + 1
+	if errors.Is(err, blockchain.ErrBlockPruned) {
+		// The light client learns that it needs a node serving older blocks
+		log.Printf("Cannot serve the proofs requested by %s, the blocks below %d are pruned\n", payload.AddrFrom, first)
+		found = nil
+	} else if err != nil {
+		log.Printf("Cannot find the proofs requested by %s: %v\n", payload.AddrFrom, err)
+		return
+	}
+	var items []ProofItem
+	for _, p := range found {
+		items = append(items, ProofItem{p.BlockHash, p.Tx.Serialize(), *p.Proof})
+	}
+	response := GobEncode(Proofs{n.address, items, first})
+	request := append(sendProofsCmdSerial, response...)
+	n.SendData(payload.AddrFrom, request)
+}
+
+///////////////////////////////////////////
+//LIGHT CLIENT
+///////////////////////////////////////////
+
+// LightClient is a wallet node without the chain. It downloads the headers and the block filters
+// from a full node, then the transactions of the watched addresses in the blocks matching the
+// filters, with their merkle proofs. A transaction is trusted once its proof matches a header
+// of the best chain.
+//
+// The headers do not commit to the filters and a single full node is asked, so the full node is
+// trusted to send the true filters and every matching transaction: a forged filter or a
+// transaction left out hides a payment of the wallet, it cannot make the wallet accept a
+// payment which is not in the best chain. Sync from a node you run or trust
+type LightClient struct {
+	address     string
+	centralNode string
+	headers     *blockchain.HeaderChain
+	transport   *Transport
+	inbox       chan []byte
+	ln          net.Listener
+
+	// syncMu makes sure that a single sync talks to the full node at a time
+	syncMu sync.Mutex
+	mu     sync.Mutex
+	// watched are the public key hashes of the addresses of the wallet
+	watched map[string][]byte
+	// txs are the verified transactions of the watched addresses by id
+	txs map[string]verifiedTx
+
+	// filters are the block filters by block hash, filteredHash is the last block filtered.
+	// They are only used by Sync
+	filters      map[string]*blockchain.GCSFilter
+	filteredHash []byte
+}
+
+type verifiedTx struct {
+	tx     *blockchain.Transaction
+	height int
+}
+
+// NewLightClient creates a light client listening on address, syncing from centralNode
+func NewLightClient(address, centralNode string, headers *blockchain.HeaderChain) *LightClient {
+	return &LightClient{
+		address:     address,
+		centralNode: centralNode,
+		headers:     headers,
+		transport:   walletTransport,
+		inbox:       make(chan []byte, 16),
+		watched:     make(map[string][]byte),
+		txs:         make(map[string]verifiedTx),
+		filters:     make(map[string]*blockchain.GCSFilter),
+	}
+}
+
+// OpenLightClient opens the header chain of the node and listens on its port for the
+// answers of the central node
+func OpenLightClient(nodeID string) (*LightClient, error) {
+	headers, err := blockchain.OpenHeaderChain(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	address := fmt.Sprintf("localhost:%s", nodeID)
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		headers.Close()
+		return nil, err
+	}
+
+	lc := NewLightClient(address, nodeConfig.CentralNode, headers)
+	lc.ln = ln
+	lc.Listen(ln)
+	return lc, nil
+}
+
+// Close stops listening and closes the header chain
+func (lc *LightClient) Close() error {
+	if lc.ln != nil {
+		lc.ln.Close()
+	}
+	return lc.headers.Close()
+}
+
+func (lc *LightClient) SetTransport(t *Transport) {
+	lc.transport = t
+}
+
+// Listen queues the messages received on ln until it is closed
+func (lc *LightClient) Listen(ln net.Listener) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			data, err := lc.transport.Receive(conn)
+			conn.Close()
+			if err != nil || len(data) < commandLength {
+				continue
+			}
+			select {
+			case lc.inbox <- data:
+			default:
+				log.Println("Light client inbox is full, dropped a message")
+			}
+		}
+	}()
+}
+
+// Watch adds the address to the addresses whose transactions are downloaded
+func (lc *LightClient) Watch(address string) error {
+	pubKeyHash, err := addressPubKeyHash(address)
+	if err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.watched[address] = pubKeyHash
+	return nil
+}
+
+// Sync downloads the new headers and filters, then the transactions of the watched addresses.
+// ErrBlockPruned is returned when the full node pruned a block holding some of them
+func (lc *LightClient) Sync() error {
+	lc.syncMu.Lock()
+	defer lc.syncMu.Unlock()
+
+	for {
+		tip, _ := lc.headers.Tip()
+		data, err := lc.request(sendHeadersCmd.Command, getHeadersCmdSerial, GetHeaders{lc.address, tip})
+		if err != nil {
+			return err
+		}
+		var payload Headers
+		if err := GobDecode(data[commandLength:], &payload); err != nil {
+			return err
+		}
+		headers, err := decodeHeaders(payload.Headers)
+		if err != nil {
+			return err
+		}
+		added, err := lc.headers.AddHeaders(headers)
+		if err != nil {
+			return err
+		}
+		if added == 0 || len(headers) < blockchain.MaxHeadersPerMessage {
+			break
+		}
+	}
+
+	if err := lc.syncFilters(); err != nil {
+		return err
+	}
+
+	lc.mu.Lock()
+	var pubKeyHashes [][]byte
+	for _, pubKeyHash := range lc.watched {
+		pubKeyHashes = append(pubKeyHashes, pubKeyHash)
+	}
+	lc.mu.Unlock()
+
+	// The matching blocks are searched on the whole best chain so that a reorganization
+	// cannot leave a stale transaction behind
+	blocks, err := lc.matchingBlocks(pubKeyHashes)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		lc.mu.Lock()
+		lc.txs = make(map[string]verifiedTx)
+		lc.mu.Unlock()
+		return nil
+	}
+	data, err := lc.request(sendProofsCmd.Command, getProofsCmdSerial, GetProofs{lc.address, pubKeyHashes, nil, blocks})
+	if err != nil {
+		return err
+	}
+	var payload Proofs
+	if err := GobDecode(data[commandLength:], &payload); err != nil {
+		return err
+	}
+	// A pruned node cannot prove the transactions of the blocks it deleted, the verified
+	// transactions are kept until a node serving them is synced from
+	if _, height, err := lc.headers.GetHeader(blocks[0]); err == nil && height < payload.FirstBlock {
+		return fmt.Errorf("%w: %s serves the blocks from %d, the wallet has transactions at %d", blockchain.ErrBlockPruned, lc.centralNode, payload.FirstBlock, height)
+	}
+
+	txs := make(map[string]verifiedTx)
+	for _, item := range payload.Items {
+		tx, err := blockchain.DeserializeTransaction(item.Tx)
+		if err != nil {
+			log.Println("Rejected invalid transaction:", err)
+			continue
+		}
+		height, err := lc.headers.VerifyTransaction(item.BlockHash, &tx, &item.Proof)
+		if err != nil {
+			log.Printf("Rejected transaction %x: %v\n", tx.ID, err)
+			continue
+		}
+		txs[hex.EncodeToString(tx.ID)] = verifiedTx{&tx, height}
+	}
+
+	lc.mu.Lock()
+	lc.txs = txs
+	lc.mu.Unlock()
+	return nil
+}
+
+// syncFilters downloads the filters of the new blocks
+func (lc *LightClient) syncFilters() error {
+	for {
+		data, err := lc.request(sendCFiltersCmd.Command, getCFiltersCmdSerial, GetCFilters{lc.address, lc.filteredHash})
+		if err != nil {
+			return err
+		}
+		var payload CFilters
+		if err := GobDecode(data[commandLength:], &payload); err != nil {
+			return err
+		}
+
+		added := 0
+		for _, item := range payload.Filters {
+			// A filter is only kept for a block of the header chain
+			if _, _, err := lc.headers.GetHeader(item.BlockHash); err != nil {
+				continue
+			}
+			filter, err := blockchain.DeserializeGCSFilter(item.Filter)
+			if err != nil {
+				return err
+			}
+			hash := hex.EncodeToString(item.BlockHash)
+			if _, ok := lc.filters[hash]; !ok {
+				added++
+			}
+			lc.filters[hash] = filter
+			lc.filteredHash = item.BlockHash
+		}
+		if added == 0 || len(payload.Filters) < blockchain.MaxFiltersPerMessage {
+			return nil
+		}
+	}
+}
+
+// matchingBlocks returns the blocks of the best chain whose filter matches one of the public
+// key hashes, in ascending order. A block without filter is always fetched
+func (lc *LightClient) matchingBlocks(pubKeyHashes [][]byte) ([][]byte, error) {
+	if len(pubKeyHashes) == 0 {
+		return nil, nil
+	}
+	var blocks [][]byte
+	hash, _ := lc.headers.Tip()
+	for len(hash) > 0 {
+		header, _, err := lc.headers.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		filter, ok := lc.filters[hex.EncodeToString(hash)]
+		if !ok || filter.MatchAny(hash, pubKeyHashes) {
+			blocks = append(blocks, hash)
+		}
+		hash = header.PrevBlockHash
+	}
+
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks, nil
+}
+
+// request sends the message to the full node and waits for its answer
+func (lc *LightClient) request(answer string, command []byte, message interface{}) ([]byte, error) {
+	// Drop the answers to a previous request
+	for len(lc.inbox) > 0 {
+		<-lc.inbox
+	}
+	if err := lc.transport.Send(lc.centralNode, append(command, GobEncode(message)...)); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(lightClientTimeout)
+	for {
+		select {
+		case data := <-lc.inbox:
+			if ByteToCmd(data[:commandLength]) == answer {
+				return data, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("%w: no %s message", ErrNoAnswer, answer)
+		}
+	}
+}
+
+// Height returns the height of the best header
+func (lc *LightClient) Height() int {
+	_, height := lc.headers.Tip()
+	return height
+}
+
+// Balance returns the value of the verified unspent outputs of the address
+func (lc *LightClient) Balance(address string) (int, error) {
+	acc, _, _, err := lc.unspent(address, -1)
+	return acc, err
+}
+
+// Confirmations returns the number of blocks confirming the transaction, false when the
+// transaction is not a verified transaction of a watched address
+func (lc *LightClient) Confirmations(txID []byte) (int, bool) {
+	lc.mu.Lock()
+	vtx, ok := lc.txs[hex.EncodeToString(txID)]
+	lc.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	return lc.Height() - vtx.height + 1, true
+}
+
+// NewTransaction builds and signs a transaction from the verified outputs of the wallet
+func (lc *LightClient) NewTransaction(wallet *blockchain.Wallet, to string, amount int) (*blockchain.Transaction, error) {
+	if !blockchain.ValidateAddress(to) {
+		return nil, blockchain.ErrInvalidAddress
+	}
+	total := amount + blockchain.CalcTxFee(amount)
+	acc, outputs, prevTXs, err := lc.unspent(string(wallet.GetAddress()), total)
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.NewTransactionFromOutputs(wallet, to, amount, acc, outputs, prevTXs)
+}
+
+// unspent collects the verified unspent outputs of the address until their value reaches
+// amount, all of them when amount is negative
+func (lc *LightClient) unspent(address string, amount int) (int, map[string][]int, map[string]blockchain.Transaction, error) {
+	pubKeyHash, err := addressPubKeyHash(address)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	spent := make(map[string]bool)
+	for _, vtx := range lc.txs {
+		if vtx.tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range vtx.tx.Vin {
+			if in.UsesKey(pubKeyHash) {
+				spent[fmt.Sprintf("%x:%d", in.Txid, in.Vout)] = true
+			}
+		}
+	}
+
+	acc := 0
+	outputs := make(map[string][]int)
+	prevTXs := make(map[string]blockchain.Transaction)
+	for id, vtx := range lc.txs {
+		for i, out := range vtx.tx.Vout {
+			if amount >= 0 && acc >= amount {
+				return acc, outputs, prevTXs, nil
+			}
+			if !out.IsLockedWithKey(pubKeyHash) || spent[fmt.Sprintf("%s:%d", id, i)] {
+				continue
+			}
+			acc += out.Value
+			outputs[id] = append(outputs[id], i)
+			prevTXs[id] = *vtx.tx
+		}
+	}
+	return acc, outputs, prevTXs, nil
+}
+
+// addressPubKeyHash returns the public key hash locked by the address
+func addressPubKeyHash(address string) ([]byte, error) {
+	if !blockchain.ValidateAddress(address) {
+		return nil, blockchain.ErrInvalidAddress
+	}
+	pubKeyHash := utils.Base58Decode([]byte(address))
+	return pubKeyHash[1 : len(pubKeyHash)-4], nil
+}
@@ -0,0 +1,89 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestLightClientVerifiesPayments(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	_ = os.Mkdir(dir+"/db", 0700)
+	_ = os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	sender, receiver := blockchain.NewWallet(), blockchain.NewWallet()
+	chain, err := blockchain.CreateBlockchain("central")
+	assert.NoError(t, err)
+	defer chain.Close()
+	_, err = chain.MineBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTX(string(sender.GetAddress()), "", 0)})
+	assert.NoError(t, err)
+	headers, err := blockchain.OpenHeaderChain("light")
+	assert.NoError(t, err)
+	defer headers.Close()
+
+	centralLn := newTestListener(t)
+	defer centralLn.Close()
+	lightLn := newTestListener(t)
+	defer lightLn.Close()
+
+	central := NewNode(centralLn.Addr().String(), centralLn.Addr().String(), "", chain)
+	go central.Serve(centralLn)
+	client := NewLightClient(lightLn.Addr().String(), central.Address(), headers)
+	client.Listen(lightLn)
+	assert.NoError(t, client.Watch(string(sender.GetAddress())))
+	assert.NoError(t, client.Watch(string(receiver.GetAddress())))
+
+	assert.NoError(t, client.Sync())
+	balance, err := client.Balance(string(sender.GetAddress()))
+	assert.NoError(t, err)
+	assert.Equal(t, blockchain.MainNet.BlockSubsidy, balance)
+
+	tx, err := client.NewTransaction(sender, string(receiver.GetAddress()), 10)
+	assert.NoError(t, err)
+	_, err = chain.MineBlock([]*blockchain.Transaction{tx, blockchain.NewCoinbaseTX(string(sender.GetAddress()), "", tx.TransactionFee)})
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.Sync())
+	assert.Equal(t, 2, client.Height())
+	confirmations, ok := client.Confirmations(tx.ID)
+	assert.True(t, ok)
+	assert.Equal(t, 1, confirmations)
+	balance, err = client.Balance(string(receiver.GetAddress()))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, balance)
+
+	_, err = client.NewTransaction(receiver, string(sender.GetAddress()), 100)
+	assert.ErrorIs(t, err, blockchain.ErrInsufficientFunds)
+}
+
+func TestLightClientReportsPrunedBlocks(t *testing.T) {
+	blockchain.SetNetwork(blockchain.RegTest)
+	defer blockchain.SetNetwork(blockchain.MainNet)
+	chain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer chain.Close()
+	assert.NoError(t, chain.EnablePruning(blockchain.RegTest.MinPruneDepth))
+	miner := blockchain.NewWallet()
+	_, err = chain.Generate(blockchain.RegTest.MinPruneDepth+2, string(miner.GetAddress()))
+	assert.NoError(t, err)
+	headers, err := blockchain.NewHeaderChain(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer headers.Close()
+
+	centralLn := newTestListener(t)
+	defer centralLn.Close()
+	lightLn := newTestListener(t)
+	defer lightLn.Close()
+	central := NewNode(centralLn.Addr().String(), centralLn.Addr().String(), "", chain)
+	go central.Serve(centralLn)
+	client := NewLightClient(lightLn.Addr().String(), central.Address(), headers)
+	client.Listen(lightLn)
+
+	// The first reward of the miner was paid in a block whose body is gone
+	assert.NoError(t, client.Watch(string(miner.GetAddress())))
+	assert.ErrorIs(t, client.Sync(), blockchain.ErrBlockPruned)
+	assert.Equal(t, blockchain.RegTest.MinPruneDepth+2, client.Height())
+}
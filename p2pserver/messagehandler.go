@@ -3,100 +3,114 @@ package p2pserver
 import (
 	"blockchaincore/blockchain"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
-	"os"
+	"time"
 )
 
 ///////////////////////////////////////////
 //SEND ADDRESS AND HANDLE RECEIVE ADDRESS
 ///////////////////////////////////////////
-func GetKnownNodes() []string {
-	var nodes []string
-	for node := range KnownNodes {
-		nodes = append(nodes, node)
-	}
-	return nodes
-}
 
 // SendGetAddress SendGetAddr returns true if already have nodes in KnownNodes
-func SendGetAddress() bool {
+func (n *Node) SendGetAddress() bool {
 
-	if len(KnownNodes) > 1 {
+	if len(n.KnownNodes()) > 1 {
 		return true
 	}
 
 	// Fetching all the nodes from the file
 	log.Println("Sending GetAddress to all the nodes from central node")
 	var r SendGetAddr
-	r.AddrFrom = myAddress
+	r.AddrFrom = n.address
 	payload := GobEncode(r)
 	request := append(getAddressesSerial, payload...)
-	SendData(CentralNode, request)
+	n.SendData(n.centralNode, request)
 	return false
 }
 
-func SendAddr(address string) {
-	nodes := Addr{GetKnownNodes()}
-	nodes.AddrList = append(nodes.AddrList, myAddress)
+func (n *Node) SendAddr(address string) {
+	nodes := Addr{n.KnownNodes()}
+	nodes.AddrList = append(nodes.AddrList, n.address)
 	payload := GobEncode(nodes)
 	request := append(sendAddrCmdSerial, payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func ReceiveAddress(data []byte) {
+func (n *Node) ReceiveAddress(data []byte) {
 	var buff bytes.Buffer
 	var addr Addr
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&addr)
 	if err != nil {
-		log.Panic(err)
-	}
-	for _, add := range addr.AddrList {
-		KnownNodes[add] = true
+		log.Println("ReceiveAddress: dropped invalid message:", err)
+		return
 	}
-	fmt.Printf("There are %d known nodes now!\n", len(KnownNodes))
+	count := n.addKnownNodes(addr.AddrList...)
+	fmt.Printf("There are %d known nodes now!\n", count)
 }
 
 ///////////////////////////////////////////
 //SEND BLOCK AND HANDLE RECEIVE BLOCK
 ///////////////////////////////////////////
 
-func SendBlock(addr string, b *blockchain.Block) {
-	d := Block{myAddress, b.Serialize()}
+func (n *Node) SendBlock(addr string, b *blockchain.Block) {
+	d := Block{n.address, b.Serialize()}
 	payload := GobEncode(d)
 	request := append(sendBlockCmdSerial, payload...)
-	SendData(addr, request)
+	n.SendData(addr, request)
 }
 
-func ReceiveBlock(data []byte, bc *blockchain.Blockchain) {
+func (n *Node) ReceiveBlock(data []byte) {
 	var buff bytes.Buffer
 	var payload Block
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveBlock: dropped invalid message:", err)
+		return
 	}
 	blockData := payload.Block
-	block := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		log.Println("ReceiveBlock: dropped invalid block:", err)
+		return
+	}
 	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
-	fmt.Printf("Added block %x\n", block.Hash)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, kindBlock, blockHash)
+	if n.bc.HasBlock(block.Hash) {
+		fmt.Printf("Block %x is already in the chain\n", block.Hash)
+	} else if err := n.bc.ValidateBlock(block); err != nil {
+		log.Printf("Rejected block %x: %v\n", block.Hash, err)
+		// Only the download from this peer is abandoned
+		n.setBlocksInTransit(payload.AddrFrom, nil, false)
+		if errors.Is(err, blockchain.ErrPrevBlockNotFound) {
+			// We are missing some blocks before this one, ask the peer for their headers
+			n.syncHeaders(payload.AddrFrom)
+		}
+		return
+	} else if err := n.bc.AddBlock(block); err != nil {
+		log.Printf("Cannot store block %x: %v\n", block.Hash, err)
+		return
+	} else {
+		n.abortMining()
+		n.removeBlockTxsFromMemPool(block)
+		fmt.Printf("Added block %x\n", block.Hash)
+	}
 
-		blocksInTransit = blocksInTransit[1:]
+	if blockHash, ok := n.nextBlockInTransit(payload.AddrFrom); ok {
+		n.SendGetData(payload.AddrFrom, kindBlock, blockHash)
+	} else if n.takeMoreHeaders(payload.AddrFrom) {
+		// The blocks of the last headers are in, ask for the next headers
+		n.syncHeaders(payload.AddrFrom)
 	} else {
-		UTXOSet := blockchain.UTXOSet{bc}
-		UTXOSet.Reindex()
+		n.notifySyncDone()
 	}
 }
 
@@ -104,33 +118,46 @@ func ReceiveBlock(data []byte, bc *blockchain.Blockchain) {
 //SEND BLOCK AND HANDLE RECEIVE BLOCK
 ///////////////////////////////////////////
 
-func SendInventory(address, kind string, items [][]byte) {
-	inv := Inventory{myAddress, kind, items}
+func (n *Node) SendInventory(address, kind string, items [][]byte) {
+	inv := Inventory{n.address, kind, items}
 	payload := GobEncode(inv)
 	request := append(sendInventoryCmdSerial, payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func ReceiveInventory(data []byte) {
+func (n *Node) ReceiveInventory(data []byte) {
 	var buff bytes.Buffer
 	var payload Inventory
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveInventory: dropped invalid message:", err)
+		return
 	}
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
 	if payload.Type == kindBlock {
-		blocksInTransit = payload.Items
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, kindBlock, blockHash)
+		// Items are ordered from the lowest block, skip the ones we already have
+		var missing [][]byte
+		for _, blockHash := range payload.Items {
+			if !n.bc.HasBlock(blockHash) {
+				missing = append(missing, blockHash)
+			}
+		}
+		if len(missing) == 0 {
+			n.notifySyncDone()
+			return
+		}
+		n.setBlocksInTransit(payload.AddrFrom, missing[1:], false)
+		n.SendGetData(payload.AddrFrom, kindBlock, missing[0])
 	}
 
 	if payload.Type == kindTx {
-		txID := payload.Items[0]
-		if memPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, kindTx, txID)
+		for _, txID := range payload.Items {
+			n.markTxKnown(payload.AddrFrom, txID)
+			if !n.memPool.Has(hex.EncodeToString(txID)) {
+				n.SendGetData(payload.AddrFrom, kindTx, txID)
+			}
 		}
 	}
 }
@@ -139,58 +166,78 @@ func ReceiveInventory(data []byte) {
 //SEND BLOCKS AND HANDLE RECEIVE BLOCKS
 ///////////////////////////////////////////
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{myAddress})
+// SendGetBlocks asks the peer for the hashes of the blocks following our tip. Our own syncs
+// go headers-first, getblocks is still answered for the older nodes
+func (n *Node) SendGetBlocks(address string) {
+	payload := GobEncode(GetBlocks{n.address, []byte(n.bc.GetLastHash())})
 	request := append(getBlocksCmdSerial, payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func ReceiveBlocks(data []byte, bc *blockchain.Blockchain) {
+func (n *Node) ReceiveBlocks(data []byte) {
 	var buff bytes.Buffer
 	var payload GetBlocks
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveBlocks: dropped invalid message:", err)
+		return
+	}
+	if first := n.bc.PrunedHeight() + 1; first > 0 {
+		// The peer needs blocks which bodies we pruned
+		if _, height, err := n.bc.GetBlockHeader(payload.LastHash); err != nil || height+1 < first {
+			log.Printf("Cannot serve %s, the blocks below %d are pruned\n", payload.AddrFrom, first)
+			return
+		}
 	}
-	blocks := bc.GetBlockHashes()
-	SendInventory(payload.AddrFrom, kindBlock, blocks)
+	blocks, err := n.bc.GetBlockHashesAfter(payload.LastHash)
+	if err != nil {
+		log.Println("Cannot read the chain:", err)
+		return
+	}
+	if len(blocks) == 0 {
+		return
+	}
+	n.SendInventory(payload.AddrFrom, kindBlock, blocks)
 }
 
 ///////////////////////////////////////////
 //SEND DATA AND HANDLE RECEIVE DATA
 ///////////////////////////////////////////
 
-func SendGetData(address string, kind string, id []byte) {
+func (n *Node) SendGetData(address string, kind string, id []byte) {
 	if kind != kindBlock && kind != kindTx {
 		log.Panic("SendGetData: unknown kind")
 	}
-	payload := GobEncode(GetData{myAddress, kind, id})
+	payload := GobEncode(GetData{n.address, kind, id})
 	request := append(getDataCmdSerial, payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func ReceiveGetData(data []byte, bc *blockchain.Blockchain) {
+func (n *Node) ReceiveGetData(data []byte) {
 	var buff bytes.Buffer
 	var payload GetData
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveGetData: dropped invalid message:", err)
+		return
 	}
 	id, rType, addrFrom := payload.ID, payload.Type, payload.AddrFrom
 	if rType == kindBlock {
-		block, err := bc.GetBlock(id)
+		block, err := n.bc.GetBlock(id)
 		if err != nil {
 			return
 		}
-		SendBlock(addrFrom, &block)
+		n.SendBlock(addrFrom, &block)
 	} else if rType == kindTx {
-		txID := hex.EncodeToString(id)
-		tx := memPool[txID]
-		SendTx(addrFrom, &tx)
+		tx, ok := n.memPool.Get(hex.EncodeToString(id))
+		if !ok {
+			return
+		}
+		n.SendTx(addrFrom, tx)
 	}
 }
 
@@ -198,14 +245,25 @@ func ReceiveGetData(data []byte, bc *blockchain.Blockchain) {
 //SEND TRANSACTION AND HANDLE RECEIVE TRANSACTION
 ///////////////////////////////////////////
 
+// SendTx sends the transaction to the node at addr, it is used by the wallets which do not
+// run a node themselves. The transaction is sent with the wallet transport
 func SendTx(addr string, tx *blockchain.Transaction) {
-	data := Tx{myAddress, tx.Serialize()}
+	data := Tx{"", tx.Serialize()}
 	payload := GobEncode(data)
 	request := append(sendTxCmdSerial, payload...)
-	SendData(addr, request)
+	if err := walletTransport.Send(addr, request); err != nil {
+		log.Printf("%s is not available\n", addr)
+	}
+}
+
+func (n *Node) SendTx(addr string, tx *blockchain.Transaction) {
+	data := Tx{n.address, tx.Serialize()}
+	payload := GobEncode(data)
+	request := append(sendTxCmdSerial, payload...)
+	n.SendData(addr, request)
 }
 
-func ReceiveTransaction(data []byte, bc *blockchain.Blockchain) {
+func (n *Node) ReceiveTransaction(data []byte) {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -213,84 +271,104 @@ func ReceiveTransaction(data []byte, bc *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveTransaction: dropped invalid message:", err)
+		return
 	}
 
 	txData := payload.Data
-	tx := blockchain.DeserializeTransaction(txData)
-	memPool[hex.EncodeToString(tx.ID)] = tx
-
-	log.Printf("My address is %s size of mempool: %d\n", myAddress, len(memPool))
-	isCentralNode := myAddress == CentralNode
-
-	if isCentralNode {
-		// Broadcast transaction to all peers
-		log.Printf("Number of known nodes: %d\n", len(KnownNodes))
-		for node := range KnownNodes {
-			if node != myAddress && node != payload.AddrFrom {
-				SendInventory(node, kindTx, [][]byte{tx.ID})
-			}
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		log.Println("ReceiveTransaction: dropped invalid transaction:", err)
+		return
+	}
+	txID := hex.EncodeToString(tx.ID)
+	n.markTxKnown(payload.AddrFrom, tx.ID)
+
+	if err := n.memPool.Add(&tx); err != nil {
+		// An echo of a relayed transaction is dropped as well
+		log.Printf("Rejected transaction %s: %v\n", txID, err)
+		return
+	}
+	poolSize := n.memPool.Count()
+
+	log.Printf("My address is %s size of mempool: %d\n", n.address, poolSize)
+
+	// Announce the transaction to the peers on the next trickle
+	n.queueTxRelay(tx.ID)
+
+	// Has miner address to receive reward
+	if len(n.mineAddr) != 0 {
+		if poolSize >= n.mineTxCount {
+			log.Println("Mining a new block")
+			n.MineTx()
 		}
 	} else {
-		// Has miner address to receive reward
-		if len(mineAddr) != 0 {
-			if len(memPool) >= mineTxCount {
-				log.Println("Mining a new block")
-				MineTx(bc)
-			}
-		} else {
-			log.Println("Mining is off")
-		}
+		log.Println("Mining is off")
 	}
 }
 
-func MineTx(bc *blockchain.Blockchain) {
-	var validTxs []*blockchain.Transaction
-	for id := range memPool {
-		fmt.Printf("Mining txid = %x\n", memPool[id].ID)
-		tx := memPool[id]
-
-		// Transaction is valid
-		if bc.VerifyTransaction(&tx) {
-			log.Printf("Transaction id %s is valid\n", id)
-			validTxs = append(validTxs, &tx)
-		} else {
-			log.Printf("Transaction id %s is invalid\n", id)
+func (n *Node) MineTx() {
+	// Transactions received while a block is being mined are picked up by the next round
+	if !n.miningMu.TryLock() {
+		return
+	}
+	defer n.miningMu.Unlock()
+
+	for n.memPool.Count() > 0 {
+		if !n.mineBlock() {
+			return
 		}
 	}
+}
 
-	if len(validTxs) == 0 {
-		fmt.Println("All transactions are invalid")
-		return
+// mineBlock mines a block assembled from the best paying transactions of the memory pool,
+// returns false when there was nothing to mine or mining failed for another reason than
+// a new tip, so that MineTx does not retry a failure forever
+func (n *Node) mineBlock() bool {
+	template, err := n.bc.NewBlockTemplate(n.memPool, blockchain.DefaultBlockTemplateConfig)
+	if err != nil {
+		log.Println("Cannot assemble a block:", err)
+		return false
+	}
+	for _, id := range template.Invalid {
+		log.Printf("Transaction id %s is invalid\n", id)
 	}
-	totalFee := 0
+	n.memPool.Remove(template.Invalid...)
 
-	for _, transaction := range validTxs {
-		totalFee += transaction.TransactionFee
+	if len(template.Transactions) == 0 {
+		fmt.Println("No transaction to mine")
+		return false
+	}
+	log.Printf("Mining %d transactions, %d bytes, total fee: %d\n", len(template.Transactions), template.Size, template.Fees)
+
+	ctx, cancel := n.miningContext()
+	defer cancel()
+	newBlock, err := n.bc.MineBlockContext(ctx, template.Txs(n.mineAddr))
+	if errors.Is(err, blockchain.ErrStaleTip) || errors.Is(err, context.Canceled) {
+		// A block arrived meanwhile, the next round mines on top of it
+		log.Println("Mining abandoned:", err)
+		return true
+	}
+	if err != nil {
+		log.Println("Cannot mine a block:", err)
+		return false
 	}
-	log.Println("Total fee:", totalFee)
+	n.connectMinedBlock(newBlock)
+	return true
+}
 
-	coinBaseTx := blockchain.NewCoinbaseTX(mineAddr, "", totalFee)
-	validTxs = append(validTxs, coinBaseTx)
-	newBlock := bc.MineBlock(validTxs)
-	utxoSet := blockchain.UTXOSet{bc}
-	utxoSet.Reindex()
+// connectMinedBlock updates the node with a block mined by itself or an external miner
+// and announces it to the peers, the chain already connected it with its UTXO set
+func (n *Node) connectMinedBlock(newBlock *blockchain.Block) {
 	fmt.Println("New block mined")
-	for _, tx := range validTxs {
-		txId := hex.EncodeToString(tx.ID)
-		delete(memPool, txId)
-	}
+	n.removeBlockTxsFromMemPool(newBlock)
 
-	for node := range KnownNodes {
-		if node != myAddress {
-			SendInventory(node, kindBlock, [][]byte{newBlock.Hash})
-			SendDeleteTxFromPool(node, validTxs)
+	// Peers rebuild the block from their mempool and drop its transactions from it
+	for _, node := range n.KnownNodes() {
+		if node != n.address {
+			n.SendCompactBlock(node, newBlock)
 		}
 	}
-
-	if len(memPool) > 0 {
-		MineTx(bc)
-	}
 }
 
 type DeleteTX struct {
@@ -298,99 +376,83 @@ type DeleteTX struct {
 	ID       [][]byte
 }
 
-func SendDeleteTxFromPool(node string, txs []*blockchain.Transaction) {
+func (n *Node) SendDeleteTxFromPool(node string, txs []*blockchain.Transaction) {
 	txIDs := make([][]byte, len(txs))
 	for i, tx := range txs {
 		txIDs[i] = tx.ID
 	}
-	r := DeleteTX{myAddress, txIDs}
+	r := DeleteTX{n.address, txIDs}
 	payload := GobEncode(r)
 	request := append(deleteTxPoolCmdSerial, payload...)
-	SendData(node, request)
+	n.SendData(node, request)
+}
+
+func (n *Node) ReceiveDeleteTxPool(data []byte) {
+	var payload = data[commandLength:]
+	var txPoolDelete = DeleteTX{}
+	var bytesBuffer bytes.Buffer
+	bytesBuffer.Write(payload)
+	decoder := gob.NewDecoder(&bytesBuffer)
+	err := decoder.Decode(&txPoolDelete)
+	if err != nil {
+		log.Println("ReceiveDeleteTxPool: dropped invalid message:", err)
+		return
+	}
+
+	for i := range txPoolDelete.ID {
+		n.memPool.Remove(hex.EncodeToString(txPoolDelete.ID[i]))
+	}
+	log.Println("Delete txs pool")
 }
 
 ///////////////////////////////////////////
 //SEND VERSION AND HANDLE RECEIVE VERSION
 ///////////////////////////////////////////
 
-func SendVersion(addr string, bc *blockchain.Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	lastHash := bc.GetLastHash()
-	payload := GobEncode(Version{nodeVersion, bestHeight, myAddress, lastHash})
+func (n *Node) SendVersion(addr string) {
+	bestHeight := n.bc.GetBestHeight()
+	lastHash := n.bc.GetLastHash()
+	payload := GobEncode(Version{nodeVersion, bestHeight, n.address, lastHash, time.Now().Unix(), blockchain.ActiveNetwork().Name, n.bc.PrunedHeight() + 1})
 	request := append(sendVersionCmdSerial, payload...)
-	SendData(addr, request)
+	n.SendData(addr, request)
 }
 
-func ReceiveVersion(data []byte, bc *blockchain.Blockchain) {
+func (n *Node) ReceiveVersion(data []byte) {
 	var buff bytes.Buffer
 	var payload Version
 	buff.Write(data[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		log.Println("ReceiveVersion: dropped invalid message:", err)
+		return
+	}
+	if network, err := blockchain.NetworkByName(payload.Network); err != nil || network.Name != blockchain.ActiveNetwork().Name {
+		log.Printf("Ignored %s, it runs on the %q network\n", payload.AddrFrom, payload.Network)
 		return
 	}
-	myHeight := bc.GetBestHeight()
+	if payload.Timestamp != 0 {
+		offset := time.Duration(payload.Timestamp-time.Now().Unix()) * time.Second
+		n.timeSource.AddTimeSample(payload.AddrFrom, offset)
+		log.Printf("Clock offset of %s is %s, network time offset is %s\n", payload.AddrFrom, offset, n.timeSource.Offset())
+	}
+
+	myHeight := n.bc.GetBestHeight()
 	otherHeight := payload.BestHeight
 
 	log.Printf("My height is %d, other height is: %d", myHeight+1, otherHeight+1)
 
-	if myHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+	if myHeight < otherHeight && payload.FirstBlock > myHeight+1 {
+		log.Printf("%s pruned the blocks from %d, it cannot sync us\n", payload.AddrFrom, myHeight+1)
+		n.notifySyncDone()
+	} else if myHeight < otherHeight {
+		n.syncHeaders(payload.AddrFrom)
 	} else if myHeight > otherHeight {
-		SendVersion(payload.AddrFrom, bc)
+		n.SendVersion(payload.AddrFrom)
 	} else {
-		// Height is equal do nothing
-	}
-
-	KnownNodes[payload.AddrFrom] = true
-}
-
-func RequestBlocks() {
-	centralNodeAddr := CentralNode
-	buildBlockChain := BuildBlockChain{myAddress}
-	payload := GobEncode(buildBlockChain)
-	request := append(getBlockChainCmdSerial, payload...)
-	SendData(centralNodeAddr, request)
-}
-
-func HandleSendBuildBlockchain(data []byte) {
-
-	var buff bytes.Buffer
-	var payload BuildBlockChain
-	buff.Write(data[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
-	}
-	addrFrom := payload.AddrFrom
-	nodeID := os.Getenv("NODE_ID")
-	file := fmt.Sprintf(blockchain.DbFile, nodeID)
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		log.Panic("File not found")
-		return
-	}
-	blockChainData, err := ioutil.ReadFile(file)
-	log.Println("Found file, and will be transfer to other node")
-	if err != nil {
-		log.Panic(err)
+		// Height is equal nothing to sync
+		n.notifySyncDone()
 	}
-	result := bytes.Join([][]byte{receiveBlockChainCmdSerial, blockChainData}, []byte{})
-	SendData(addrFrom, result)
-
-}
 
-func ReceiveBuildBlockChain(data []byte, ln net.Listener) {
-	defer ln.Close()
-	blockChainData := data[commandLength:]
-	log.Println("Build blockchain from other node")
-	nodeID := os.Getenv("NODE_ID")
-	err := ioutil.WriteFile(fmt.Sprintf(blockchain.DbFile, nodeID), blockChainData, 0644)
-	if err != nil {
-		log.Println("Error writing blockchain to file", err)
-		return
-	}
-	doneWritingBlockChain <- true
+	n.addKnownNodes(payload.AddrFrom)
 }
@@ -1,5 +1,7 @@
 package p2pserver
 
+import "blockchaincore/blockchain"
+
 type Addr struct {
 	AddrList []string
 }
@@ -11,6 +13,7 @@ type Block struct {
 
 type GetBlocks struct {
 	AddrFrom string
+	LastHash []byte
 }
 
 type GetData struct {
@@ -35,12 +38,99 @@ type Version struct {
 	BestHeight int
 	AddrFrom   string
 	LastHash   string
+	// Timestamp is the unix time of the sender, the receiver derives the clock offset of the sender
+	Timestamp int64
+	// Network is the name of the network of the sender, the main network when empty
+	Network string
+	// FirstBlock is the height of the oldest block the sender serves, a pruned node
+	// deleted the bodies of the blocks below it
+	FirstBlock int
 }
 
-type BuildBlockChain struct {
+type SendGetAddr struct {
 	AddrFrom string
 }
 
-type SendGetAddr struct {
+// CompactBlock announces a block with its header and the short ids of its transactions,
+// the transactions the peer cannot know about (the coinbase) are prefilled
+type CompactBlock struct {
+	AddrFrom string
+	// Header is the canonical encoding of the block header
+	Header    []byte
+	Hash      []byte
+	Height    int
+	ShortIDs  [][]byte
+	Prefilled []PrefilledTx
+}
+
+type PrefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+// GetBlockTxn requests the transactions of a compact block missing from the mempool
+type GetBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type BlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Txs       [][]byte
+}
+
+// GetHeaders requests the headers following LastHash, from the genesis block when it is unknown
+type GetHeaders struct {
+	AddrFrom string
+	LastHash []byte
+}
+
+// Headers holds canonically encoded headers in ascending order
+type Headers struct {
 	AddrFrom string
+	Headers  [][]byte
+}
+
+// GetProofs requests the transactions paying to or spending from the public key hashes,
+// in the blocks following FromHash, with their merkle proofs. Only the blocks of
+// BlockHashes are searched when it is set
+type GetProofs struct {
+	AddrFrom     string
+	PubKeyHashes [][]byte
+	FromHash     []byte
+	BlockHashes  [][]byte
+}
+
+type Proofs struct {
+	AddrFrom string
+	Items    []ProofItem
+	// FirstBlock is the height of the oldest block the sender serves, as in Version. A pruned
+	// sender answers without items when a requested block is below it
+	FirstBlock int
+}
+
+// ProofItem is a serialized transaction with the proof that the block commits to it
+type ProofItem struct {
+	BlockHash []byte
+	Tx        []byte
+	Proof     blockchain.MerkleProof
+}
+
+// GetCFilters requests the filters of the blocks following LastHash, from the genesis block when it is unknown
+type GetCFilters struct {
+	AddrFrom string
+	LastHash []byte
+}
+
+// CFilters holds the filters of consecutive blocks in ascending order
+type CFilters struct {
+	AddrFrom string
+	Filters  []CFilter
+}
+
+type CFilter struct {
+	BlockHash []byte
+	Filter    []byte
 }
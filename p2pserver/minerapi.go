@@ -0,0 +1,187 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"blockchaincore/types"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// MaxGenerateBlocks is the number of blocks a single generate call mines at most
+const MaxGenerateBlocks = 1000
+
+var ErrGenerateCount = errors.New("the number of blocks to generate is out of range")
+
+// MinerAPI serves the block templates of the node to external miners, which submit the solved
+// blocks back. A template lists the transactions to include, the miner adds its coinbase paying
+// coinbasevalue after them and searches the nonce. On regtest, POST /generate mines blocks
+// right away
+func (n *Node) MinerAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/getblocktemplate", n.getBlockTemplateHandler)
+	mux.HandleFunc("/submitblock", n.submitBlockHandler)
+	mux.HandleFunc("/generate", n.generateHandler)
+	return mux
+}
+
+// ServeMinerAPI serves the miner API on addr until it fails
+func (n *Node) ServeMinerAPI(addr string) error {
+	log.Println("Serving block templates on", addr)
+	return http.ListenAndServe(addr, n.MinerAPI())
+}
+
+func (n *Node) getBlockTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := blockchain.DefaultBlockTemplateConfig
+	template, err := n.bc.NewBlockTemplate(n.memPool, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	n.memPool.Remove(template.Invalid...)
+
+	resp := types.BlockTemplateInfo{
+		PreviousBlockHash: hex.EncodeToString(template.PrevBlockHash),
+		Height:            template.Height,
+		Bits:              template.TargetBits,
+		CurTime:           template.Timestamp,
+		MinTime:           template.MinTime,
+		CoinbaseValue:     template.CoinbaseValue(),
+		SizeLimit:         config.MaxBlockSize,
+		TxLimit:           config.MaxBlockTxs,
+		Transactions:      []types.BlockTemplateTxInfo{},
+	}
+	for _, tx := range template.Transactions {
+		resp.Transactions = append(resp.Transactions, types.BlockTemplateTxInfo{
+			Data:    hex.EncodeToString(tx.Tx.Serialize()),
+			TxID:    hex.EncodeToString(tx.Tx.ID),
+			Fee:     tx.Fee,
+			Size:    tx.Size,
+			Depends: tx.Depends,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (n *Node) submitBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var req types.SubmitBlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(types.SubmitBlockResponse{Result: "rejected", Message: err.Error()})
+		return
+	}
+
+	if err := n.submitBlock(req.Data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(types.SubmitBlockResponse{Result: "rejected", Message: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(types.SubmitBlockResponse{Result: "accepted"})
+}
+
+// submitBlock validates the hex encoded block solved by an external miner and connects it
+func (n *Node) submitBlock(data string) error {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	block, err := blockchain.DeserializeBlock(raw)
+	if err != nil || len(block.Hash) == 0 {
+		return errors.New("malformed block")
+	}
+	if n.bc.HasBlock(block.Hash) {
+		return errors.New("duplicate block")
+	}
+	if err := n.bc.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	if err := n.bc.AddBlock(block); err != nil {
+		return err
+	}
+	n.abortMining()
+	log.Printf("Accepted block %x from an external miner\n", block.Hash)
+	n.connectMinedBlock(block)
+	return nil
+}
+
+func (n *Node) generateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !blockchain.IsRegTest() {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(types.GenerateResponse{Message: blockchain.ErrNotRegTest.Error()})
+		return
+	}
+
+	var req types.GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(types.GenerateResponse{Message: err.Error()})
+		return
+	}
+
+	resp := types.GenerateResponse{Hashes: []string{}}
+	hashes, err := n.Generate(req.Blocks, req.Address)
+	for _, hash := range hashes {
+		resp.Hashes = append(resp.Hashes, hex.EncodeToString(hash))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Message = err.Error()
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Generate mines count blocks from the templates of the node right away, paying address.
+// It is only available on regtest, so that the tests control when the blocks are mined, and
+// mines MaxGenerateBlocks at most
+func (n *Node) Generate(count int, address string) ([][]byte, error) {
+	if !blockchain.IsRegTest() {
+		return nil, blockchain.ErrNotRegTest
+	}
+	if count < 1 || count > MaxGenerateBlocks {
+		return nil, ErrGenerateCount
+	}
+	if !blockchain.ValidateAddress(address) {
+		return nil, blockchain.ErrInvalidAddress
+	}
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+
+	var hashes [][]byte
+	for i := 0; i < count; i++ {
+		template, err := n.bc.NewBlockTemplate(n.memPool, blockchain.DefaultBlockTemplateConfig)
+		if err != nil {
+			return hashes, err
+		}
+		n.memPool.Remove(template.Invalid...)
+
+		block, err := n.bc.MineBlockContext(context.Background(), template.Txs(address))
+		if err != nil {
+			return hashes, err
+		}
+		n.connectMinedBlock(block)
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes, nil
+}
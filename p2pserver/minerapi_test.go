@@ -0,0 +1,36 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGenerateIsBoundedAndRegTestOnly(t *testing.T) {
+	bc, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = bc.Close() })
+	node := NewNode("localhost:1", "", "", bc)
+	api := httptest.NewServer(node.MinerAPI())
+	t.Cleanup(api.Close)
+	address := string(blockchain.NewWallet().GetAddress())
+
+	generate := func(blocks string) int {
+		resp, err := http.Post(api.URL+"/generate", "application/json",
+			strings.NewReader(`{"blocks":`+blocks+`,"address":"`+address+`"}`))
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, generate("1"))
+
+	blockchain.SetNetwork(blockchain.RegTest)
+	t.Cleanup(func() { blockchain.SetNetwork(blockchain.MainNet) })
+	assert.Equal(t, http.StatusBadRequest, generate("1001"))
+	assert.Equal(t, http.StatusBadRequest, generate("0"))
+	_, err = node.Generate(MaxGenerateBlocks+1, address)
+	assert.ErrorIs(t, err, ErrGenerateCount)
+}
@@ -0,0 +1,226 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// Node is a running p2p node, it owns the peers, the memory pool and the sync state.
+// The state is guarded by mu so that every connection can be handled in its own goroutine,
+// and several nodes can run in the same process
+type Node struct {
+	address     string
+	centralNode string
+	mineAddr    string
+	mineTxCount int
+	bc          *blockchain.Blockchain
+	transport   *Transport
+
+	mu         sync.Mutex
+	knownNodes map[string]bool
+	// peersFile keeps the known nodes across restarts, see LoadPeers
+	peersFile string
+	// blocksInTransit holds for each peer the blocks still to ask it for
+	blocksInTransit map[string][][]byte
+	// moreHeaders holds the peers whose headers of the blocks in transit filled a message,
+	// their next headers are asked once these blocks are in
+	moreHeaders   map[string]bool
+	memPool       *blockchain.Mempool
+	pendingBlocks map[string]*pendingCompactBlock
+	// peerKnownTxs holds for each known node the transactions it announced or we announced to it
+	peerKnownTxs map[string]*knownTxs
+	invQueue     map[string][][]byte
+	// cancelMining abandons the block being mined
+	cancelMining context.CancelFunc
+	// timeSource is the network-adjusted time, from the clock offsets of the peers
+	timeSource *blockchain.MedianTimeSource
+
+	// miningMu makes sure that a single block is mined at a time
+	miningMu    sync.Mutex
+	doneSyncing chan bool
+}
+
+// NewNode creates a node listening on address, knowing centralNode as its first peer.
+// An empty mineAddr disables mining. The pool and mining settings come from the active NodeConfig
+func NewNode(address, centralNode, mineAddr string, bc *blockchain.Blockchain) *Node {
+	timeSource := blockchain.NewMedianTimeSource()
+	if bc != nil {
+		bc.SetTimeSource(timeSource)
+	}
+	return &Node{
+		address:         address,
+		centralNode:     centralNode,
+		mineAddr:        mineAddr,
+		mineTxCount:     nodeConfig.MineTxCount,
+		bc:              bc,
+		transport:       &Transport{},
+		knownNodes:      map[string]bool{centralNode: true},
+		blocksInTransit: make(map[string][][]byte),
+		moreHeaders:     make(map[string]bool),
+		memPool:         blockchain.NewMempool(&blockchain.UTXOSet{Blockchain: bc}, nodeConfig.Mempool),
+		pendingBlocks:   make(map[string]*pendingCompactBlock),
+		peerKnownTxs:    make(map[string]*knownTxs),
+		invQueue:        make(map[string][][]byte),
+		doneSyncing:     make(chan bool, 1),
+		timeSource:      timeSource,
+	}
+}
+
+// miningContext returns the context of a new mining round, it is cancelled by abortMining
+func (n *Node) miningContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n.mu.Lock()
+	n.cancelMining = cancel
+	n.mu.Unlock()
+	return ctx, cancel
+}
+
+// abortMining stops mining on a tip which is no longer the best one
+func (n *Node) abortMining() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.cancelMining != nil {
+		n.cancelMining()
+	}
+}
+
+// SetTransport replaces the default plaintext transport, it must be called before serving
+func (n *Node) SetTransport(t *Transport) {
+	n.transport = t
+}
+
+// Address returns the address the node is listening on
+func (n *Node) Address() string {
+	return n.address
+}
+
+func (n *Node) isCentralNode() bool {
+	return n.address == n.centralNode
+}
+
+// KnownNodes returns the addresses of the peers known by the node
+func (n *Node) KnownNodes() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var nodes []string
+	for node := range n.knownNodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (n *Node) addKnownNodes(addrs ...string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	added := false
+	for _, addr := range addrs {
+		if !n.knownNodes[addr] {
+			n.knownNodes[addr] = true
+			added = true
+		}
+	}
+	if added {
+		n.savePeers()
+	}
+	return len(n.knownNodes)
+}
+
+func (n *Node) removeKnownNode(addr string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.knownNodes[addr] {
+		delete(n.knownNodes, addr)
+		n.savePeers()
+	}
+	// The relay state of the peer goes with it
+	delete(n.peerKnownTxs, addr)
+	delete(n.invQueue, addr)
+	delete(n.blocksInTransit, addr)
+	delete(n.moreHeaders, addr)
+	return len(n.knownNodes)
+}
+
+// MemPool returns the memory pool of the node
+func (n *Node) MemPool() *blockchain.Mempool {
+	return n.memPool
+}
+
+// removeBlockTxsFromMemPool drops the transactions confirmed by the block and the ones conflicting with it
+func (n *Node) removeBlockTxsFromMemPool(block *blockchain.Block) {
+	removed := n.memPool.RemoveBlockTxs(block)
+	n.forgetTxs(removed...)
+}
+
+// setBlocksInTransit replaces the blocks to ask the peer for, the other peers are not affected
+func (n *Node) setBlocksInTransit(addr string, hashes [][]byte, moreHeaders bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(hashes) == 0 {
+		delete(n.blocksInTransit, addr)
+	} else {
+		n.blocksInTransit[addr] = hashes
+	}
+	if moreHeaders {
+		n.moreHeaders[addr] = true
+	} else {
+		delete(n.moreHeaders, addr)
+	}
+}
+
+// takeMoreHeaders tells whether the peer has more headers for us, and clears the flag
+func (n *Node) takeMoreHeaders(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	more := n.moreHeaders[addr]
+	delete(n.moreHeaders, addr)
+	return more
+}
+
+// nextBlockInTransit pops the next block to request from the peer, returns false when there
+// is none left
+func (n *Node) nextBlockInTransit(addr string) ([]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	hashes := n.blocksInTransit[addr]
+	if len(hashes) == 0 {
+		return nil, false
+	}
+	if len(hashes) == 1 {
+		delete(n.blocksInTransit, addr)
+	} else {
+		n.blocksInTransit[addr] = hashes[1:]
+	}
+	return hashes[0], true
+}
+
+// notifySyncDone wakes up Sync if a sync is in progress
+func (n *Node) notifySyncDone() {
+	select {
+	case n.doneSyncing <- true:
+	default:
+	}
+}
+
+// Serve accepts the connections on ln and handles each of them in its own goroutine,
+// the transactions are relayed to the peers until ln is closed
+func (n *Node) Serve(ln net.Listener) error {
+	quit := make(chan struct{})
+	defer close(quit)
+	go n.relayLoop(quit)
+
+	for {
+		log.Println("Waiting for connection ")
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go n.HandleConnection(conn)
+	}
+}
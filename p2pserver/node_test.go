@@ -0,0 +1,197 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestListener(t *testing.T) net.Listener {
+	ln, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func TestNodesSyncInOneProcess(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	_ = os.Mkdir(dir+"/db", 0700)
+	_ = os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	wallet := blockchain.NewWallet()
+	centralChain, err := blockchain.CreateBlockchain("central")
+	assert.NoError(t, err)
+	defer centralChain.Close()
+	_, err = centralChain.MineBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTX(string(wallet.GetAddress()), "", 0)})
+	assert.NoError(t, err)
+	peerChain, err := blockchain.CreateBlockchain("peer")
+	assert.NoError(t, err)
+	defer peerChain.Close()
+
+	centralLn := newTestListener(t)
+	defer centralLn.Close()
+	peerLn := newTestListener(t)
+	defer peerLn.Close()
+
+	central := NewNode(centralLn.Addr().String(), centralLn.Addr().String(), "", centralChain)
+	peer := NewNode(peerLn.Addr().String(), central.Address(), "", peerChain)
+	go central.Serve(centralLn)
+
+	peer.Sync(peerLn)
+
+	assert.Equal(t, 1, peerChain.GetBestHeight())
+	assert.Equal(t, centralChain.GetLastHash(), peerChain.GetLastHash())
+	assert.Contains(t, central.KnownNodes(), peer.Address())
+}
+
+func TestQueueTxRelaySkipsPeersKnowingTheTx(t *testing.T) {
+	node := NewNode("localhost:1", "localhost:2", "", nil)
+	node.addKnownNodes("localhost:3", "localhost:4")
+	txID := []byte{0x01, 0x02}
+
+	node.markTxKnown("localhost:3", txID)
+	node.queueTxRelay(txID)
+	node.queueTxRelay(txID)
+
+	assert.Equal(t, [][]byte{txID}, node.invQueue["localhost:2"])
+	assert.Equal(t, [][]byte{txID}, node.invQueue["localhost:4"])
+	assert.Empty(t, node.invQueue["localhost:3"])
+	assert.Empty(t, node.invQueue["localhost:1"])
+}
+
+func TestKnownTxsAreBoundedAndDroppedWithThePeer(t *testing.T) {
+	node := NewNode("localhost:1", "localhost:2", "", nil)
+	node.addKnownNodes("localhost:3")
+
+	for i := 0; i <= maxKnownTxs; i++ {
+		node.markTxKnown("localhost:3", []byte{byte(i >> 8), byte(i)})
+	}
+	assert.Len(t, node.peerKnownTxs["localhost:3"].ids, maxKnownTxs)
+	assert.False(t, node.peerKnownTxs["localhost:3"].has("0000"))
+
+	node.markTxKnown("localhost:4", []byte{0x01})
+	assert.NotContains(t, node.peerKnownTxs, "localhost:4")
+
+	node.queueTxRelay([]byte{0xff, 0xff})
+	node.removeKnownNode("localhost:3")
+	assert.NotContains(t, node.peerKnownTxs, "localhost:3")
+	assert.NotContains(t, node.invQueue, "localhost:3")
+}
+
+// readOnlyStore fails every update, as a full disk does
+type readOnlyStore struct {
+	blockchain.ChainStore
+}
+
+func (s readOnlyStore) Update(fn func(tx blockchain.StoreTx) error) error {
+	return errors.New("read-only store")
+}
+
+func TestMiningStopsOnPersistentErrors(t *testing.T) {
+	blockchain.SetNetwork(blockchain.RegTest)
+	defer blockchain.SetNetwork(blockchain.MainNet)
+	sender, receiver := blockchain.NewWallet(), blockchain.NewWallet()
+	store := blockchain.NewMemoryStore()
+	bc, err := blockchain.CreateBlockchainInStore(store)
+	assert.NoError(t, err)
+	defer bc.Close()
+	_, err = bc.Generate(1, string(sender.GetAddress()))
+	assert.NoError(t, err)
+	tx, err := blockchain.NewUTXOTransaction(sender, string(receiver.GetAddress()), 10, &blockchain.UTXOSet{Blockchain: bc})
+	assert.NoError(t, err)
+
+	readOnly, err := blockchain.NewBlockchainFromStore(readOnlyStore{store})
+	assert.NoError(t, err)
+	node := NewNode("localhost:1", "localhost:1", string(sender.GetAddress()), readOnly)
+	assert.NoError(t, node.memPool.Add(tx))
+
+	done := make(chan struct{})
+	go func() {
+		node.MineTx()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MineTx keeps retrying")
+	}
+	assert.Equal(t, 1, node.memPool.Count())
+}
+
+func TestSyncGoesPastOneHeadersMessage(t *testing.T) {
+	blockchain.SetNetwork(blockchain.RegTest)
+	defer blockchain.SetNetwork(blockchain.MainNet)
+	wd, _ := os.Getwd()
+	_ = os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	wallet := blockchain.NewWallet()
+	centralChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer centralChain.Close()
+	_, err = centralChain.Generate(blockchain.MaxHeadersPerMessage+1, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+	peerChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer peerChain.Close()
+
+	centralLn := newTestListener(t)
+	defer centralLn.Close()
+	peerLn := newTestListener(t)
+	defer peerLn.Close()
+
+	central := NewNode(centralLn.Addr().String(), centralLn.Addr().String(), "", centralChain)
+	peer := NewNode(peerLn.Addr().String(), central.Address(), "", peerChain)
+	go central.Serve(centralLn)
+
+	peer.Sync(peerLn)
+
+	assert.Equal(t, blockchain.MaxHeadersPerMessage+1, peerChain.GetBestHeight())
+	assert.Equal(t, centralChain.GetLastHash(), peerChain.GetLastHash())
+}
+
+func TestInvalidBlockOnlyStopsTheDownloadFromItsPeer(t *testing.T) {
+	blockchain.SetNetwork(blockchain.RegTest)
+	defer blockchain.SetNetwork(blockchain.MainNet)
+	wallet := blockchain.NewWallet()
+	remoteChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer remoteChain.Close()
+	blocks, err := remoteChain.Generate(3, string(wallet.GetAddress()))
+	assert.NoError(t, err)
+	localChain, err := blockchain.CreateBlockchainInStore(blockchain.NewMemoryStore())
+	assert.NoError(t, err)
+	defer localChain.Close()
+
+	// The peer is listening so that it stays known, the other one is offline
+	peerLn := newTestListener(t)
+	defer peerLn.Close()
+	peer := peerLn.Addr().String()
+	offline := newTestListener(t)
+	offline.Close()
+	other := offline.Addr().String()
+	node := NewNode("localhost:1", peer, "", localChain)
+
+	var encoded [][]byte
+	for _, header := range remoteChain.GetHeadersAfter(nil, blockchain.MaxHeadersPerMessage) {
+		encoded = append(encoded, header.Serialize())
+	}
+	node.ReceiveHeaders(append(sendHeadersCmdSerial, GobEncode(Headers{peer, encoded})...))
+	assert.Equal(t, [][]byte{blocks[1].Hash, blocks[2].Hash}, node.blocksInTransit[peer])
+
+	invalid := *blocks[2]
+	invalid.Transactions = []*blockchain.Transaction{blockchain.NewCoinbaseTX(string(wallet.GetAddress()), "", 0)}
+	node.ReceiveBlock(append(sendBlockCmdSerial, GobEncode(Block{other, invalid.Serialize()})...))
+	assert.Equal(t, [][]byte{blocks[1].Hash, blocks[2].Hash}, node.blocksInTransit[peer])
+
+	node.ReceiveBlock(append(sendBlockCmdSerial, GobEncode(Block{peer, blocks[0].Serialize()})...))
+	assert.Equal(t, 1, localChain.GetBestHeight())
+	assert.Equal(t, [][]byte{blocks[2].Hash}, node.blocksInTransit[peer])
+}
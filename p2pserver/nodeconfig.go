@@ -0,0 +1,36 @@
+package p2pserver
+
+import "blockchaincore/blockchain"
+
+// DefaultCentralNode is the node the others sync from unless configured otherwise
+const DefaultCentralNode = "localhost:3000"
+
+// NodeConfig holds the settings of the nodes and light clients created by the process
+type NodeConfig struct {
+	// CentralNode is the first peer of a node, it syncs from it
+	CentralNode string
+	// Peers are known from the start in addition to the central node
+	Peers []string
+	// MineTxCount is the number of pool transactions a miner waits for before mining a block
+	MineTxCount int
+	Mempool     blockchain.MempoolConfig
+}
+
+var DefaultNodeConfig = NodeConfig{
+	CentralNode: DefaultCentralNode,
+	MineTxCount: 1,
+	Mempool:     blockchain.DefaultMempoolConfig,
+}
+
+// nodeConfig is set once at startup, before any node is created
+var nodeConfig = DefaultNodeConfig
+
+// SetNodeConfig selects the settings of the nodes created from now on
+func SetNodeConfig(config NodeConfig) {
+	nodeConfig = config
+}
+
+// ActiveNodeConfig returns the settings of the nodes of the process
+func ActiveNodeConfig() NodeConfig {
+	return nodeConfig
+}
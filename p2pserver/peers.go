@@ -0,0 +1,47 @@
+package p2pserver
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PeersFile keeps the addresses of the peers known by a node across restarts, one per line
+const PeersFile = "peers_%s.dat"
+
+// LoadPeers adds the peers saved in file to the known nodes, the known nodes are then saved
+// to file whenever they change
+func (n *Node) LoadPeers(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peersFile = file
+	for _, addr := range strings.Fields(string(content)) {
+		if addr != n.address {
+			n.knownNodes[addr] = true
+		}
+	}
+	return nil
+}
+
+// savePeers writes the known nodes to the peers file, n.mu must be held
+func (n *Node) savePeers() {
+	if n.peersFile == "" {
+		return
+	}
+	var addrs []string
+	for addr := range n.knownNodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	content := strings.Join(addrs, "\n") + "\n"
+	if err := ioutil.WriteFile(n.peersFile, []byte(content), 0600); err != nil {
+		log.Println("Cannot save the peers:", err)
+	}
+}
@@ -0,0 +1,136 @@
+package p2pserver
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+// trickleInterval is the delay between two inventory announcements to the peers,
+// the transactions received in between are announced in a single inv
+const trickleInterval = 2 * time.Second
+
+// expiryInterval is the delay between two checks for expired mempool transactions
+const expiryInterval = time.Minute
+
+// maxKnownTxs bounds the transactions remembered for each peer, the oldest ones are forgotten
+// first. Forgetting a transaction only risks announcing it twice
+const maxKnownTxs = 5000
+
+// knownTxs is the set of transactions a peer knows, bounded to maxKnownTxs
+type knownTxs struct {
+	ids map[string]bool
+	// order holds the ids from the oldest, the removed ones may be left in it
+	order []string
+}
+
+func newKnownTxs() *knownTxs {
+	return &knownTxs{ids: make(map[string]bool)}
+}
+
+func (k *knownTxs) has(txID string) bool {
+	return k.ids[txID]
+}
+
+// add records the transaction, forgetting the oldest ones when the set is full
+func (k *knownTxs) add(txID string) {
+	if k.ids[txID] {
+		return
+	}
+	for len(k.order) >= maxKnownTxs {
+		delete(k.ids, k.order[0])
+		k.order = k.order[1:]
+	}
+	k.ids[txID] = true
+	k.order = append(k.order, txID)
+}
+
+func (k *knownTxs) remove(txID string) {
+	delete(k.ids, txID)
+}
+
+// markTxKnown records that the peer already has the transaction, so it is never announced back.
+// Only the known nodes are tracked, the other ones are never announced anything
+func (n *Node) markTxKnown(peer string, txID []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.knownNodes[peer] {
+		return
+	}
+	n.peerKnownTxsOf(peer).add(hex.EncodeToString(txID))
+}
+
+// peerKnownTxsOf returns the transactions known by the peer, n.mu must be held
+func (n *Node) peerKnownTxsOf(peer string) *knownTxs {
+	known := n.peerKnownTxs[peer]
+	if known == nil {
+		known = newKnownTxs()
+		n.peerKnownTxs[peer] = known
+	}
+	return known
+}
+
+// queueTxRelay queues the transaction for every peer which does not know it yet,
+// it is announced on the next trickle
+func (n *Node) queueTxRelay(txID []byte) {
+	key := hex.EncodeToString(txID)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for peer := range n.knownNodes {
+		if peer == n.address {
+			continue
+		}
+		known := n.peerKnownTxsOf(peer)
+		if known.has(key) {
+			continue
+		}
+		known.add(key)
+		n.invQueue[peer] = append(n.invQueue[peer], txID)
+	}
+}
+
+// forgetTxs drops the confirmed transactions from the peers knowledge
+func (n *Node) forgetTxs(txIDs ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, known := range n.peerKnownTxs {
+		for _, txID := range txIDs {
+			known.remove(txID)
+		}
+	}
+}
+
+// flushInventory announces the queued transactions, one inv per peer
+func (n *Node) flushInventory() {
+	n.mu.Lock()
+	queue := n.invQueue
+	n.invQueue = make(map[string][][]byte)
+	n.mu.Unlock()
+
+	for peer, items := range queue {
+		n.SendInventory(peer, kindTx, items)
+	}
+}
+
+// relayLoop flushes the inventory queue on every trickle and drops the expired
+// mempool transactions until quit is closed
+func (n *Node) relayLoop(quit <-chan struct{}) {
+	ticker := time.NewTicker(trickleInterval)
+	defer ticker.Stop()
+	expiryTicker := time.NewTicker(expiryInterval)
+	defer expiryTicker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			n.flushInventory()
+		case now := <-expiryTicker.C:
+			n.forgetTxs(n.memPool.Expire(now)...)
+		}
+	}
+}
@@ -2,12 +2,8 @@ package p2pserver
 
 import (
 	"blockchaincore/blockchain"
-	"bytes"
-	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"github.com/vrecan/death"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -16,50 +12,108 @@ import (
 	"time"
 )
 
-var doneWritingBlockChain = make(chan bool)
+// StartServer runs the node until it fails, the block templates are served to external miners
+// on minerAPIAddr when set. The chain is closed on SIGINT or SIGTERM
+func StartServer(nodeID, minerAddr, minerAPIAddr string, transport *Transport) error {
+	node, err := OpenNode(nodeID, minerAddr)
+	if err != nil {
+		return err
+	}
+	defer node.bc.Close()
+	go HandleClose(node.bc)
+	node.SetTransport(transport)
+
+	return node.Run(minerAPIAddr)
+}
 
-func StartServer(nodeID, minerAddr string) {
-	myAddress = fmt.Sprintf("localhost:%s", nodeID)
-	mineAddr = minerAddr
-	ln, err := net.Listen(protocol, myAddress)
+// OpenNode opens the chain of the node once for the whole process, the p2p server and the web
+// API share it. A new node starts with an empty chain, the blocks are downloaded and validated
+// once the version handshake with the central node is done. A UTXO set left behind the tip
+// by a crash is repaired before serving, the peers known by the last run and the configured
+// ones are loaded
+func OpenNode(nodeID, minerAddr string) (*Node, error) {
+	bc, err := openOrCreateBlockchain(nodeID)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	repaired, err := blockchain.UTXOSet{Blockchain: bc}.CheckTip()
+	if err != nil {
+		bc.Close()
+		return nil, err
+	}
+	if repaired {
+		log.Println("The UTXO set did not match the tip of the chain, it was repaired")
+	}
+	node := NewNode(fmt.Sprintf("localhost:%s", nodeID), nodeConfig.CentralNode, minerAddr, bc)
+	if err := node.LoadPeers(blockchain.NetworkFilePath(PeersFile, nodeID)); err != nil {
+		bc.Close()
+		return nil, err
+	}
+	node.addKnownNodes(nodeConfig.Peers...)
+	return node, nil
+}
+
+// Blockchain returns the chain of the node
+func (n *Node) Blockchain() *blockchain.Blockchain {
+	return n.bc
+}
+
+// Run listens on the address of the node and serves the peers until the listener fails,
+// the block templates are served to external miners on minerAPIAddr when set
+func (n *Node) Run(minerAPIAddr string) error {
+	ln, err := net.Listen(protocol, n.address)
+	if err != nil {
+		return err
 	}
 	defer ln.Close()
-	file := fmt.Sprintf(blockchain.DbFile, nodeID)
 
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		// Blocking the rest of the program until the blockchain is sync from the central node
-		GetBlockFromCentralNode(ln)
+	// If not the central node
+	if !n.isCentralNode() {
+		n.SendVersion(n.centralNode)
 	}
+	log.Println("Listening on", n.address)
 
-	bc := blockchain.NewBlockchain(nodeID)
-	defer bc.Close()
-	go HandleClose(bc)
+	if minerAPIAddr != "" {
+		go func() {
+			log.Println("Miner API stopped:", n.ServeMinerAPI(minerAPIAddr))
+		}()
+	}
 
-	// If not the central node
-	if myAddress != CentralNode {
-		SendVersion(CentralNode, bc)
+	return n.Serve(ln)
+}
+
+func openOrCreateBlockchain(nodeID string) (*blockchain.Blockchain, error) {
+	file := blockchain.DbFilePath(nodeID)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return blockchain.CreateBlockchain(nodeID)
 	}
-	log.Println("Listening on port :", nodeID)
+	return blockchain.NewBlockchain(nodeID)
+}
 
-	for {
-		log.Println("Waiting for connection ")
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		go HandleConnection(conn, bc, ln)
+// SyncFromCentralNode downloads the missing blocks from the central node and returns
+// once the chain is up-to-date or the central node stops answering
+func SyncFromCentralNode(ln net.Listener) error {
+	defer ln.Close()
+	node, err := OpenNode(os.Getenv("NODE_ID"), "")
+	if err != nil {
+		return err
 	}
+	defer node.bc.Close()
 
+	node.Sync(ln)
+	return nil
 }
 
-func GetBlockFromCentralNode(ln net.Listener) {
-	if myAddress == "" {
-		myAddress = fmt.Sprintf("localhost:%s", os.Getenv("NODE_ID"))
+// Sync sends our version to the central node, downloads the headers it is ahead by then
+// their blocks, until the chain is up-to-date or the central node stops answering
+func (n *Node) Sync(ln net.Listener) {
+	fmt.Println("Syncing blockchain from central node")
+	// Drop a notification left by a previous sync
+	select {
+	case <-n.doneSyncing:
+	default:
 	}
-	fmt.Println("Requesting blockchain from central node")
-	RequestBlocks()
+	n.SendVersion(n.centralNode)
 	connCh := make(chan net.Conn)
 
 	go func(c chan net.Conn) {
@@ -67,28 +121,29 @@ func GetBlockFromCentralNode(ln net.Listener) {
 			// Blocking
 			conn, err := ln.Accept()
 			if err != nil {
-				log.Println(err)
 				log.Println("Stop listening")
+				close(c)
 				break
 			}
 			c <- conn
-			fmt.Println("Handle connection")
 		}
 	}(connCh)
 
 	for {
 		select {
-		case <-doneWritingBlockChain:
-			fmt.Println("Done writing blockchain")
+		case <-n.doneSyncing:
+			fmt.Println("Done syncing blockchain")
 			return
-		case conn := <-connCh:
-			fmt.Println("Got connection")
-			go HandleConnection(conn, nil, ln)
+		case conn, ok := <-connCh:
+			if !ok {
+				return
+			}
+			go n.HandleConnection(conn)
 		case <-time.After(time.Second * 3):
-			fmt.Println("Timeout 3s")
+			fmt.Println("Timeout 3s, stop syncing")
+			return
 		}
 	}
-
 }
 
 func HandleClose(bc *blockchain.Blockchain) {
@@ -101,12 +156,21 @@ func HandleClose(bc *blockchain.Blockchain) {
 	})
 }
 
-func HandleConnection(conn net.Conn, bc *blockchain.Blockchain, ln net.Listener) {
-
+func (n *Node) HandleConnection(conn net.Conn) {
+	defer func() {
+		// A bad message must not stop the node, nor the other nodes of the process
+		if r := recover(); r != nil {
+			log.Println("Error while handling connection: ", r)
+		}
+	}()
 	defer conn.Close()
-	data, err := ioutil.ReadAll(conn)
+	data, err := n.transport.Receive(conn)
 	if err != nil {
-		log.Panic(err)
+		log.Println("Dropped connection: ", err)
+		return
+	}
+	if len(data) < commandLength {
+		return
 	}
 
 	command := ByteToCmd(data[:commandLength])
@@ -114,43 +178,36 @@ func HandleConnection(conn net.Conn, bc *blockchain.Blockchain, ln net.Listener)
 
 	switch command {
 	case sendVersionCmd.Command:
-		ReceiveVersion(data, bc)
+		n.ReceiveVersion(data)
 	case sendAddrCmd.Command:
-		ReceiveAddress(data)
+		n.ReceiveAddress(data)
 	case sendBlockCmd.Command:
-		ReceiveBlock(data, bc)
+		n.ReceiveBlock(data)
 	case sendInventoryCmd.Command:
-		ReceiveInventory(data)
+		n.ReceiveInventory(data)
 	case getBlocksCmd.Command:
-		ReceiveBlocks(data, bc)
+		n.ReceiveBlocks(data)
 	case getDataCmd.Command:
-		ReceiveGetData(data, bc)
+		n.ReceiveGetData(data)
 	case sendTxCmd.Command:
-		ReceiveTransaction(data, bc)
-	case getBlockChainCmd.Command:
-		HandleSendBuildBlockchain(data)
-	case receiveBlockChainCmd.Command:
-		ReceiveBuildBlockChain(data, ln)
+		n.ReceiveTransaction(data)
 	case deleteTxPoolCmd.Command:
-		ReceiveDeleteTxPool(data)
+		n.ReceiveDeleteTxPool(data)
+	case sendCompactBlockCmd.Command:
+		n.ReceiveCompactBlock(data)
+	case getBlockTxnCmd.Command:
+		n.ReceiveGetBlockTxn(data)
+	case sendBlockTxnCmd.Command:
+		n.ReceiveBlockTxn(data)
+	case getHeadersCmd.Command:
+		n.ReceiveGetHeaders(data)
+	case sendHeadersCmd.Command:
+		n.ReceiveHeaders(data)
+	case getProofsCmd.Command:
+		n.ReceiveGetProofs(data)
+	case getCFiltersCmd.Command:
+		n.ReceiveGetCFilters(data)
 	default:
 		fmt.Printf("Unknown command %s\n", command)
 	}
 }
-
-func ReceiveDeleteTxPool(data []byte) {
-	var payload = data[commandLength:]
-	var txPoolDelete = DeleteTX{}
-	var bytesBuffer bytes.Buffer
-	bytesBuffer.Write(payload)
-	decoder := gob.NewDecoder(&bytesBuffer)
-	err := decoder.Decode(&txPoolDelete)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	for i := range txPoolDelete.ID {
-		delete(memPool, hex.EncodeToString(txPoolDelete.ID[i]))
-	}
-	log.Println("Delete txs pool")
-}
@@ -0,0 +1,286 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// NodeKeyFile stores the static identity key of a node
+const NodeKeyFile = "node_key_%s.dat"
+
+// handshakeMagic starts every encrypted connection, a plaintext message starts with its command
+const handshakeMagic = "\x00NX1"
+const handshakeTimeout = 5 * time.Second
+const keyLength = 32
+
+var (
+	ErrPlaintextRejected = errors.New("plaintext connection rejected")
+	ErrPeerNotAllowed    = errors.New("peer public key is not allowed")
+	ErrNoIdentity        = errors.New("node has no identity key")
+)
+
+// Identity is the static X25519 key pair identifying a node on the encrypted transport
+type Identity struct {
+	Private [keyLength]byte
+	Public  [keyLength]byte
+}
+
+func newKeyPair() (*Identity, error) {
+	var id Identity
+	if _, err := rand.Read(id.Private[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(id.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(id.Public[:], public)
+	return &id, nil
+}
+
+// NewIdentity generates a new identity key pair
+func NewIdentity() (*Identity, error) {
+	return newKeyPair()
+}
+
+// LoadOrCreateIdentity reads the identity key of the node, a new one is generated on the first run
+func LoadOrCreateIdentity(nodeID string) (*Identity, error) {
+	file := blockchain.NetworkFilePath(NodeKeyFile, nodeID)
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := blockchain.CreateNetworkDir(); err != nil {
+			return nil, err
+		}
+		return id, ioutil.WriteFile(file, []byte(hex.EncodeToString(id.Private[:])), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(private) != keyLength {
+		return nil, fmt.Errorf("invalid node key file %s", file)
+	}
+	var id Identity
+	copy(id.Private[:], private)
+	public, err := curve25519.X25519(id.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(id.Public[:], public)
+	return &id, nil
+}
+
+// PublicKeyHex returns the public key to share with the peers allow-listing this node
+func (id *Identity) PublicKeyHex() string {
+	return hex.EncodeToString(id.Public[:])
+}
+
+// walletTransport sends the transactions of the wallets and the requests of the light clients
+// of the process, see SetWalletTransport
+var walletTransport = &Transport{}
+
+// SetWalletTransport selects the transport of the wallets and of the light clients created
+// from now on, it must have an identity to reach the nodes requiring encryption
+func SetWalletTransport(t *Transport) {
+	walletTransport = t
+}
+
+// Transport sends and receives the messages of a node. Without identity the messages are
+// sent in plaintext, with an identity they are encrypted and both peers are authenticated
+// by their static keys
+type Transport struct {
+	Identity *Identity
+	// RequireEncryption rejects the plaintext incoming messages
+	RequireEncryption bool
+	// allowedPeers restricts the peers to these static keys, any peer is accepted when empty
+	allowedPeers map[[keyLength]byte]bool
+}
+
+// AllowPeer adds the hex encoded public key to the allow-list of the transport
+func (t *Transport) AllowPeer(publicKeyHex string) error {
+	key, err := hex.DecodeString(publicKeyHex)
+	if err != nil || len(key) != keyLength {
+		return fmt.Errorf("invalid peer public key %s", publicKeyHex)
+	}
+	if t.allowedPeers == nil {
+		t.allowedPeers = make(map[[keyLength]byte]bool)
+	}
+	var k [keyLength]byte
+	copy(k[:], key)
+	t.allowedPeers[k] = true
+	return nil
+}
+
+func (t *Transport) isAllowed(key []byte) bool {
+	if len(t.allowedPeers) == 0 {
+		return true
+	}
+	var k [keyLength]byte
+	copy(k[:], key)
+	return t.allowedPeers[k]
+}
+
+// Send delivers the request to addr in a single connection
+func (t *Transport) Send(addr string, data []byte) error {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if t.Identity == nil {
+		_, err = io.Copy(conn, bytes.NewReader(data))
+		return err
+	}
+	return t.sendEncrypted(conn, data)
+}
+
+// Receive reads the whole request of the connection
+func (t *Transport) Receive(conn net.Conn) ([]byte, error) {
+	reader := bufio.NewReader(conn)
+	magic, err := reader.Peek(len(handshakeMagic))
+	if err != nil || string(magic) != handshakeMagic {
+		if t.RequireEncryption {
+			return nil, ErrPlaintextRejected
+		}
+		return ioutil.ReadAll(reader)
+	}
+	return t.receiveEncrypted(conn, reader)
+}
+
+// The initiator sends its ephemeral and static keys, the responder answers with its own keys.
+// Mixing the ephemeral-ephemeral, ephemeral-static and static-ephemeral shared secrets
+// authenticates both static keys, then the request is sealed with the derived key
+func (t *Transport) sendEncrypted(conn net.Conn, data []byte) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ephemeral, err := newKeyPair()
+	if err != nil {
+		return err
+	}
+
+	hello := bytes.Join([][]byte{[]byte(handshakeMagic), ephemeral.Public[:], t.Identity.Public[:]}, []byte{})
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2*keyLength)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	remoteEphemeral, remoteStatic := reply[:keyLength], reply[keyLength:]
+	if !t.isAllowed(remoteStatic) {
+		return ErrPeerNotAllowed
+	}
+
+	key, err := deriveKey(hello, reply,
+		dh(ephemeral.Private[:], remoteEphemeral),
+		dh(ephemeral.Private[:], remoteStatic),
+		dh(t.Identity.Private[:], remoteEphemeral))
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+
+	// Every connection has its own ephemeral keys, so the key is used for a single message
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := conn.Write(aead.Seal(nil, nonce, data, nil)); err != nil {
+		return err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+func (t *Transport) receiveEncrypted(conn net.Conn, reader *bufio.Reader) ([]byte, error) {
+	if t.Identity == nil {
+		return nil, ErrNoIdentity
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	hello := make([]byte, len(handshakeMagic)+2*keyLength)
+	if _, err := io.ReadFull(reader, hello); err != nil {
+		return nil, err
+	}
+	remoteEphemeral := hello[len(handshakeMagic) : len(handshakeMagic)+keyLength]
+	remoteStatic := hello[len(handshakeMagic)+keyLength:]
+	if !t.isAllowed(remoteStatic) {
+		return nil, ErrPeerNotAllowed
+	}
+
+	ephemeral, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	reply := append(append([]byte{}, ephemeral.Public[:]...), t.Identity.Public[:]...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(hello, reply,
+		dh(ephemeral.Private[:], remoteEphemeral),
+		dh(t.Identity.Private[:], remoteEphemeral),
+		dh(ephemeral.Private[:], remoteStatic))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func dh(private, public []byte) []byte {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		// Low order point, the derived key is unusable
+		return nil
+	}
+	return shared
+}
+
+// deriveKey derives the session key from the shared secrets, bound to the handshake transcript
+func deriveKey(hello, reply []byte, secrets ...[]byte) ([]byte, error) {
+	var ikm []byte
+	for _, secret := range secrets {
+		if secret == nil {
+			return nil, errors.New("invalid handshake key")
+		}
+		ikm = append(ikm, secret...)
+	}
+	salt := sha256.Sum256(append(append([]byte{}, hello...), reply...))
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt[:], []byte("blockchain-go transport")), key)
+	return key, err
+}
@@ -0,0 +1,80 @@
+package p2pserver
+
+import (
+	"blockchaincore/blockchain"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// receiveOne sends the request with the sender transport and returns what the receiver got
+func receiveOne(t *testing.T, sender, receiver *Transport, request []byte) ([]byte, error) {
+	ln := newTestListener(t)
+	defer ln.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- result{nil, err}
+			return
+		}
+		defer conn.Close()
+		data, err := receiver.Receive(conn)
+		received <- result{data, err}
+	}()
+
+	_ = sender.Send(ln.Addr().String(), request)
+	r := <-received
+	return r.data, r.err
+}
+
+func TestEncryptedTransport(t *testing.T) {
+	senderID, _ := NewIdentity()
+	receiverID, _ := NewIdentity()
+	request := append(sendTxCmdSerial, []byte("payload")...)
+
+	sender := &Transport{Identity: senderID}
+	receiver := &Transport{Identity: receiverID, RequireEncryption: true}
+	assert.NoError(t, receiver.AllowPeer(senderID.PublicKeyHex()))
+
+	data, err := receiveOne(t, sender, receiver, request)
+	assert.NoError(t, err)
+	assert.Equal(t, request, data)
+
+	_, err = receiveOne(t, &Transport{}, receiver, request)
+	assert.ErrorIs(t, err, ErrPlaintextRejected)
+
+	strangerID, _ := NewIdentity()
+	_, err = receiveOne(t, &Transport{Identity: strangerID}, receiver, request)
+	assert.ErrorIs(t, err, ErrPeerNotAllowed)
+}
+
+func TestWalletTransactionsReachEncryptedNodes(t *testing.T) {
+	walletID, _ := NewIdentity()
+	nodeID, _ := NewIdentity()
+	node := &Transport{Identity: nodeID, RequireEncryption: true}
+	SetWalletTransport(&Transport{Identity: walletID})
+	defer SetWalletTransport(&Transport{})
+
+	ln := newTestListener(t)
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := node.Receive(conn)
+		received <- data
+	}()
+
+	SendTx(ln.Addr().String(), blockchain.NewCoinbaseTX(string(blockchain.NewWallet().GetAddress()), "", 0))
+	assert.True(t, bytes.HasPrefix(<-received, sendTxCmdSerial))
+}
@@ -1,26 +1,15 @@
 package p2pserver
 
 import (
-	"blockchaincore/blockchain"
 	"bytes"
 	"encoding/gob"
-	"io"
 	"log"
-	"net"
 )
 
 const protocol = "tcp"
 const nodeVersion = 1
 const commandLength = 12
-const CentralNode = "localhost:3000"
 
-var myAddress string
-var mineAddr string
-var KnownNodes = map[string]bool{CentralNode: true}
-var blocksInTransit = [][]byte{}
-var memPool = make(map[string]blockchain.Transaction)
-
-const mineTxCount = 1
 const kindBlock = "block"
 const kindTx = "tx"
 
@@ -46,21 +35,12 @@ func GobDecode[DataType any](data []byte, to *DataType) error {
 	return dec.Decode(to)
 }
 
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// SendData sends the request to the peer, the peer is forgotten when it is offline
+func (n *Node) SendData(addr string, data []byte) {
+	err := n.transport.Send(addr, data)
 	if err != nil {
 		// Node offline remove that node from the node list
-		log.Printf("%s is not available, remaining nodes: %d\n", addr, len(KnownNodes))
-		UpdateKnownNodes(addr)
-		return
-	}
-	defer conn.Close()
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+		remaining := n.removeKnownNode(addr)
+		log.Printf("%s is not available, remaining nodes: %d\n", addr, remaining)
 	}
 }
-
-func UpdateKnownNodes(addr string) {
-	delete(KnownNodes, addr)
-}
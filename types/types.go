@@ -18,3 +18,70 @@ type TransactionInfo struct {
 	TransactionHash string `json:"transaction_hash"`
 	TransactionFee  int    `json:"transaction_fee"`
 }
+
+type BlockTemplateTxInfo struct {
+	Data    string `json:"data"`
+	TxID    string `json:"txid"`
+	Fee     int    `json:"fee"`
+	Size    int    `json:"size"`
+	Depends []int  `json:"depends"`
+}
+
+type BlockTemplateInfo struct {
+	PreviousBlockHash string                `json:"previousblockhash"`
+	Height            int                   `json:"height"`
+	Bits              int                   `json:"bits"`
+	CurTime           int64                 `json:"curtime"`
+	MinTime           int64                 `json:"mintime"`
+	CoinbaseValue     int                   `json:"coinbasevalue"`
+	SizeLimit         int                   `json:"sizelimit"`
+	TxLimit           int                   `json:"txlimit"`
+	Transactions      []BlockTemplateTxInfo `json:"transactions"`
+}
+
+type SubmitBlockRequest struct {
+	Data string `json:"data"`
+}
+
+type SubmitBlockResponse struct {
+	Result  string `json:"result"`
+	Message string `json:"message"`
+}
+
+type HeaderInfo struct {
+	BlockHash         string `json:"block_hash"`
+	BlockHeight       int    `json:"block_height"`
+	Version           int32  `json:"version"`
+	PreviousBlockHash string `json:"previous_block_hash"`
+	MerkleRoot        string `json:"merkle_root"`
+	Timestamp         int64  `json:"timestamp"`
+	Bits              int32  `json:"bits"`
+	Nonce             int    `json:"nonce"`
+	// Raw is the hex canonical encoding hashed by the proof of work
+	Raw string `json:"raw"`
+}
+
+type TransactionProofInfo struct {
+	TransactionHash string `json:"transaction_hash"`
+	// Transaction is the hex serialized transaction, the leaf of the proof is its sha256
+	Transaction string `json:"transaction"`
+	BlockHash   string `json:"block_hash"`
+	BlockHeight int    `json:"block_height"`
+	// Header is the hex canonical header of the block, it commits to the merkle root
+	Header     string   `json:"header"`
+	MerkleRoot string   `json:"merkle_root"`
+	Index      int      `json:"index"`
+	Siblings   []string `json:"siblings"`
+}
+
+// GenerateRequest asks a regtest node to mine Blocks blocks right away, paying Address. Blocks
+// is between 1 and 1000
+type GenerateRequest struct {
+	Blocks  int    `json:"blocks"`
+	Address string `json:"address"`
+}
+
+type GenerateResponse struct {
+	Hashes  []string `json:"hashes"`
+	Message string   `json:"message,omitempty"`
+}
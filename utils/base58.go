@@ -7,7 +7,9 @@ import (
 
 var b58Alphabet = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
 
-// Base58Encode encodes a byte array to Base58
+// Base58Encode encodes a byte array to Base58, every leading zero byte is encoded as "1".
+// Older versions wrote a single "1" whatever the number of zero bytes, the addresses only
+// differ when the public key hash starts with a zero byte and the old ones never validated
 func Base58Encode(input []byte) []byte {
 	var result []byte
 
@@ -23,7 +25,7 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	ReverseBytes(result)
-	for b := range input {
+	for _, b := range input {
 		if b == 0x00 {
 			result = append([]byte{b58Alphabet[0]}, result...)
 		} else {
@@ -39,10 +41,12 @@ func Base58Decode(input []byte) []byte {
 	result := big.NewInt(0)
 	zeroBytes := 0
 
-	for b := range input {
-		if b == 0x00 {
-			zeroBytes++
+	// Every leading zero byte is encoded as the first character of the alphabet
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
 		}
+		zeroBytes++
 	}
 
 	payload := input[zeroBytes:]
@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBase58KeepsLeadingZeros(t *testing.T) {
+	for _, input := range [][]byte{{0x00, 0x00, 0x01, 0x02}, {0x00}, {0x01, 0x00}, {0xff, 0x00, 0x00}} {
+		encoded := Base58Encode(input)
+		assert.Equal(t, input, Base58Decode(encoded), "%x", input)
+	}
+	assert.Equal(t, "11", string(Base58Encode([]byte{0x00, 0x00})))
+	assert.Equal(t, "112", string(Base58Encode([]byte{0x00, 0x00, 0x01})))
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 )
 
@@ -26,20 +25,16 @@ func GetBlock(w http.ResponseWriter, request *http.Request) {
 			return
 		}
 	}()
-	blockChain := NewBlockchain(os.Getenv("NODE_ID"))
-	defer blockChain.Close()
-
 	countPr := request.URL.Query().Get("count")
 	if countPr == "" {
 		countPr = ""
 	}
 	count, _ := strconv.Atoi(countPr)
 
-	it := blockChain.Iterator()
+	it := chain.Iterator()
 	var getBlockResp GetBlockResponse
 
-	for {
-		block := it.Next()
+	for block := it.Next(); block != nil; block = it.Next() {
 		var coinbaseTx Transaction
 		for _, tx := range block.Transactions {
 			if tx.IsCoinbase() {
@@ -70,10 +65,16 @@ func GetBlock(w http.ResponseWriter, request *http.Request) {
 		}
 		getBlockResp.Blocks = append(getBlockResp.Blocks, blockInfo)
 		count--
-		if block == nil || len(block.PrevBlockHash) == 0 || count == 0 {
+		if count == 0 {
 			break
 		}
 	}
+	if err := it.Err(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
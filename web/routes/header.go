@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"blockchaincore/blockchain"
+	. "blockchaincore/types"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+type HeadersResponse struct {
+	Headers []HeaderInfo `json:"headers"`
+	Count   int          `json:"count"`
+}
+
+func newHeaderInfo(header *blockchain.BlockHeader, height int) HeaderInfo {
+	return HeaderInfo{
+		BlockHash:         hex.EncodeToString(header.BlockHash()),
+		BlockHeight:       height,
+		Version:           header.Version,
+		PreviousBlockHash: hex.EncodeToString(header.PrevBlockHash),
+		MerkleRoot:        hex.EncodeToString(header.MerkleRoot),
+		Timestamp:         header.Timestamp,
+		Bits:              header.Bits,
+		Nonce:             header.Nonce,
+		Raw:               hex.EncodeToString(header.Serialize()),
+	}
+}
+
+// GetHeaders serves the headers following the block "from", from the genesis block when
+// it is not set, for light clients and header sync
+func GetHeaders(w http.ResponseWriter, request *http.Request) {
+	count, err := strconv.Atoi(request.URL.Query().Get("count"))
+	if err != nil || count <= 0 || count > blockchain.MaxHeadersPerMessage {
+		count = blockchain.MaxHeadersPerMessage
+	}
+	from, err := hex.DecodeString(request.URL.Query().Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	height := 0
+	if _, fromHeight, err := chain.GetBlockHeader(from); err == nil {
+		height = fromHeight + 1
+	}
+	resp := HeadersResponse{Headers: []HeaderInfo{}}
+	for i, header := range chain.GetHeadersAfter(from, count) {
+		resp.Headers = append(resp.Headers, newHeaderInfo(header, height+i))
+	}
+	resp.Count = len(resp.Headers)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func GetHeaderByHash(w http.ResponseWriter, request *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(request)["hash"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	header, height, err := chain.GetBlockHeader(hash)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(newHeaderInfo(header, height))
+}
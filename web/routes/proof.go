@@ -0,0 +1,48 @@
+package routes
+
+import (
+	. "blockchaincore/types"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// GetTransactionProof serves the merkle proof that a transaction is part of a block, an SPV
+// wallet checks it against the header without downloading the block
+func GetTransactionProof(w http.ResponseWriter, request *http.Request) {
+	txID, err := hex.DecodeString(mux.Vars(request)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(Response{Message: "Invalid transaction id", Status: http.StatusBadRequest})
+		return
+	}
+
+	block, err := chain.FindTransactionBlock(txID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(Response{Message: "Transaction not found", Status: http.StatusNotFound})
+		return
+	}
+	proof, err := block.Proof(txID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := TransactionProofInfo{
+		TransactionHash: hex.EncodeToString(txID),
+		Transaction:     hex.EncodeToString(block.Transactions[proof.Index].Serialize()),
+		BlockHash:       hex.EncodeToString(block.Hash),
+		BlockHeight:     block.Height,
+		Header:          hex.EncodeToString(block.BlockHeader.Serialize()),
+		MerkleRoot:      hex.EncodeToString(block.MerkleRoot),
+		Index:           proof.Index,
+		Siblings:        []string{},
+	}
+	for _, sibling := range proof.Siblings {
+		resp.Siblings = append(resp.Siblings, hex.EncodeToString(sibling))
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
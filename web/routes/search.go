@@ -1,10 +1,8 @@
 package routes
 
 import (
-	"blockchaincore/blockchain"
 	"encoding/json"
 	"net/http"
-	"os"
 	"strconv"
 )
 
@@ -33,12 +31,10 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(data)
 	}
 
-	bc := blockchain.NewBlockchain(os.Getenv("NODE_ID"))
-	defer bc.Close()
 	heightInt, e := strconv.Atoi(search)
 	if e != nil {
 		// Is hashing of transaction
-		tx, err := bc.GetTransaction(search)
+		tx, err := chain.GetTransaction(search)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			data, _ := json.Marshal(Response{Status: http.StatusNotFound, Message: "Transaction not found"})
@@ -48,7 +44,7 @@ func Search(w http.ResponseWriter, r *http.Request) {
 			_, _ = w.Write(data)
 		}
 	} else {
-		block, e := bc.GetBlockByHeight(heightInt)
+		block, e := chain.GetBlockByHeight(heightInt)
 		if e != nil {
 			// Not found
 			w.WriteHeader(http.StatusNotFound)
@@ -1,12 +1,10 @@
 package routes
 
 import (
-	"blockchaincore/blockchain"
 	. "blockchaincore/types"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
-	"os"
 	"strconv"
 )
 
@@ -22,12 +20,9 @@ func GetTransaction(w http.ResponseWriter, request *http.Request) {
 	}
 	count, _ := strconv.Atoi(countPr)
 
-	bc := blockchain.NewBlockchain(os.Getenv("NODE_ID"))
-	defer bc.Close()
 	txResponse := TransactionResponse{}
-	it := bc.Iterator()
-	for {
-		block := it.Next()
+	it := chain.Iterator()
+	for block := it.Next(); block != nil; block = it.Next() {
 		for _, tx := range block.Transactions {
 			txResponse.Transactions = append(txResponse.Transactions, TransactionInfo{
 				FromAddress:     tx.FromAddress,
@@ -40,10 +35,15 @@ func GetTransaction(w http.ResponseWriter, request *http.Request) {
 			})
 		}
 		count--
-		if len(block.PrevBlockHash) == 0 || len(txResponse.Transactions) >= count {
+		if len(txResponse.Transactions) >= count {
 			break
 		}
 	}
+	if err := it.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Internal Server Error"))
+		return
+	}
 	txResponse.Count = len(txResponse.Transactions)
 	data, _ := json.Marshal(txResponse)
 	_, _ = w.Write(data)
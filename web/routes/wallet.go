@@ -2,6 +2,7 @@ package routes
 
 import (
 	. "blockchaincore/blockchain"
+	"blockchaincore/p2pserver"
 	"blockchaincore/types"
 	"blockchaincore/utils"
 	utils2 "blockchaincore/web/utils"
@@ -9,10 +10,30 @@ import (
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 )
 
+// lightClient serves the wallet routes in SPV mode, the chain is used when it is nil
+var lightClient *p2pserver.LightClient
+
+// SetLightClient runs the wallet routes on the light client
+func SetLightClient(lc *p2pserver.LightClient) {
+	lightClient = lc
+}
+
+// chain is the chain of the node, opened once for the process and shared by every request
+var chain *Blockchain
+
+// SetBlockchain serves the routes from the chain, it must be called before serving
+func SetBlockchain(bc *Blockchain) {
+	chain = bc
+}
+
+// SharedBlockchain returns the chain set by SetBlockchain, nil in SPV mode
+func SharedBlockchain() *Blockchain {
+	return chain
+}
+
 type Response struct {
 	Message string      `json:"message"`
 	Status  int         `json:"status"`
@@ -43,8 +64,14 @@ func CreateWalletHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	wallets, _ := NewWallets(request.NodePort)
 	address, privateKey, publicKey := wallets.CreateWallet()
-	wallets.SaveToFile(request.NodePort)
 	w.Header().Set("Content-Type", "application/json")
+	if err := wallets.SaveToFile(request.NodePort); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		data, _ := json.Marshal(Response{Message: "Server error", Status: http.StatusInternalServerError})
+		_, _ = w.Write(data)
+		return
+	}
 
 	wallet := utils.WalletData{
 		Address:    address,
@@ -114,7 +141,19 @@ func SendMoneyFromWallet(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(data)
 		return
 	}
-	utils2.SendMoney(request.PrivateAddress, request.ToAddress, request.Amount)
+	if lightClient != nil {
+		if err := utils2.SendMoneySPV(lightClient, request.PrivateAddress, request.ToAddress, request.Amount); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data, _ := json.Marshal(Response{Message: err.Error(), Status: http.StatusBadRequest})
+			_, _ = w.Write(data)
+			return
+		}
+	} else if err := utils2.SendMoney(chain, request.PrivateAddress, request.ToAddress, request.Amount); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data, _ := json.Marshal(Response{Message: err.Error(), Status: http.StatusBadRequest})
+		_, _ = w.Write(data)
+		return
+	}
 	// Ok status
 	w.WriteHeader(http.StatusOK)
 }
@@ -135,7 +174,6 @@ func GetBalance(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 	log.Println("Go getbalance")
-	nodeID := os.Getenv("NODE_ID")
 	w.Header().Set("Content-Type", "application/json")
 	var addr GetBalanceRequest
 	err := json.NewDecoder(r.Body).Decode(&addr)
@@ -144,17 +182,27 @@ func GetBalance(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(data)
 		return
 	}
-	bc := NewBlockchain(nodeID)
+	if lightClient != nil {
+		getBalanceSPV(w, addr.Address)
+		return
+	}
 	if !ValidateAddress(addr.Address) {
-		log.Panic("ERROR: Address is not valid")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(Response{Message: ErrInvalidAddress.Error(), Status: http.StatusBadRequest})
+		return
 	}
 
-	UTXOSet := UTXOSet{bc}
-	defer bc.Db.Close()
+	UTXOSet := UTXOSet{Blockchain: chain}
 	balance := 0
 	pubKeyHash := utils.Base58Decode([]byte(addr.Address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		log.Println("Error when get balance: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(Response{Message: "Server error", Status: http.StatusInternalServerError})
+		return
+	}
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
@@ -171,6 +219,27 @@ func GetBalance(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getBalanceSPV answers with the balance verified by the light client
+func getBalanceSPV(w http.ResponseWriter, address string) {
+	if err := lightClient.Watch(address); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(Response{Message: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	// A new address has no transaction until the next sync, the last verified state is served on failure
+	if err := lightClient.Sync(); err != nil {
+		log.Println("Light client sync failed: ", err)
+	}
+	balance, err := lightClient.Balance(address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(Response{Message: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(Response{Message: "Balance is", Status: http.StatusOK, Data: balance})
+}
+
 type BlockHeightResponse struct {
 	Height    int             `json:"height"`
 	BlockInfo types.BlockInfo `json:"data"`
@@ -191,8 +260,6 @@ func GetBlockByHeight(w http.ResponseWriter, r *http.Request) {
 	height := mux.Vars(r)["height"]
 	w.Header().Set("Content-Type", "application/json")
 
-	bc := NewBlockchain(os.Getenv("NODE_ID"))
-	defer bc.Close()
 	heightInt, err := strconv.Atoi(height)
 	if err != nil {
 		log.Println("GetBlockByHeight: ", err)
@@ -203,7 +270,7 @@ func GetBlockByHeight(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	block, err := bc.GetBlockByHeight(heightInt)
+	block, err := chain.GetBlockByHeight(heightInt)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		_ = json.NewEncoder(w).Encode(Response{Message: "Block not found", Status: http.StatusNotFound})
@@ -222,9 +289,7 @@ func GetTransactionByID(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(Response{Message: "Invalid transaction id", Status: http.StatusBadRequest})
 		return
 	}
-	bc := NewBlockchain(os.Getenv("NODE_ID"))
-	defer bc.Close()
-	tx, err := bc.GetTransaction(id)
+	tx, err := chain.GetTransaction(id)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		_ = json.NewEncoder(w).Encode(Response{Message: "Transaction not found", Status: http.StatusNotFound})
@@ -7,21 +7,50 @@ import (
 	"os"
 )
 
-func SendMoney(priKeyFrom, toAddress string, amount int) {
+// SendMoney spends the outputs of the wallet found in the chain of the node
+func SendMoney(bc *blockchain.Blockchain, priKeyFrom, toAddress string, amount int) error {
 	nodeID := os.Getenv("NODE_ID")
 	if !blockchain.ValidateAddress(toAddress) {
-		log.Panic("ERROR: Recipient address is not valid")
+		return blockchain.ErrInvalidAddress
 	}
-	bc := blockchain.NewBlockchain(nodeID)
-	defer bc.Db.Close()
 	wallets, err := blockchain.NewWallets(nodeID)
-	wallet := wallets.FromPrivateKey(priKeyFrom)
+	if err != nil {
+		log.Println("SendMoney: no local wallets:", err)
+	}
+	wallet, err := wallets.FromPrivateKey(priKeyFrom)
+	if err != nil {
+		return err
+	}
 
-	if err != nil || wallet == nil {
-		// Handle sync wallet from other node
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	tx, err := blockchain.NewUTXOTransaction(wallet, toAddress, amount, &UTXOSet)
+	if err != nil {
+		return err
 	}
+	p2pserver.SendTx(p2pserver.ActiveNodeConfig().CentralNode, tx)
+	return nil
+}
 
-	UTXOSet := blockchain.UTXOSet{bc}
-	tx := blockchain.NewUTXOTransaction(wallet, toAddress, amount, &UTXOSet)
-	p2pserver.SendTx(p2pserver.CentralNode, tx)
+// SendMoneySPV spends the outputs of the wallet verified by the light client
+func SendMoneySPV(lc *p2pserver.LightClient, priKeyFrom, toAddress string, amount int) error {
+	wallets, err := blockchain.NewWallets(os.Getenv("NODE_ID"))
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.FromPrivateKey(priKeyFrom)
+	if err != nil {
+		return err
+	}
+	if err := lc.Watch(string(wallet.GetAddress())); err != nil {
+		return err
+	}
+	if err := lc.Sync(); err != nil {
+		return err
+	}
+	tx, err := lc.NewTransaction(wallet, toAddress, amount)
+	if err != nil {
+		return err
+	}
+	p2pserver.SendTx(p2pserver.ActiveNodeConfig().CentralNode, tx)
+	return nil
 }
@@ -37,40 +37,33 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func StartWebServer(port string) {
-	r := mux.NewRouter()
-	//r.Use(corsMiddleware)
-	cors := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Bearer", "Bearer ", "content-type", "Origin", "Accept"}))
-	r.Use(cors)
-
-	r.HandleFunc("/", IndexHandler).Methods("GET")
-	r.HandleFunc("/create-blockchain", CreateBlockChainHandler).Methods("POST")
-
-	r.HandleFunc("/wallet/create", routes.CreateWalletHandler).Methods("POST", "OPTIONS")
-	r.HandleFunc("/wallet/access", routes.AccessWalletHandler).Methods("POST", "OPTIONS")
-	r.HandleFunc("/wallet/send", routes.SendMoneyFromWallet).Methods("POST", "OPTIONS")
-	r.HandleFunc("/wallet/getbalance", routes.GetBalance).Methods("POST", "OPTIONS")
-
-	r.HandleFunc("/block", routes.GetBlock).Methods("GET")
-	r.HandleFunc("/block/{height}", routes.GetBlockByHeight).Methods("GET")
-
-	r.HandleFunc("/transaction", routes.GetTransaction).Methods("GET")
-	r.HandleFunc("/transaction/{id}", routes.GetTransactionByID).Methods("GET")
-	r.HandleFunc("/search", routes.Search).Methods("GET")
-	r.HandleFunc("/get-balance", GetBalanceHandler).Methods("POST")
-
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":" + port,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+// StartWebServer serves the wallet and the explorer on their own. The chain of the node is opened
+// once and synced from the central node every 5 seconds. With spv, the wallet runs on a light
+// client syncing the headers and its own transactions instead of the whole chain
+func StartWebServer(port string, spv bool) {
+	var lc *p2pserver.LightClient
+	var node *p2pserver.Node
+	if spv {
+		var err error
+		lc, err = p2pserver.OpenLightClient(os.Getenv("NODE_ID"))
+		if err != nil {
+			log.Println("Cannot start the light client: ", err)
+			return
+		}
+		defer lc.Close()
+		routes.SetLightClient(lc)
+	} else {
+		var err error
+		node, err = p2pserver.OpenNode(os.Getenv("NODE_ID"), "")
+		if err != nil {
+			log.Println("Cannot open the chain: ", err)
+			return
+		}
+		defer node.Blockchain().Close()
+		routes.SetBlockchain(node.Blockchain())
 	}
 
-	r.PathPrefix("/css/").Handler(http.StripPrefix("/css/", http.FileServer(http.Dir(pathStatic+"css"))))
-	r.PathPrefix("/js/").Handler(http.StripPrefix("/js/", http.FileServer(http.Dir(pathStatic+"js"))))
+	srv := newServer(port)
 	log.Println("Starting web server on port " + port)
 	// Call sync blockchain periodically
 	go func(c chan bool) {
@@ -83,11 +76,19 @@ func StartWebServer(port string) {
 					break
 				}
 			case <-tick.C:
+				if lc != nil {
+					if err := lc.Sync(); err != nil {
+						log.Println("Light client sync failed: ", err)
+					}
+					continue
+				}
 				ln, err := net.Listen("tcp", ":"+os.Getenv("NODE_ID"))
 				if err != nil {
 					log.Println("An error occur", err)
+					continue
 				}
-				p2pserver.GetBlockFromCentralNode(ln)
+				node.Sync(ln)
+				ln.Close()
 			}
 		}
 	}(stopWebSig)
@@ -105,6 +106,52 @@ func StartWebServer(port string) {
 
 }
 
+// StartNodeWebServer serves the wallet and the explorer from the chain of a node running in the
+// same process, the p2p server keeps the chain up-to-date
+func StartNodeWebServer(port string, node *p2pserver.Node) error {
+	routes.SetBlockchain(node.Blockchain())
+	log.Println("Starting web server on port " + port)
+	return newServer(port).ListenAndServe()
+}
+
+func newServer(port string) *http.Server {
+	r := mux.NewRouter()
+	//r.Use(corsMiddleware)
+	cors := handlers.CORS(
+		handlers.AllowedOrigins([]string{"*"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Bearer", "Bearer ", "content-type", "Origin", "Accept"}))
+	r.Use(cors)
+
+	r.HandleFunc("/", IndexHandler).Methods("GET")
+	r.HandleFunc("/create-blockchain", CreateBlockChainHandler).Methods("POST")
+
+	r.HandleFunc("/wallet/create", routes.CreateWalletHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/wallet/access", routes.AccessWalletHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/wallet/send", routes.SendMoneyFromWallet).Methods("POST", "OPTIONS")
+	r.HandleFunc("/wallet/getbalance", routes.GetBalance).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/block", routes.GetBlock).Methods("GET")
+	r.HandleFunc("/block/{height}", routes.GetBlockByHeight).Methods("GET")
+	r.HandleFunc("/headers", routes.GetHeaders).Methods("GET")
+	r.HandleFunc("/header/{hash}", routes.GetHeaderByHash).Methods("GET")
+
+	r.HandleFunc("/transaction", routes.GetTransaction).Methods("GET")
+	r.HandleFunc("/transaction/{id}", routes.GetTransactionByID).Methods("GET")
+	r.HandleFunc("/transaction/{id}/proof", routes.GetTransactionProof).Methods("GET")
+	r.HandleFunc("/search", routes.Search).Methods("GET")
+	r.HandleFunc("/get-balance", GetBalanceHandler).Methods("POST")
+
+	r.PathPrefix("/css/").Handler(http.StripPrefix("/css/", http.FileServer(http.Dir(pathStatic+"css"))))
+	r.PathPrefix("/js/").Handler(http.StripPrefix("/js/", http.FileServer(http.Dir(pathStatic+"js"))))
+	return &http.Server{
+		Handler:      r,
+		Addr:         ":" + port,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+}
+
 type GetBalanceResponse struct {
 	Address string `json:"address"`
 	Balance string `json:"balance"`
@@ -129,13 +176,26 @@ func GetBalanceHandler(writer http.ResponseWriter, request *http.Request) {
 
 		return
 	}
-	bc := blockchain.NewBlockchain(nodePort)
-	utxoSet := blockchain.UTXOSet{bc}
-	defer bc.Db.Close()
+	// The chain of the node is already open, another node's chain is opened for the request
+	bc := routes.SharedBlockchain()
+	if bc == nil || (nodePort != "" && nodePort != os.Getenv("NODE_ID")) {
+		var err error
+		bc, err = blockchain.NewBlockchain(nodePort)
+		if err != nil {
+			writeBalanceError(writer, address, err)
+			return
+		}
+		defer bc.Close()
+	}
+	utxoSet := blockchain.UTXOSet{Blockchain: bc}
 	balance := 0
 	pubKeyHash := utils.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := utxoSet.FindUTXO(pubKeyHash)
+	UTXOs, err := utxoSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		writeBalanceError(writer, address, err)
+		return
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -155,6 +215,18 @@ func GetBalanceHandler(writer http.ResponseWriter, request *http.Request) {
 
 }
 
+func writeBalanceError(writer http.ResponseWriter, address string, err error) {
+	log.Println("Get balance fail: ", err)
+	writer.WriteHeader(http.StatusInternalServerError)
+	resp, _ := json.Marshal(GetBalanceResponse{
+		Address: address,
+		Balance: "0",
+		Message: err.Error(),
+		Success: false,
+	})
+	writer.Write(resp)
+}
+
 type CreateBlockResponse struct {
 	Message string `json:"message"`
 }
@@ -169,17 +241,21 @@ func CreateBlockChainHandler(writer http.ResponseWriter, request *http.Request)
 		}
 	}()
 
-	address := request.FormValue("address")
+	// The genesis block is fixed by the network, it pays no address
 	nodePort := request.FormValue("node-port")
-	if address == "" || nodePort == "" {
+	if nodePort == "" {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	bc := blockchain.CreateBlockchain(address, nodePort)
-	defer bc.Db.Close()
-
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	bc, err := blockchain.CreateBlockchain(nodePort)
+	if err != nil {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusBadRequest)
+		data, _ := json.Marshal(CreateBlockResponse{Message: err.Error()})
+		writer.Write(data)
+		return
+	}
+	defer bc.Close()
 
 	fmt.Println("Done!")
 	writer.WriteHeader(http.StatusOK)